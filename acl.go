@@ -0,0 +1,122 @@
+package fdd
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+//ACL 按来源地址的访问控制, deny优先, allow非空时仅放行匹配的地址, 规则文件可重新加载
+type ACL struct {
+	mu    sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	allowCIDRs []string
+	denyCIDRs  []string
+	allowFile  string
+	denyFile   string
+}
+
+func NewACL(allowCIDRs, denyCIDRs []string, allowFile, denyFile string) (*ACL, error) {
+	acl := &ACL{
+		allowCIDRs: allowCIDRs,
+		denyCIDRs:  denyCIDRs,
+		allowFile:  allowFile,
+		denyFile:   denyFile,
+	}
+	if err := acl.Reload(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+//Reload 重新读取规则文件, 失败时保留原有规则
+func (a *ACL) Reload() error {
+	allow, err := loadCIDRs(a.allowCIDRs, a.allowFile)
+	if err != nil {
+		return err
+	}
+	deny, err := loadCIDRs(a.denyCIDRs, a.denyFile)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.allow, a.deny = allow, deny
+	log.Info("[acl] load rules: allow ", len(allow), ", deny ", len(deny))
+	return nil
+}
+
+//Allowed 判断来源地址是否允许访问
+func (a *ACL) Allowed(ip net.IP) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadCIDRs(cidrs []string, file string) ([]*net.IPNet, error) {
+	list := append([]string(nil), cidrs...)
+	if file != "" {
+		lines, err := LoadLines(file)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, lines...)
+	}
+	return ParseCIDRs(list)
+}
+
+//ParseCIDRs 解析CIDR列表, 单个ip视为/32或/128
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, v := range list {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, errors.New("invalid address: " + v)
+			}
+			if ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+//TrustedIP 判断ip是否在信任列表中, 列表为空时信任所有来源
+func TrustedIP(nets []*net.IPNet, ip net.IP) bool {
+	if len(nets) == 0 {
+		return true
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
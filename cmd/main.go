@@ -6,19 +6,97 @@ import (
 	"net"
 	"os"
 	"os/signal"
-	"time"
+	"strconv"
+	"strings"
+	"syscall"
 
 	nested "github.com/antonfisher/nested-logrus-formatter"
 	"github.com/rocinan/fdd"
 	"github.com/sirupsen/logrus"
 )
 
+const kSrvScheme = "srv://"
+
 var (
 	log *logrus.Logger
 	la  *string
 	lp  *int
 	ra  *string
 	rp  *int
+	af  *string
+	dc  *bool
+	dh  *string
+	db  *string
+	al  *string
+	dl  *string
+	alf *string
+	dlf *string
+	rst *bool
+	sta *string
+	cr  *float64
+	cb  *int
+	mti *int
+	mui *int
+	mt  *int
+	mu  *int
+	ur  *int64
+	dr  *int64
+	iur *int64
+	idr *int64
+	rur *int64
+	rdr *int64
+	rb  *int64
+	usd *bool
+	qb  *int64
+	qib *int64
+	qpi *bool
+	qf  *string
+	qa  *string
+	qp  *string
+	qrd *int
+	qt  *int64
+	pp  *int
+	pin *string
+	ptr *string
+	pto *int
+	tp  *string
+	tpm *string
+	sp  *bool
+	src *string
+	dev *string
+	nd  *bool
+	rcb *int
+	sdb *int
+	mk  *int
+	tos *int
+	cc  *string
+	tfo *bool
+	da  *int
+	uto *int
+	bl  *int
+	um  *string
+	uo  *string
+	tc  *string
+	tca *string
+	rt  *bool
+	rsn *string
+	rca *string
+	rct *string
+	rpn *string
+	sr  *string
+	pk  *int
+	hr  *string
+	xff *bool
+	snf *string
+	ups *string
+	s5  *bool
+	s5u *string
+	s5a *string
+	tun *string
+	tk  *string
+	mx  *string
+	mxc *int
+	uot *string
 )
 
 func init() {
@@ -28,68 +106,256 @@ func init() {
 		FieldsOrder: []string{"component", "category"},
 	})
 	log.SetOutput(os.Stdout)
-	la = flag.String("la", "0.0.0.0", "listen addr")
-	ra = flag.String("ra", "", "target address ip or domain")
+	la = flag.String("la", "0.0.0.0", "listen addr: ip, interface name, or eth0:v4/eth0:v6 to follow its addresses")
+	ra = flag.String("ra", "", "target address ip, domain or srv://_service._proto.domain")
 	lp = flag.Int("lp", 9001, "listen port")
 	rp = flag.Int("rp", 0, "target port")
+	dc = flag.Bool("dns", false, "enable dns cache mode for udp forwarding to a resolver")
+	dh = flag.String("dns-hosts", "", "hosts file with static dns overrides")
+	db = flag.String("dns-block", "", "file of blocked domains, one per line")
+	al = flag.String("allow", "", "allowed source cidrs, comma separated")
+	dl = flag.String("deny", "", "denied source cidrs, comma separated")
+	alf = flag.String("allow-file", "", "file of allowed source cidrs, reloaded on SIGHUP")
+	dlf = flag.String("deny-file", "", "file of denied source cidrs, reloaded on SIGHUP")
+	rst = flag.Bool("rst", false, "reset rejected tcp connections instead of closing")
+	sta = flag.String("stats-addr", "", "serve stats as json on /stats and prometheus text on /metrics, e.g. 127.0.0.1:9090")
+	cr = flag.Float64("conn-rate", 0, "new connections per second per source ip, 0 is unlimited")
+	cb = flag.Int("conn-burst", 10, "burst of new connections per source ip")
+	mti = flag.Int("max-tcp-ip", 0, "max concurrent tcp flows per source ip")
+	mui = flag.Int("max-udp-ip", 0, "max concurrent udp sessions per source ip")
+	mt = flag.Int("max-tcp", 0, "max concurrent tcp flows of the rule")
+	mu = flag.Int("max-udp", 0, "max concurrent udp sessions of the rule")
+	ur = flag.Int64("up-rate", 0, "upload bytes per second of each tcp flow")
+	dr = flag.Int64("down-rate", 0, "download bytes per second of each tcp flow")
+	iur = flag.Int64("ip-up-rate", 0, "upload bytes per second of each source ip")
+	idr = flag.Int64("ip-down-rate", 0, "download bytes per second of each source ip")
+	rur = flag.Int64("rule-up-rate", 0, "upload bytes per second of the rule")
+	rdr = flag.Int64("rule-down-rate", 0, "download bytes per second of the rule")
+	rb = flag.Int64("rate-burst", 0, "burst bytes of rate limits, default one second of rate")
+	usd = flag.Bool("udp-shape-delay", false, "delay udp packets over rate limit instead of dropping")
+	qb = flag.Int64("quota", 0, "traffic quota bytes of the rule per period")
+	qib = flag.Int64("quota-ip", 0, "traffic quota bytes of each source ip per period")
+	qpi = flag.Bool("quota-per-ip", false, "account traffic per source ip")
+	qf = flag.String("quota-file", "", "file to persist traffic accounting")
+	qa = flag.String("quota-action", fdd.QuotaActionLog, "action when quota exceeded: block|throttle|log")
+	qp = flag.String("quota-period", fdd.QuotaPeriodMonthly, "quota reset period: daily|weekly|monthly")
+	qrd = flag.Int("quota-reset-day", 1, "day of month to reset monthly quota (1-28)")
+	qt = flag.Int64("quota-throttle", 64*1024, "bytes per second when throttled by quota")
+	pp = flag.Int("proxy-protocol", 0, "send proxy protocol header to target: 0 off, 1 or 2 (udp needs 2)")
+	pin = flag.String("proxy-in", "", "parse proxy protocol header from client: accept|require, empty to disable")
+	ptr = flag.String("proxy-trusted", "", "comma separated cidrs allowed to send proxy protocol header or client address over mux, empty trusts all")
+	pto = flag.Int("proxy-timeout", 5, "seconds to wait for proxy protocol header")
+	tp = flag.String("transparent", "", "transparent proxy mode: redirect|tproxy, forward to original dst instead of target")
+	tpm = flag.String("tproxy-map", "", "comma separated original dst to target map in transparent mode, e.g. 10.0.0.1:80=192.168.1.2:8080")
+	sp = flag.Bool("spoof", false, "use client ip as source address toward target (IP_TRANSPARENT, needs policy routing)")
+	src = flag.String("src", "", "comma separated outbound source ips, rotated per connection")
+	dev = flag.String("dev", "", "bind outbound sockets to interface (SO_BINDTODEVICE)")
+	nd = flag.Bool("nodelay", false, "set TCP_NODELAY on tcp conns")
+	rcb = flag.Int("rcvbuf", 0, "SO_RCVBUF bytes, 0 for system default")
+	sdb = flag.Int("sndbuf", 0, "SO_SNDBUF bytes, 0 for system default")
+	mk = flag.Int("mark", 0, "SO_MARK for policy routing, 0 to disable")
+	tos = flag.Int("tos", 0, "ip tos/ipv6 traffic class, dscp<<2")
+	cc = flag.String("cc", "", "tcp congestion control algorithm, e.g. bbr")
+	tfo = flag.Bool("tfo", false, "enable TCP_FASTOPEN on listen and connect")
+	da = flag.Int("defer-accept", 0, "TCP_DEFER_ACCEPT seconds, 0 to disable")
+	uto = flag.Int("user-timeout", 0, "TCP_USER_TIMEOUT milliseconds, 0 to disable")
+	bl = flag.Int("backlog", 128, "tcp listen backlog")
+	um = flag.String("unix-mode", "", "file mode of unix listen socket in octal, e.g. 0660")
+	uo = flag.String("unix-owner", "", "owner of unix listen socket: user[:group]")
+	tc = flag.String("tls-cert", "", "terminate tls on tcp listener, comma separated cert.pem:key.pem pairs selected by sni, reloaded on change")
+	tca = flag.String("tls-ca", "", "ca bundle to verify client certificates (mtls), empty to disable")
+	rt = flag.Bool("target-tls", false, "connect to target over tls")
+	rsn = flag.String("target-sni", "", "tls server name of target, default target domain or ip")
+	rca = flag.String("target-ca", "", "ca bundle to verify target certificate, default system roots")
+	rct = flag.String("target-cert", "", "client certificate for target as cert.pem:key.pem")
+	rpn = flag.String("target-pin", "", "comma separated sha256 fingerprints of target certificate, verified instead of ca unless -target-ca is set")
+	sr = flag.String("sni-route", "", "route tls conns by sni without terminating: comma separated host=ip[:port], *.domain wildcard and * default")
+	hr = flag.String("http-route", "", "route http/1.x conns by first request: comma separated host[/path]=ip[:port], *.domain wildcard and * default")
+	xff = flag.Bool("xff", false, "add X-Forwarded-For to the first request of http routed conns")
+	snf = flag.String("sniff", "", "route by protocol of first bytes: comma separated proto=ip[:port], proto is tls|http|ssh|prefix:<bytes>|regex:<expr>|timeout|*")
+	ups = flag.String("upstream", "", "reach target through proxy chain: comma separated socks5://[user:pass@]host:port or http://[user:pass@]host:port, udp needs a single socks5 proxy")
+	s5 = flag.Bool("socks5", false, "run as socks5 server, clients choose the target (connect and udp associate)")
+	s5u = flag.String("socks-user", "", "comma separated user:pass for socks5 auth, empty for no auth")
+	s5a = flag.String("socks-allow", "", "comma separated socks5 destination allowlist: ip, cidr, domain or *.domain, optional :port, empty allows all")
+	tun = flag.String("tunnel", "", "encrypted tunnel between two fdd: client encrypts toward target, server decrypts from clients")
+	tk = flag.String("tunnel-key", "", "pre-shared key of the tunnel, same on both sides, use a random key such as: openssl rand -hex 32")
+	mx = flag.String("mux", "", "multiplex conns and udp sessions over persistent conns between two fdd: client|server")
+	mxc = flag.Int("mux-conns", 2, "number of persistent conns kept by mux client")
+	uot = flag.String("udp-over-tcp", "", "carry udp sessions over one tcp conn between two fdd for networks blocking udp: client|server")
+	pk = flag.Int("peek-timeout", 5, "seconds to wait for first bytes of a conn when routing")
+	af = flag.String("af", fdd.FamilyPreferV4, "target address family: ipv4|ipv6|ipv4only|ipv6only")
 }
 
 func main() {
 	flag.Parse()
-	if *ra == "" || *rp == 0 {
+	_, _, unixTarget := fdd.UnixPath(*ra)
+	if !*s5 && *tp == "" && *sr == "" && *hr == "" && *snf == "" && (*ra == "" || (*rp == 0 && !strings.HasPrefix(*ra, kSrvScheme) && !unixTarget)) {
 		log.Error("target info is required")
 		os.Exit(-1)
 	}
 	cfg := &fdd.Config{
-		ListenPort: *lp,
-		RemotePort: *rp,
-		ListenAddr: *la,
-		RemoteAddr: *ra,
-		UdpTimeOut: 50,
-		HandlerCap: 2048,
+		ListenPort:   *lp,
+		RemotePort:   *rp,
+		ListenAddr:   *la,
+		RemoteAddr:   *ra,
+		UdpTimeOut:   50,
+		HandlerCap:   2048,
+		AddrFamily:   *af,
+		Backends:     fdd.NewBackendSet(),
+		DnsCache:     *dc,
+		DnsHostsFile: *dh,
+		DnsBlockFile: *db,
+		AllowCIDRs:   splitList(*al),
+		DenyCIDRs:    splitList(*dl),
+		AllowFile:    *alf,
+		DenyFile:     *dlf,
+		AclReset:     *rst,
+		StatsAddr:    *sta,
+
+		ConnRate:       *cr,
+		ConnBurst:      *cb,
+		MaxTcpPerIP:    *mti,
+		MaxUdpPerIP:    *mui,
+		MaxTcpFlows:    *mt,
+		MaxUdpSessions: *mu,
+
+		UpRate:        *ur,
+		DownRate:      *dr,
+		IPUpRate:      *iur,
+		IPDownRate:    *idr,
+		RuleUpRate:    *rur,
+		RuleDownRate:  *rdr,
+		RateBurst:     *rb,
+		UdpShapeDelay: *usd,
+
+		QuotaBytes:    *qb,
+		QuotaIPBytes:  *qib,
+		QuotaPerIP:    *qpi,
+		QuotaFile:     *qf,
+		QuotaAction:   *qa,
+		QuotaPeriod:   *qp,
+		QuotaResetDay: *qrd,
+		QuotaThrottle: *qt,
+
+		ProxyProtocol:      *pp,
+		ProxyProtocolIn:    *pin,
+		ProxyTrusted:       splitList(*ptr),
+		ProxyHeaderTimeout: *pto,
+
+		Transparent: *tp,
+		SpoofSource: *sp,
+		SourceAddrs: splitList(*src),
+		BindDevice:  *dev,
+		TLSCerts:    splitList(*tc),
+		TLSClientCA: *tca,
+
+		RemoteTLS:           *rt,
+		RemoteTLSServerName: *rsn,
+		RemoteTLSCA:         *rca,
+		RemoteTLSCert:       *rct,
+		RemoteTLSPins:       splitList(*rpn),
+
+		SNIRoutes:     splitList(*sr),
+		HTTPRoutes:    splitList(*hr),
+		XForwardedFor: *xff,
+		SniffRoutes:   splitList(*snf),
+		PeekTimeout:   *pk,
+
+		Upstreams: splitList(*ups),
+
+		SocksServer: *s5,
+		SocksUsers:  splitList(*s5u),
+		SocksAllow:  splitList(*s5a),
+
+		Tunnel:    *tun,
+		TunnelKey: *tk,
+
+		Mux:        *mx,
+		MuxConns:   *mxc,
+		UdpOverTCP: *uot,
+	}
+	tuning := fdd.SocketTuning{
+		NoDelay:     *nd,
+		RcvBuf:      *rcb,
+		SndBuf:      *sdb,
+		Mark:        *mk,
+		TOS:         *tos,
+		Congestion:  *cc,
+		FastOpen:    *tfo,
+		DeferAccept: *da,
+		UserTimeout: *uto,
+		Backlog:     *bl,
+	}
+	if (tuning != fdd.SocketTuning{Backlog: 128}) {
+		cfg.Tuning = &tuning
+	}
+	if m, err := fdd.ParseTransparentMap(splitList(*tpm)); err != nil {
+		log.Error(err)
+		os.Exit(-1)
+	} else {
+		cfg.TransparentMap = m
 	}
 	rp := new(fdd.Fdd)
-	CheckDomain(cfg)
+	if cfg.RemoteAddr != "" && !unixTarget {
+		CheckDomain(cfg)
+	}
+	if *um != "" {
+		mode, err := strconv.ParseUint(*um, 8, 32)
+		if err != nil {
+			log.Error("invalid unix socket mode: ", *um)
+			os.Exit(-1)
+		}
+		cfg.UnixMode = os.FileMode(mode)
+	}
+	cfg.UnixOwner = *uo
 	if err := rp.Start(cfg); err != nil {
 		log.Error(err)
 		os.Exit(-1)
 	}
 	log.Info("Start Service Successfully")
 	log.Info("PID: ", os.Getpid())
-	log.Info("DIR: " + fmt.Sprintf("%s:%d => %s:%d", cfg.ListenAddr, cfg.ListenPort, cfg.RemoteAddr, cfg.RemotePort))
+	if cfg.SocksServer {
+		log.Info("DIR: " + fmt.Sprintf("%s:%d => socks5", cfg.ListenAddr, cfg.ListenPort))
+	} else if cfg.Transparent != "" {
+		log.Info("DIR: " + fmt.Sprintf("%s:%d => original dst (%s)", cfg.ListenAddr, cfg.ListenPort, cfg.Transparent))
+	} else if cfg.RemoteAddr == "" {
+		log.Info("DIR: " + fmt.Sprintf("%s:%d => routes", cfg.ListenAddr, cfg.ListenPort))
+	} else {
+		log.Info("DIR: " + fmt.Sprintf("%s:%d => %s:%d", cfg.ListenAddr, cfg.ListenPort, cfg.RemoteAddr, cfg.RemotePort))
+	}
 	//wait exit
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
-	<-signalChan
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGHUP, syscall.SIGUSR1)
+	for sig := range signalChan {
+		if sig == syscall.SIGUSR1 {
+			log.Info("stats: ", rp.Stats())
+			continue
+		}
+		if sig != syscall.SIGHUP {
+			break
+		}
+		log.Info("reload config")
+		if err := rp.Reload(); err != nil {
+			log.Error("reload config err: ", err)
+		}
+	}
 	fmt.Println()
 	rp.Stop()
 }
 
 func CheckDomain(cfg *fdd.Config) {
-	if net.ParseIP(cfg.RemoteAddr) == nil {
+	if strings.HasPrefix(cfg.RemoteAddr, kSrvScheme) {
+		log.Info("srv target detected")
+		cfg.TargetSrv = strings.TrimPrefix(cfg.RemoteAddr, kSrvScheme)
+	} else if net.ParseIP(cfg.RemoteAddr) == nil {
 		log.Info("domain detected")
 		cfg.TargetDomain = cfg.RemoteAddr
-		log.Info("start resolver domain...")
-		if ip, err := fdd.GetDomainIp(cfg.TargetDomain); err != nil || ip == "" {
-			log.Error("resolver domain err:", err, cfg.TargetDomain, ip)
-			os.Exit(-1)
-		} else {
-			cfg.RemoteAddr = ip
-			log.Info("resolver successful: " + cfg.TargetDomain + " => " + ip)
-			ticker := time.NewTicker(time.Minute * 5)
-			log.Info("start resolver loop(5 min)")
-			defer ticker.Stop()
-			go func() {
-				for range ticker.C {
-					if ip, err := fdd.GetDomainIp(cfg.TargetDomain); err != nil || ip == "" {
-						log.Error("resolver domain err:", err, cfg.TargetDomain, ip)
-						os.Exit(-1)
-					} else {
-						cfg.RemoteAddr = ip
-						log.Info("resolver successful: " + cfg.TargetDomain + " => " + ip)
-					}
-				}
-			}()
-		}
 	}
 }
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -3,7 +3,7 @@ package fdd
 import (
 	"crypto/md5"
 	"encoding/hex"
-	"fmt"
+	"errors"
 	"net"
 	"strconv"
 
@@ -11,82 +11,231 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-//socket常用操作方法封装 //todo ipv6 support
-//CreateTcpListenSocket 根据地址端口创建tcp监听socket
-func CreateTcpListenSocket(addr string, port int) (int, error) {
-	if fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_TCP); err != nil {
+//socket常用操作方法封装
+//listenSockAddr 解析监听地址, 非法地址返回错误而不是默认为0.0.0.0
+func listenSockAddr(addr string, port int) (unix.Sockaddr, error) {
+	if net.ParseIP(addr) == nil {
+		return nil, errors.New("invalid listen addr: " + addr)
+	}
+	return SockAddrParse(addr, port), nil
+}
+
+//setV6Only 非通配的ipv6地址只接收ipv6, 避免与同端口的ipv4监听冲突
+func setV6Only(fd int, sa unix.Sockaddr) {
+	if v, ok := sa.(*unix.SockaddrInet6); ok && !net.IP(v.Addr[:]).IsUnspecified() {
+		unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 1)
+	}
+}
+
+//CreateTcpListenSocket 根据地址端口创建tcp监听socket, 支持ipv4/ipv6
+func CreateTcpListenSocket(addr string, port int, st *SocketTuning) (int, error) {
+	socketAddr, err := listenSockAddr(addr, port)
+	if err != nil {
+		return 0, err
+	}
+	family := SockAddrFamily(socketAddr)
+	if fd, err := unix.Socket(family, unix.SOCK_STREAM, unix.IPPROTO_TCP); err != nil {
 		return 0, err
 	} else {
 		SetNoBlock(fd)
 		SetReUseAddr(fd)
-		socketAddr := unix.SockaddrInet4{Port: port}
-		copy(socketAddr.Addr[:], net.ParseIP(addr).To4())
-		if err := unix.Bind(fd, &socketAddr); err != nil {
+		setV6Only(fd, socketAddr)
+		if err := st.applyListen(fd, family); err != nil {
+			CloseSocket(fd)
+			return 0, err
+		}
+		if err := unix.Bind(fd, socketAddr); err != nil {
+			CloseSocket(fd)
 			return 0, err
 		}
-		if err := unix.Listen(fd, 128); err != nil {
+		if err := unix.Listen(fd, st.backlog()); err != nil {
+			CloseSocket(fd)
 			return 0, err
 		}
 		return fd, nil
 	}
 }
 
-//CreateUdpListenSocket 根据地址创建udp socket
-func CreateUdpListenSocket(addr string, port int) (int, error) {
-	if fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_UDP); err != nil {
+//CreateUdpListenSocket 根据地址创建udp socket, 支持ipv4/ipv6
+func CreateUdpListenSocket(addr string, port int, st *SocketTuning) (int, error) {
+	socketAddr, err := listenSockAddr(addr, port)
+	if err != nil {
+		return 0, err
+	}
+	family := SockAddrFamily(socketAddr)
+	if fd, err := unix.Socket(family, unix.SOCK_DGRAM, unix.IPPROTO_UDP); err != nil {
 		return 0, err
 	} else {
 		defer SetNoBlock(fd)
 		SetReUseAddr(fd)
-		socketAddr := unix.SockaddrInet4{Port: port}
-		copy(socketAddr.Addr[:], net.ParseIP(addr).To4())
-		if err := unix.Bind(fd, &socketAddr); err != nil {
+		setV6Only(fd, socketAddr)
+		if err := st.applyCommon(fd, family, false); err != nil {
+			CloseSocket(fd)
+			return 0, err
+		}
+		if err := unix.Bind(fd, socketAddr); err != nil {
+			CloseSocket(fd)
 			return 0, err
 		}
 		return fd, nil
 	}
 }
 
-//AcceptTcpConn 接受tcp链接返回链接socketFD
-func AcceptTcpConn(fd int) (int, error) {
-	if fd, _, err := unix.Accept(fd); err != nil {
-		return 0, err
+//AcceptTcpConn 接受tcp链接返回链接socketFD和客户端地址
+func AcceptTcpConn(fd int) (int, unix.Sockaddr, error) {
+	if fd, sa, err := unix.Accept(fd); err != nil {
+		return 0, nil, err
 	} else {
-		return fd, nil
+		return fd, sa, nil
 	}
 }
 
+//SocketOpts 远端socket选项
+type SocketOpts struct {
+	//BindAddr 连接前绑定的本地地址, nil时由内核选择
+	BindAddr unix.Sockaddr
+	//Transparent 设置 IP_TRANSPARENT, 允许绑定客户端等非本机地址
+	Transparent bool
+	//SourcePool BindAddr为空时从源地址池中轮流选取同地址族的地址绑定
+	SourcePool *SourcePool
+	//Device 通过 SO_BINDTODEVICE 绑定出口网卡
+	Device string
+	//Tuning 缓冲区、SO_MARK、TOS等socket参数
+	Tuning *SocketTuning
+}
+
+//apply 在connect/sendto之前设置socket选项, 绑定地址与目标地址族不一致时返回 EAFNOSUPPORT
+func (o *SocketOpts) apply(fd int, family int, stream bool) error {
+	if o == nil {
+		return nil
+	}
+	if family == unix.AF_UNIX {
+		if sa, ok := o.BindAddr.(*unix.SockaddrUnix); ok {
+			return unix.Bind(fd, sa)
+		}
+		return nil
+	}
+	if err := o.Tuning.applyDial(fd, family, stream); err != nil {
+		return err
+	}
+	if o.Transparent {
+		if err := SetTransparent(fd, family); err != nil {
+			return err
+		}
+	}
+	if o.Device != "" {
+		if err := unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, o.Device); err != nil {
+			return err
+		}
+	}
+	bind := o.BindAddr
+	if bind == nil && o.SourcePool != nil {
+		if bind = o.SourcePool.Next(family); bind == nil {
+			return unix.EAFNOSUPPORT
+		}
+	}
+	if bind != nil {
+		if SockAddrFamily(bind) != family {
+			return unix.EAFNOSUPPORT
+		}
+		if err := unix.Bind(fd, bind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 //CreateRemoteSocket 创建tcp连接 socketFD
-func CreateRemoteSocket(remoteAddr string, remotePort int) (int, error) {
-	if fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_TCP); err != nil {
+func CreateRemoteSocket(remoteAddr string, remotePort int, opts *SocketOpts) (int, error) {
+	socketAddr := TargetSockAddr(remoteAddr, remotePort)
+	if fd, err := unix.Socket(SockAddrFamily(socketAddr), unix.SOCK_STREAM, 0); err != nil {
 		return 0, err
 	} else {
 		defer SetNoBlock(fd)
-		socketAddr := unix.SockaddrInet4{Port: remotePort}
-		copy(socketAddr.Addr[:], net.ParseIP(remoteAddr).To4())
-		if err = unix.Connect(fd, &socketAddr); err != nil {
+		if err := opts.apply(fd, SockAddrFamily(socketAddr), true); err != nil {
+			CloseSocket(fd)
+			return 0, err
+		}
+		if err = unix.Connect(fd, socketAddr); err != nil {
+			CloseSocket(fd)
 			return 0, err
 		}
 		return fd, nil
 	}
 }
 
-//CreateRemoteSocket 创建udp socketFD
-func CreateUdpRemoteSocket() (int, error) {
-	if fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0); err != nil {
+//CreateUdpRemoteSocket 根据地址族创建udp socketFD
+func CreateUdpRemoteSocket(family int, opts *SocketOpts) (int, error) {
+	if fd, err := unix.Socket(family, unix.SOCK_DGRAM, 0); err != nil {
 		return 0, err
 	} else {
+		if family == unix.AF_UNIX {
+			//unix数据报需要绑定地址才能收到应答, 空路径由内核自动分配抽象地址
+			opts = &SocketOpts{BindAddr: &unix.SockaddrUnix{}}
+		}
+		if err := opts.apply(fd, family, false); err != nil {
+			CloseSocket(fd)
+			return 0, err
+		}
 		defer SetNoBlock(fd)
 		return fd, nil
 	}
 }
 
-func SockAddrParse(addr string, port int) *unix.SockaddrInet4 {
-	sa := &unix.SockaddrInet4{Port: port}
-	copy(sa.Addr[:], net.ParseIP(addr).To4())
+//SockAddrParse 根据地址端口生成sockaddr, 自动区分ipv4/ipv6
+func SockAddrParse(addr string, port int) unix.Sockaddr {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil {
+		sa := &unix.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip.To4())
+		return sa
+	}
+	sa := &unix.SockaddrInet6{Port: port}
+	copy(sa.Addr[:], ip.To16())
 	return sa
 }
 
+//SockAddrFamily 返回sockaddr对应的地址族
+func SockAddrFamily(sa unix.Sockaddr) int {
+	switch sa.(type) {
+	case *unix.SockaddrInet6:
+		return unix.AF_INET6
+	case *unix.SockaddrUnix:
+		return unix.AF_UNIX
+	}
+	return unix.AF_INET
+}
+
+//TargetSockAddr 生成后端地址, 支持 unix:/unixgram: 路径
+func TargetSockAddr(addr string, port int) unix.Sockaddr {
+	if path, _, ok := UnixPath(addr); ok {
+		return &unix.SockaddrUnix{Name: path}
+	}
+	return SockAddrParse(addr, port)
+}
+
+//SockAddrIP 返回sockaddr中的ip
+func SockAddrIP(sa unix.Sockaddr) net.IP {
+	switch v := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(v.Addr[:])
+	case *unix.SockaddrInet6:
+		return net.IP(v.Addr[:])
+	}
+	return nil
+}
+
+//SockAddrPort 返回sockaddr中的端口
+func SockAddrPort(sa unix.Sockaddr) int {
+	switch v := sa.(type) {
+	case *unix.SockaddrInet4:
+		return v.Port
+	case *unix.SockaddrInet6:
+		return v.Port
+	}
+	return 0
+}
+
 func CheckError(pf string, err error) bool {
 	if err != nil {
 		log.Warn(pf, err)
@@ -103,13 +252,17 @@ func BufferRecv(fd int, buffer *[]byte) (int, error) {
 	return unix.Read(fd, *buffer)
 }
 
-func PacketSend(fd int, p *[]byte, sa *unix.SockaddrInet4) error {
+//PacketSend sa 为nil时发往已连接socket的对端
+func PacketSend(fd int, p *[]byte, sa unix.Sockaddr) error {
+	if sa == nil {
+		_, err := unix.Write(fd, *p)
+		return err
+	}
 	return unix.Sendto(fd, *p, 0, sa)
 }
 
-func PacketRecv(fd int, p *[]byte) (int, *unix.SockaddrInet4, error) {
-	n, from, err := unix.Recvfrom(fd, *p, 0)
-	return n, from.(*unix.SockaddrInet4), err
+func PacketRecv(fd int, p *[]byte) (int, unix.Sockaddr, error) {
+	return unix.Recvfrom(fd, *p, 0)
 }
 
 func SetNoBlock(fd int) error {
@@ -124,36 +277,112 @@ func CloseSocket(fd int) error {
 	return unix.Close(fd)
 }
 
+//ResetSocket 设置SO_LINGER为0后关闭, 对端收到RST
+func ResetSocket(fd int) error {
+	unix.SetsockoptLinger(fd, unix.SOL_SOCKET, unix.SO_LINGER, &unix.Linger{Onoff: 1, Linger: 0})
+	return unix.Close(fd)
+}
+
 func MD5Addr(addr []byte, port int) string {
 	sum := md5.Sum(append(addr, []byte(strconv.Itoa(port))...))
 	return hex.EncodeToString(sum[:])
 }
 
+//GetDomainIp 解析域名, 返回按地址族偏好排序后的第一个地址
 func GetDomainIp(domain string) (string, error) {
-	dot, err := dns.NewDoTClient("223.5.5.5:853", true)
-	if err != nil {
+	ips, err := GetDomainIps(domain, FamilyPreferV4)
+	if err != nil || len(ips) == 0 {
 		return "", err
 	}
+	return ips[0], nil
+}
+
+//GetDomainIps 解析域名全部A/AAAA记录, 按地址族偏好交错排序(RFC8305)
+func GetDomainIps(domain string, family string) ([]string, error) {
+	dot, err := dns.NewDoTClient(kDnsServer, true)
+	if err != nil {
+		return nil, err
+	}
 	defer dot.Close()
+	ips, _, err := lookupHost(dot, domain, family)
+	return ips, err
+}
+
+//lookupHost 查询域名A/AAAA记录, 返回排序后的地址和最小TTL; 一个地址族查询失败时保留另一个的结果, 都失败时返回错误
+func lookupHost(dot *dns.DoTClient, domain string, family string) ([]string, uint32, error) {
+	var v4, v6 []string
+	var ttl4, ttl6 uint32
+	var err4, err6 error
+	if family != FamilyOnlyV6 {
+		v4, ttl4, err4 = lookupAddr(dot, domain, dns.RecordTypeA)
+	}
+	if family != FamilyOnlyV4 {
+		v6, ttl6, err6 = lookupAddr(dot, domain, dns.RecordTypeAAAA)
+	}
+	if err4 != nil && (err6 != nil || family == FamilyOnlyV4 || len(v6) == 0) {
+		return nil, 0, err4
+	} else if err6 != nil && (family == FamilyOnlyV6 || len(v4) == 0) {
+		return nil, 0, err6
+	} else if err4 != nil || err6 != nil {
+		log.Warn("[resolver] lookup ", domain, " partially failed: ", err4, " ", err6)
+	}
+	ttl := minTTL(ttl4, ttl6)
+	if family == FamilyPreferV6 || family == FamilyOnlyV6 {
+		return interleaveAddrs(v6, v4), ttl, nil
+	}
+	return interleaveAddrs(v4, v6), ttl, nil
+}
+
+func lookupAddr(dot *dns.DoTClient, domain string, rtype dns.RecordType) ([]string, uint32, error) {
 	res, err := dot.Lookup(dns.MessageQuestion{
 		Name: domain,
-		Type: dns.RecordTypeA,
+		Type: rtype,
 	}, false)
 	if err != nil {
-		return "", err
+		return nil, 0, err
 	}
+	ips, ttl := make([]string, 0, len(res.Answer)), uint32(0)
 	for _, v := range res.Answer {
-		if v.Type != 5 {
-			return v.Value.(string), nil
+		if v.Type == rtype {
+			ips = append(ips, v.Value.(string))
+			ttl = minTTL(ttl, v.TTL)
 		}
 	}
-	return "", nil
+	return ips, ttl, nil
+}
+
+//minTTL 返回非零ttl中较小的一个
+func minTTL(a, b uint32) uint32 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+//interleaveAddrs 首选地址族在前, 两个地址族交替排列
+func interleaveAddrs(first, second []string) []string {
+	ips := make([]string, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ips = append(ips, first[i])
+		}
+		if i < len(second) {
+			ips = append(ips, second[i])
+		}
+	}
+	return ips
 }
 
 func Judge(v int) bool {
 	return v != 0
 }
 
-func Addr2Str(sa *unix.SockaddrInet4) string {
-	return fmt.Sprintf("%d.%d.%d.%d:%d", sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3], sa.Port)
+func Addr2Str(sa unix.Sockaddr) string {
+	if v, ok := sa.(*unix.SockaddrUnix); ok {
+		if v.Name == "" {
+			return UnixScheme + "@unnamed"
+		}
+		return UnixScheme + v.Name
+	}
+	return net.JoinHostPort(SockAddrIP(sa).String(), strconv.Itoa(SockAddrPort(sa)))
 }
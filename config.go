@@ -1,5 +1,24 @@
 package fdd
 
+import (
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	FamilyPreferV4 = "ipv4"
+	FamilyPreferV6 = "ipv6"
+	FamilyOnlyV4   = "ipv4only"
+	FamilyOnlyV6   = "ipv6only"
+
+	ProxyInAccept  = "accept"
+	ProxyInRequire = "require"
+)
+
 type Config struct {
 	ListenPort   int
 	RemotePort   int
@@ -8,6 +27,89 @@ type Config struct {
 	ListenAddr   string
 	RemoteAddr   string
 	TargetDomain string
+	TargetSrv    string
+	AddrFamily   string
+	Backends     *BackendSet
+	DnsCache     bool
+	DnsHostsFile string
+	DnsBlockFile string
+	AllowCIDRs   []string
+	DenyCIDRs    []string
+	AllowFile    string
+	DenyFile     string
+	AclReset     bool
+	StatsAddr    string
+
+	ConnRate       float64
+	ConnBurst      int
+	MaxTcpPerIP    int
+	MaxUdpPerIP    int
+	MaxTcpFlows    int
+	MaxUdpSessions int
+
+	UpRate        int64
+	DownRate      int64
+	IPUpRate      int64
+	IPDownRate    int64
+	RuleUpRate    int64
+	RuleDownRate  int64
+	RateBurst     int64
+	UdpShapeDelay bool
+
+	QuotaBytes    int64
+	QuotaIPBytes  int64
+	QuotaPerIP    bool
+	QuotaFile     string
+	QuotaAction   string
+	QuotaPeriod   string
+	QuotaResetDay int
+	QuotaThrottle int64
+
+	ProxyProtocol      int
+	ProxyProtocolIn    string
+	ProxyTrusted       []string
+	ProxyHeaderTimeout int
+
+	Transparent    string
+	TransparentMap map[string]Backend
+	SpoofSource    bool
+
+	SourceAddrs []string
+	SourcePool  *SourcePool
+	BindDevice  string
+
+	Tuning *SocketTuning
+
+	UnixMode  os.FileMode
+	UnixOwner string
+
+	TLSCerts    []string
+	TLSClientCA string
+
+	RemoteTLS           bool
+	RemoteTLSServerName string
+	RemoteTLSCA         string
+	RemoteTLSCert       string
+	RemoteTLSPins       []string
+
+	SNIRoutes     []string
+	HTTPRoutes    []string
+	XForwardedFor bool
+	SniffRoutes   []string
+	PeekTimeout   int
+
+	Upstreams []string
+
+	SocksServer bool
+	SocksUsers  []string
+	SocksAllow  []string
+
+	Tunnel    string
+	TunnelKey string
+
+	Mux        string
+	MuxConns   int
+	UdpOverTCP string
 }
 
 func NewConfig(la, ra string, lp, rp, hcp, timeout int) Config {
@@ -18,5 +120,135 @@ func NewConfig(la, ra string, lp, rp, hcp, timeout int) Config {
 		RemotePort: rp,
 		UdpTimeOut: timeout,
 		HandlerCap: 1024,
+		AddrFamily: FamilyPreferV4,
+		Backends:   NewBackendSet(),
+
+		ProxyHeaderTimeout: 5,
+		PeekTimeout:        5,
+	}
+}
+
+//RemoteSocketOpts 返回连接后端时使用的socket选项, 开启 SpoofSource 时以客户端ip作为源地址, 否则使用源地址池
+func (c *Config) RemoteSocketOpts(client unix.Sockaddr) *SocketOpts {
+	if !c.SpoofSource && c.SourcePool == nil && c.BindDevice == "" && c.Tuning == nil {
+		return nil
+	}
+	opts := &SocketOpts{SourcePool: c.SourcePool, Device: c.BindDevice, Tuning: c.Tuning}
+	if c.SpoofSource && SockAddrIP(client) != nil {
+		opts.BindAddr, opts.Transparent = SockAddrParse(SockAddrIP(client).String(), 0), true
+	}
+	return opts
+}
+
+//Relays 根据监听和目标地址类型判断需要启动的tcp/udp转发, unix:流式地址只启用tcp, unixgram:数据报地址只启用udp
+func (c *Config) Relays() (tcp bool, udp bool) {
+	tcp, udp = true, true
+	for _, addr := range []string{c.ListenAddr, c.RemoteAddr} {
+		if _, dgram, ok := UnixPath(addr); ok {
+			tcp, udp = tcp && !dgram, udp && dgram
+		}
 	}
+	return tcp, udp
+}
+
+//HasDefaultTarget 是否有默认转发目标, 路由未命中时使用
+func (c *Config) HasDefaultTarget() bool {
+	return c.RemoteAddr != "" || c.Transparent != ""
+}
+
+//HasACL 是否配置了访问控制规则
+func (c *Config) HasACL() bool {
+	return len(c.AllowCIDRs) != 0 || len(c.DenyCIDRs) != 0 || c.AllowFile != "" || c.DenyFile != ""
+}
+
+//HasShaping 是否配置了带宽限制
+func (c *Config) HasShaping() bool {
+	return c.UpRate > 0 || c.DownRate > 0 || c.IPUpRate > 0 || c.IPDownRate > 0 || c.RuleUpRate > 0 || c.RuleDownRate > 0 ||
+		(c.HasQuota() && c.QuotaAction == QuotaActionThrottle)
+}
+
+//HasQuota 是否需要流量统计
+func (c *Config) HasQuota() bool {
+	return c.QuotaBytes > 0 || c.QuotaIPBytes > 0 || c.QuotaPerIP || c.QuotaFile != ""
+}
+
+//RemoteBackends 返回当前后端地址集合, 未解析域名时退化为 RemoteAddr:RemotePort
+func (c *Config) RemoteBackends() []Backend {
+	if c.Backends != nil {
+		if list := c.Backends.Load(); len(list) != 0 {
+			return list
+		}
+	}
+	return []Backend{{Addr: c.RemoteAddr, Port: c.RemotePort, Host: c.TargetDomain}}
+}
+
+type Backend struct {
+	Addr     string
+	Port     int
+	Host     string
+	Priority uint16
+	Weight   uint16
+}
+
+//OrderBackends 按SRV规则排列后端(RFC2782): priority升序, 同priority内按weight加权随机排列主机,
+//同一主机的多个地址保持解析时的顺序
+func OrderBackends(list []Backend) []Backend {
+	if len(list) <= 1 {
+		return list
+	}
+	hosts, addrs := make([]Backend, 0, len(list)), make(map[string][]Backend, len(list))
+	for _, b := range list {
+		if _, ok := addrs[b.Host]; !ok {
+			hosts = append(hosts, b)
+		}
+		addrs[b.Host] = append(addrs[b.Host], b)
+	}
+	sort.SliceStable(hosts, func(i, j int) bool {
+		return hosts[i].Priority < hosts[j].Priority
+	})
+	ordered := make([]Backend, 0, len(list))
+	for start := 0; start < len(hosts); {
+		end := start
+		for end < len(hosts) && hosts[end].Priority == hosts[start].Priority {
+			end++
+		}
+		for group := hosts[start:end]; len(group) > 0; {
+			total := 0
+			for _, h := range group {
+				total += int(h.Weight) + 1
+			}
+			pick, n := rand.Intn(total), 0
+			for ; n < len(group)-1; n++ {
+				if pick -= int(group[n].Weight) + 1; pick < 0 {
+					break
+				}
+			}
+			ordered = append(ordered, addrs[group[n].Host]...)
+			group = append(group[:n:n], group[n+1:]...)
+		}
+		start = end
+	}
+	return ordered
+}
+
+//BackendSet 后端地址集合, 解析协程写入, eventLoop读取
+type BackendSet struct {
+	mu   sync.RWMutex
+	list []Backend
+}
+
+func NewBackendSet() *BackendSet {
+	return &BackendSet{}
+}
+
+func (bs *BackendSet) Load() []Backend {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	return bs.list
+}
+
+func (bs *BackendSet) Store(list []Backend) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.list = list
 }
@@ -0,0 +1,203 @@
+package fdd
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rocinan/fdd/poller"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	kConnAttemptDelay = 250 * time.Millisecond
+	kConnTimeout      = 5 * time.Second
+)
+
+//Dialer 事件驱动的 Happy Eyeballs 连接器(RFC8305): 按顺序对后端发起非阻塞连接, 上一个连接未完成时每隔 delay 追加下一个候选,
+//某个地址连接失败立即尝试下一个. 连接结果由eventLoop通知, 追加候选和超时由调用方在 HandleTick 中调用 Tick 检查,
+//最先建立成功的连接通过 done 返回, 返回前已从eventLoop移除
+type Dialer struct {
+	backends  []Backend
+	opts      *SocketOpts
+	delay     time.Duration
+	next      int
+	lastStart time.Time
+	deadline  time.Time
+	pending   map[int]Backend
+	lastErr   error
+	finished  bool
+	eventLoop *poller.EventLoop
+	done      func(fd int, b Backend, err error)
+}
+
+//NewDialer 创建连接器, 调用 Start 后开始连接
+func NewDialer(ep *poller.EventLoop, backends []Backend, opts *SocketOpts, done func(fd int, b Backend, err error)) *Dialer {
+	//TCP_FASTOPEN_CONNECT 使connect立即返回成功, SYN推迟到首次写入, 多个候选时无法比较谁先建立连接
+	if len(backends) > 1 && opts != nil && opts.Tuning != nil && opts.Tuning.FastOpen {
+		o, st := *opts, *opts.Tuning
+		st.FastOpen, o.Tuning = false, &st
+		opts = &o
+	}
+	return &Dialer{
+		backends:  backends,
+		opts:      opts,
+		delay:     kConnAttemptDelay,
+		pending:   make(map[int]Backend, len(backends)),
+		lastErr:   unix.ECONNREFUSED,
+		eventLoop: ep,
+		done:      done,
+	}
+}
+
+//Start 发起第一个连接, 立即成功或全部失败时 done 在 Start 返回前被调用
+func (d *Dialer) Start() {
+	d.deadline = time.Now().Add(kConnTimeout)
+	d.startNext()
+}
+
+//startNext 发起下一个候选的连接, 立即失败的候选跳过
+func (d *Dialer) startNext() {
+	for !d.finished && d.next < len(d.backends) {
+		b := d.backends[d.next]
+		d.next, d.lastStart = d.next+1, time.Now()
+		fd, done, err := connectNoBlock(b.Addr, b.Port, d.opts)
+		if err != nil {
+			log.Debug("[dialer] connect ", b.Addr, " err: ", err)
+			d.lastErr = err
+			continue
+		}
+		if done {
+			d.finish(fd, b, nil)
+			return
+		}
+		if err := d.eventLoop.Register(fd, kPollOut|kPollErr, d); err != nil {
+			CloseSocket(fd)
+			d.lastErr = err
+			continue
+		}
+		d.pending[fd] = b
+		return
+	}
+	if !d.finished && len(d.pending) == 0 {
+		d.finish(INVALID_SOCKET, Backend{}, d.lastErr)
+	}
+}
+
+//HandleEvent 连接完成(成功或失败)时socket可写
+func (d *Dialer) HandleEvent(fd, ev int) {
+	b, ok := d.pending[fd]
+	if !ok || d.finished {
+		return
+	}
+	if soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR); err != nil || soErr != 0 {
+		if err == nil {
+			err = unix.Errno(soErr)
+		}
+		log.Debug("[dialer] connect ", b.Addr, " err: ", err)
+		d.lastErr = err
+		d.drop(fd)
+		//失败后立即开始下一个候选
+		d.startNext()
+		return
+	}
+	d.eventLoop.UnRegister(fd)
+	delete(d.pending, fd)
+	d.finish(fd, b, nil)
+}
+
+//Tick 超时后返回 ETIMEDOUT, 否则在上一个候选超过 delay 未完成时追加下一个
+func (d *Dialer) Tick(now time.Time) {
+	if d.finished {
+		return
+	} else if now.After(d.deadline) {
+		d.finish(INVALID_SOCKET, Backend{}, unix.ETIMEDOUT)
+	} else if d.next < len(d.backends) && now.Sub(d.lastStart) >= d.delay {
+		d.startNext()
+	}
+}
+
+func (d *Dialer) drop(fd int) {
+	d.eventLoop.UnRegister(fd)
+	CloseSocket(fd)
+	delete(d.pending, fd)
+}
+
+func (d *Dialer) finish(fd int, b Backend, err error) {
+	d.finished = true
+	for pfd := range d.pending {
+		d.drop(pfd)
+	}
+	d.done(fd, b, err)
+}
+
+//Close 放弃连接, 关闭未完成的socket, 不再调用 done
+func (d *Dialer) Close() {
+	d.finished = true
+	for fd := range d.pending {
+		d.drop(fd)
+	}
+}
+
+//connectNoBlock 创建非阻塞socket并发起连接, done 表示已立即连接成功
+func connectNoBlock(addr string, port int, opts *SocketOpts) (int, bool, error) {
+	sa := TargetSockAddr(addr, port)
+	fd, err := unix.Socket(SockAddrFamily(sa), unix.SOCK_STREAM, 0)
+	if err != nil {
+		return 0, false, err
+	}
+	if err := opts.apply(fd, SockAddrFamily(sa), true); err != nil {
+		CloseSocket(fd)
+		return 0, false, err
+	}
+	SetNoBlock(fd)
+	if err := unix.Connect(fd, sa); err != nil {
+		if err == unix.EINPROGRESS {
+			return fd, false, nil
+		}
+		CloseSocket(fd)
+		return 0, false, err
+	}
+	return fd, true, nil
+}
+
+//SourcePool 出站源地址池, 按地址族轮流选取, 仅在eventLoop线程中使用
+type SourcePool struct {
+	addrs map[int][]net.IP
+	next  map[int]int
+}
+
+//NewSourcePool 解析源地址列表, 列表为空时返回nil
+func NewSourcePool(list []string) (*SourcePool, error) {
+	p := &SourcePool{addrs: make(map[int][]net.IP), next: make(map[int]int)}
+	for _, v := range list {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, errors.New("invalid source address: " + v)
+		}
+		family := unix.AF_INET6
+		if ip.To4() != nil {
+			family = unix.AF_INET
+		}
+		p.addrs[family] = append(p.addrs[family], ip)
+	}
+	if len(p.addrs) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+//Next 返回下一个指定地址族的源地址, 端口由内核分配, 没有该地址族的地址时返回nil
+func (p *SourcePool) Next(family int) unix.Sockaddr {
+	addrs := p.addrs[family]
+	if len(addrs) == 0 {
+		return nil
+	}
+	i := p.next[family] % len(addrs)
+	p.next[family] = i + 1
+	return SockAddrParse(addrs[i].String(), 0)
+}
@@ -0,0 +1,396 @@
+package fdd
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shuLhan/share/lib/dns"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	kDnsCacheSize       = 4096
+	kDnsInflightTimeout = 5 * time.Second
+	kDnsOverrideTTL     = 60
+)
+
+var errDnsQuestion = errors.New("dns: need exactly one question")
+
+type dnsWaiter struct {
+	fd  int
+	src unix.Sockaddr
+	id  uint16
+}
+
+//dnsReply 发给等待中客户端的应答
+type dnsReply struct {
+	dnsWaiter
+	pkt []byte
+}
+
+//dnsInflight 已转发给上游的查询, id 为转发时替换的随机查询ID
+type dnsInflight struct {
+	start   time.Time
+	id      uint16
+	waiters []dnsWaiter
+}
+
+type dnsCacheEntry struct {
+	msg    dnsmessage.Message
+	stored time.Time
+	expire time.Time
+}
+
+//DNSCache 转发53端口时的dns缓存, 按TTL缓存应答, 合并相同的并发udp查询, 支持静态覆盖与黑名单,
+//tcp查询按长度前缀分帧后经 dnsStreamCodec 使用同一缓存
+type DNSCache struct {
+	entries   map[string]*dnsCacheEntry
+	inflight  map[string]*dnsInflight
+	overrides map[string][]*dns.ResourceRecord
+	blocklist map[string]struct{}
+	lastSweep time.Time
+}
+
+func NewDNSCache(hostsFile, blockFile string) (*DNSCache, error) {
+	dc := &DNSCache{
+		entries:   make(map[string]*dnsCacheEntry, kDnsCacheSize),
+		inflight:  make(map[string]*dnsInflight),
+		overrides: make(map[string][]*dns.ResourceRecord),
+		blocklist: make(map[string]struct{}),
+	}
+	if hostsFile != "" {
+		hf, err := dns.ParseHostsFile(hostsFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range hf.Records {
+			rr.TTL = kDnsOverrideTTL
+			dc.overrides[rr.Name] = append(dc.overrides[rr.Name], rr)
+		}
+	}
+	if blockFile != "" {
+		domains, err := LoadLines(blockFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range domains {
+			dc.blocklist[strings.ToLower(strings.TrimSuffix(d, "."))] = struct{}{}
+		}
+	}
+	return dc, nil
+}
+
+//OnQuery 处理客户端的udp查询, handled 为true表示无需转发: answer 不为空时由调用方发给客户端, 否则已合并到进行中的查询;
+//需要转发时 pkt 的查询ID被替换为随机值, 上游应答须带回该ID
+func (dc *DNSCache) OnQuery(fd int, src unix.Sockaddr, pkt []byte) (answer []byte, handled bool) {
+	now := time.Now()
+	answer, key, id := dc.lookup(pkt, now)
+	if answer != nil {
+		return answer, true
+	} else if key == "" {
+		return nil, false
+	}
+	if q, ok := dc.inflight[key]; ok && now.Sub(q.start) < kDnsInflightTimeout {
+		q.waiters = append(q.waiters, dnsWaiter{fd: fd, src: src, id: id})
+		return nil, true
+	}
+	var fid [2]byte
+	rand.Read(fid[:])
+	copy(pkt, fid[:])
+	dc.inflight[key] = &dnsInflight{start: now, id: binary.BigEndian.Uint16(fid[:]), waiters: []dnsWaiter{{fd: fd, src: src, id: id}}}
+	return nil, false
+}
+
+//HandleTick 每秒清理超过 kDnsInflightTimeout 仍未应答的查询
+func (dc *DNSCache) HandleTick(now time.Time) {
+	if now.Sub(dc.lastSweep) < time.Second {
+		return
+	}
+	dc.lastSweep = now
+	for key, q := range dc.inflight {
+		if now.Sub(q.start) >= kDnsInflightTimeout {
+			delete(dc.inflight, key)
+		}
+	}
+}
+
+//OnAnswer 处理上游的udp应答, 写入缓存并返回发给所有等待客户端的应答; 返回false表示不是dns应答,
+//问题或查询ID与进行中的查询不符的应答可能是伪造的, 返回true且不返回应答, 由调用方丢弃
+func (dc *DNSCache) OnAnswer(pkt []byte) ([]dnsReply, bool) {
+	h, q, err := parseDnsQuestion(pkt)
+	if err != nil || !h.Response {
+		return nil, false
+	}
+	key := dnsKey(q)
+	inflight, ok := dc.inflight[key]
+	if !ok || inflight.id != h.ID {
+		log.Debug("[dns_cache] drop unmatched answer: ", dnsName(q), " id ", h.ID)
+		return nil, true
+	}
+	delete(dc.inflight, key)
+	now := time.Now()
+	e := dc.store(key, pkt, now)
+	replies := make([]dnsReply, 0, len(inflight.waiters))
+	for _, w := range inflight.waiters {
+		var answer []byte
+		if e != nil {
+			answer = e.answer(w.id, now)
+		}
+		if answer == nil {
+			//不可缓存的应答原样转发, 只替换查询ID
+			answer = append([]byte(nil), pkt...)
+			binary.BigEndian.PutUint16(answer, w.id)
+		}
+		replies = append(replies, dnsReply{dnsWaiter: w, pkt: answer})
+	}
+	return replies, true
+}
+
+//lookup 查询黑名单、静态覆盖和缓存, 命中时返回本地应答, 不是可处理的查询时 key 为空
+func (dc *DNSCache) lookup(pkt []byte, now time.Time) (answer []byte, key string, id uint16) {
+	h, q, err := parseDnsQuestion(pkt)
+	if err != nil || h.Response {
+		return nil, "", 0
+	}
+	name := dnsName(q)
+	if dc.isBlocked(name) {
+		return dc.reply(h, q, dns.RCodeErrName, nil), "", h.ID
+	}
+	if rrs, ok := dc.overrides[name]; ok {
+		answers := make([]dns.ResourceRecord, 0, len(rrs))
+		for _, rr := range rrs {
+			if uint16(rr.Type) == uint16(q.Type) {
+				answers = append(answers, *rr)
+			}
+		}
+		return dc.reply(h, q, dns.RCodeOK, answers), "", h.ID
+	}
+	key = dnsKey(q)
+	if e, ok := dc.entries[key]; ok {
+		if now.Before(e.expire) {
+			if answer = e.answer(h.ID, now); answer != nil {
+				return answer, key, h.ID
+			}
+		}
+		delete(dc.entries, key)
+	}
+	return nil, key, h.ID
+}
+
+func (dc *DNSCache) isBlocked(name string) bool {
+	for {
+		if _, ok := dc.blocklist[name]; ok {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+//store 缓存可缓存的应答, 不可缓存时返回nil
+func (dc *DNSCache) store(key string, pkt []byte, now time.Time) *dnsCacheEntry {
+	e := newDnsCacheEntry(pkt, now)
+	if e == nil {
+		return nil
+	}
+	if len(dc.entries) >= kDnsCacheSize {
+		for k, v := range dc.entries {
+			if now.After(v.expire) {
+				delete(dc.entries, k)
+			}
+		}
+		//仍然已满时随机淘汰一个
+		for k := range dc.entries {
+			if len(dc.entries) < kDnsCacheSize {
+				break
+			}
+			delete(dc.entries, k)
+		}
+	}
+	dc.entries[key] = e
+	return e
+}
+
+//reply 本地构造应答
+func (dc *DNSCache) reply(h dnsmessage.Header, q dnsmessage.Question, code dns.ResponseCode, answers []dns.ResourceRecord) []byte {
+	msg := dns.NewMessage()
+	msg.Header.ID = h.ID
+	msg.Header.IsQuery = false
+	msg.Header.IsRD = h.RecursionDesired
+	msg.Header.IsRA = true
+	msg.Header.RCode = code
+	msg.Header.QDCount = 1
+	msg.Question = dns.MessageQuestion{Name: dnsName(q), Type: dns.RecordType(q.Type), Class: dns.RecordClass(q.Class)}
+	msg.Answer = answers
+	pkt, err := msg.Pack()
+	if !CheckError("[dns_cache] pack answer err: ", err) {
+		return nil
+	}
+	return pkt
+}
+
+//NewStreamCodec 创建tcp查询的编解码器, 作为 TCPRelayHandler 的 localCodec 使用
+func (dc *DNSCache) NewStreamCodec() StreamCodec {
+	return &dnsStreamCodec{cache: dc}
+}
+
+//dnsStreamCodec 按tcp dns的2字节长度前缀分帧(RFC1035 4.2.2): 命中缓存的查询直接应答客户端,
+//其余查询转发给上游, 上游的应答写入缓存后转发给客户端
+type dnsStreamCodec struct {
+	cache *DNSCache
+	up    []byte
+	down  []byte
+	out   []byte
+}
+
+func (c *dnsStreamCodec) Decode(in []byte) ([]byte, error) {
+	c.up = append(c.up, in...)
+	var plain []byte
+	now := time.Now()
+	for len(c.up) >= 2 {
+		size := 2 + int(binary.BigEndian.Uint16(c.up))
+		if len(c.up) < size {
+			break
+		}
+		if answer, _, _ := c.cache.lookup(c.up[2:size], now); answer != nil && len(answer) <= 0xFFFF {
+			c.out = append(c.out, byte(len(answer)>>8), byte(len(answer)))
+			c.out = append(c.out, answer...)
+		} else {
+			plain = append(plain, c.up[:size]...)
+		}
+		c.up = c.up[size:]
+	}
+	return plain, nil
+}
+
+func (c *dnsStreamCodec) Encode(plain []byte) error {
+	c.down = append(c.down, plain...)
+	now := time.Now()
+	for len(c.down) >= 2 {
+		size := 2 + int(binary.BigEndian.Uint16(c.down))
+		if len(c.down) < size {
+			break
+		}
+		pkt := c.down[2:size]
+		if h, q, err := parseDnsQuestion(pkt); err == nil && h.Response {
+			c.cache.store(dnsKey(q), pkt, now)
+		}
+		c.out = append(c.out, c.down[:size]...)
+		c.down = c.down[size:]
+	}
+	return nil
+}
+
+func (c *dnsStreamCodec) Output() []byte {
+	out := c.out
+	c.out = nil
+	return out
+}
+
+func (c *dnsStreamCodec) SetNotify(fn func(err error)) {}
+
+func (c *dnsStreamCodec) Close() {}
+
+//newDnsCacheEntry 解析应答, 截断、出错及TTL为0的应答不缓存
+func newDnsCacheEntry(pkt []byte, now time.Time) *dnsCacheEntry {
+	e := &dnsCacheEntry{stored: now}
+	if err := e.msg.Unpack(pkt); err != nil || len(e.msg.Questions) != 1 || e.msg.Header.Truncated {
+		return nil
+	} else if rcode := e.msg.Header.RCode; rcode != dnsmessage.RCodeSuccess && rcode != dnsmessage.RCodeNameError {
+		return nil
+	}
+	ttl := uint32(0)
+	for _, section := range [][]dnsmessage.Resource{e.msg.Answers, e.msg.Authorities, e.msg.Additionals} {
+		for _, rr := range section {
+			if rr.Header.Type != dnsmessage.TypeOPT {
+				ttl = minTTL(ttl, rr.Header.TTL)
+			}
+		}
+	}
+	if ttl == 0 {
+		return nil
+	}
+	e.expire = now.Add(time.Duration(ttl) * time.Second)
+	return e
+}
+
+//answer 以缓存的应答重新打包, 替换查询ID并扣减已缓存的时间, OPT记录的TTL字段不是时间, 保持不变
+func (e *dnsCacheEntry) answer(id uint16, now time.Time) []byte {
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	msg := e.msg
+	msg.Header.ID = id
+	msg.Answers = subTTL(e.msg.Answers, elapsed)
+	msg.Authorities = subTTL(e.msg.Authorities, elapsed)
+	msg.Additionals = subTTL(e.msg.Additionals, elapsed)
+	pkt, err := msg.Pack()
+	if !CheckError("[dns_cache] pack cached answer err: ", err) {
+		return nil
+	}
+	return pkt
+}
+
+func subTTL(rrs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	out := make([]dnsmessage.Resource, len(rrs))
+	for i, rr := range rrs {
+		if rr.Header.Type != dnsmessage.TypeOPT && rr.Header.TTL > elapsed {
+			rr.Header.TTL -= elapsed
+		} else if rr.Header.Type != dnsmessage.TypeOPT {
+			rr.Header.TTL = 0
+		}
+		out[i] = rr
+	}
+	return out
+}
+
+//parseDnsQuestion 解析报文头和唯一的问题, 压缩指针的越界和环路由 dnsmessage 检查.
+//lib/dns 解析名字时跟随压缩指针没有次数限制, 指针环路会使eventLoop死循环, 且会原地改写报文, 不能用于解析客户端和上游的报文
+
+func parseDnsQuestion(pkt []byte) (dnsmessage.Header, dnsmessage.Question, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(pkt)
+	if err != nil {
+		return h, dnsmessage.Question{}, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return h, q, err
+	} else if _, err := p.Question(); err != dnsmessage.ErrSectionDone {
+		return h, q, errDnsQuestion
+	}
+	return h, q, nil
+}
+
+//dnsName 返回小写且不带末尾点的查询域名
+func dnsName(q dnsmessage.Question) string {
+	return strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+}
+
+func dnsKey(q dnsmessage.Question) string {
+	return dnsName(q) + "/" + strconv.Itoa(int(q.Type)) + "/" + strconv.Itoa(int(q.Class))
+}
+
+//LoadLines 读取文件中的非空行, 忽略#开头的注释
+func LoadLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines, scanner := make([]string, 0), bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,211 @@
+package fdd
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//dnsQuery 构造 example.com A 查询
+func dnsQuery(id uint16) []byte {
+	pkt := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	pkt = append(pkt, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0)
+	return append(pkt, 0, 1, 0, 1)
+}
+
+//dnsAnswer 构造对 dnsQuery 的应答, 答案记录的名字用指向问题的压缩指针
+func dnsAnswer(id uint16, ttl uint32) []byte {
+	pkt := dnsQuery(id)
+	pkt[2], pkt[3], pkt[7] = 0x81, 0x80, 1
+	pkt = append(pkt, 0xC0, 12, 0, 1, 0, 1)
+	pkt = append(pkt, byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl))
+	return append(pkt, 0, 4, 1, 2, 3, 4)
+}
+
+func TestParseDnsQuestion(t *testing.T) {
+	loop := dnsQuery(1)[:12]
+	//问题名字的压缩指针指向自身
+	loop = append(loop, 0xC0, 12, 0, 1, 0, 1)
+	pair := dnsQuery(1)[:12]
+	//两个指针互相指向
+	pair = append(pair, 0xC0, 14, 0xC0, 12, 0, 1, 0, 1)
+	twoQ := dnsQuery(1)
+	twoQ[5] = 2
+	tests := []struct {
+		name string
+		pkt  []byte
+		ok   bool
+	}{
+		{"query", dnsQuery(1), true},
+		{"answer", dnsAnswer(1, 60), true},
+		{"empty", nil, false},
+		{"header only", dnsQuery(1)[:12], false},
+		{"truncated name", dnsQuery(1)[:18], false},
+		{"truncated type", dnsQuery(1)[:27], false},
+		{"pointer loop", loop, false},
+		{"pointer pair loop", pair, false},
+		{"two questions", twoQ, false},
+	}
+	for _, tt := range tests {
+		h, q, err := parseDnsQuestion(tt.pkt)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && (h.ID != 1 || dnsName(q) != "example.com" || q.Type != dnsmessage.TypeA) {
+			t.Errorf("%s: got id %d name %q type %v", tt.name, h.ID, dnsName(q), q.Type)
+		}
+	}
+}
+
+func TestDnsCacheEntry(t *testing.T) {
+	now := time.Now()
+	e := newDnsCacheEntry(dnsAnswer(1, 60), now)
+	if e == nil {
+		t.Fatal("answer with compressed name not cached")
+	}
+	answer := e.answer(7, now.Add(10*time.Second))
+	var msg dnsmessage.Message
+	if err := msg.Unpack(answer); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.ID != 7 || len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != 50 {
+		t.Fatalf("unexpected cached answer: %+v", msg)
+	}
+	if a, ok := msg.Answers[0].Body.(*dnsmessage.AResource); !ok || a.A != [4]byte{1, 2, 3, 4} || msg.Answers[0].Header.Name.String() != "example.com." {
+		t.Fatalf("unexpected answer record: %+v", msg.Answers[0])
+	}
+
+	full := dnsAnswer(1, 60)
+	truncated := dnsAnswer(1, 60)
+	truncated[2] |= 0x02
+	loop := append([]byte(nil), full...)
+	//答案记录的名字指向自身
+	loop[len(dnsQuery(1))+1] = byte(len(dnsQuery(1)))
+	tests := []struct {
+		name string
+		pkt  []byte
+	}{
+		{"zero ttl", dnsAnswer(1, 0)},
+		{"tc flag", truncated},
+		{"truncated rdata", full[:len(full)-2]},
+		{"truncated record header", full[:len(dnsQuery(1))+6]},
+		{"answer pointer loop", loop},
+	}
+	for _, tt := range tests {
+		if newDnsCacheEntry(tt.pkt, now) != nil {
+			t.Errorf("%s: should not be cached", tt.name)
+		}
+	}
+}
+
+func TestDnsCacheCoalesce(t *testing.T) {
+	dc, _ := NewDNSCache("", "")
+	forwarded := dnsQuery(1)
+	if _, handled := dc.OnQuery(3, nil, forwarded); handled {
+		t.Fatal("first query should be forwarded")
+	}
+	if answer, handled := dc.OnQuery(4, nil, dnsQuery(2)); !handled || answer != nil {
+		t.Fatal("same query in flight should wait")
+	}
+	fid := binary.BigEndian.Uint16(forwarded)
+	replies, ok := dc.OnAnswer(dnsAnswer(fid, 60))
+	if !ok || len(replies) != 2 {
+		t.Fatalf("got %d replies, want 2", len(replies))
+	}
+	for i, r := range replies {
+		if id := binary.BigEndian.Uint16(r.pkt); id != uint16(i+1) || r.fd != i+3 {
+			t.Errorf("reply %d: id %d fd %d", i, id, r.fd)
+		}
+	}
+	answer, handled := dc.OnQuery(5, nil, dnsQuery(9))
+	if !handled || answer == nil || binary.BigEndian.Uint16(answer) != 9 {
+		t.Fatal("cached answer not returned")
+	}
+	if replies, ok := dc.OnAnswer(dnsAnswer(fid, 60)); !ok || len(replies) != 0 {
+		t.Fatal("answer without query in flight should be dropped")
+	}
+}
+
+func TestDnsCacheSpoofedAnswer(t *testing.T) {
+	dc, _ := NewDNSCache("", "")
+	forwarded := dnsQuery(1)
+	dc.OnQuery(3, nil, forwarded)
+	fid := binary.BigEndian.Uint16(forwarded)
+	//问题相同但查询ID不符的应答被丢弃, 不写入缓存, 查询仍在等待
+	if replies, ok := dc.OnAnswer(dnsAnswer(fid+1, 60)); !ok || len(replies) != 0 {
+		t.Fatalf("spoofed answer: %d replies", len(replies))
+	}
+	if len(dc.entries) != 0 || dc.inflight["example.com/1/1"] == nil {
+		t.Fatal("spoofed answer cached or query dropped")
+	}
+	if replies, _ := dc.OnAnswer(dnsAnswer(fid, 60)); len(replies) != 1 || binary.BigEndian.Uint16(replies[0].pkt) != 1 {
+		t.Fatal("real answer not delivered")
+	}
+}
+
+func TestDnsCacheInflightSweep(t *testing.T) {
+	dc, _ := NewDNSCache("", "")
+	for i := 0; i < 100; i++ {
+		q := dnsQuery(uint16(i))
+		q[13] = byte('a' + i%26)
+		q[14] = byte('a' + i/26)
+		dc.OnQuery(3, nil, q)
+	}
+	if len(dc.inflight) != 100 {
+		t.Fatalf("%d queries in flight, want 100", len(dc.inflight))
+	}
+	now := time.Now()
+	dc.HandleTick(now)
+	if len(dc.inflight) != 100 {
+		t.Fatal("fresh queries swept")
+	}
+	dc.HandleTick(now.Add(kDnsInflightTimeout))
+	if len(dc.inflight) != 0 {
+		t.Fatalf("%d stale queries left", len(dc.inflight))
+	}
+}
+
+func TestDnsCacheBlock(t *testing.T) {
+	dc, _ := NewDNSCache("", "")
+	dc.blocklist["com"] = struct{}{}
+	answer, handled := dc.OnQuery(3, nil, dnsQuery(1))
+	var msg dnsmessage.Message
+	if !handled || msg.Unpack(answer) != nil || msg.Header.RCode != dnsmessage.RCodeNameError || msg.Header.ID != 1 {
+		t.Fatalf("blocked domain answer: %+v", msg.Header)
+	}
+}
+
+func TestDnsStreamCodec(t *testing.T) {
+	dc, _ := NewDNSCache("", "")
+	c := dc.NewStreamCodec()
+	frame := func(pkt []byte) []byte {
+		return append([]byte{byte(len(pkt) >> 8), byte(len(pkt))}, pkt...)
+	}
+	//查询分两次到达
+	q := frame(dnsQuery(1))
+	if plain, _ := c.Decode(q[:5]); len(plain) != 0 {
+		t.Fatal("partial frame forwarded")
+	}
+	if plain, _ := c.Decode(q[5:]); string(plain) != string(q) {
+		t.Fatal("query not forwarded")
+	}
+	a := frame(dnsAnswer(1, 60))
+	c.Encode(a)
+	if out := c.Output(); string(out) != string(a) {
+		t.Fatal("answer not forwarded to client")
+	}
+	//已缓存的查询本地应答, 未缓存的继续转发
+	other := dnsQuery(2)
+	other[len(other)-3] = 28
+	plain, _ := c.Decode(append(frame(dnsQuery(5)), frame(other)...))
+	if string(plain) != string(frame(other)) {
+		t.Fatal("uncached query not forwarded")
+	}
+	out := c.Output()
+	if len(out) < 2 || int(binary.BigEndian.Uint16(out)) != len(out)-2 || binary.BigEndian.Uint16(out[2:]) != 5 {
+		t.Fatal("cached answer not framed")
+	}
+}
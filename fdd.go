@@ -2,7 +2,9 @@ package fdd
 
 import (
 	"errors"
+	"net/http"
 	"os"
+	"strconv"
 
 	nested "github.com/antonfisher/nested-logrus-formatter"
 	"github.com/rocinan/fdd/poller"
@@ -20,37 +22,303 @@ func init() {
 }
 
 type Fdd struct {
+	acl       *ACL
+	stats     *Stats
+	limiter   *Limiter
+	shaper    *Shaper
+	quota     *Quota
+	dnsCache  *DNSCache
+	hostAddrs *HostAddrs
+	tls       *TLSServer
+	tlsClient *TLSClient
+	tunnel    *Tunnel
+	mux       *Mux
+	upstream  *Upstream
+	resolver  *Resolver
 	tcpServer *TCPRelay
 	udpServer *UDPRelay
+	watcher   *AddrWatcher
+	statsSrv  *http.Server
 	eventLoop *poller.EventLoop
 }
 
 func (f *Fdd) Start(cfg *Config) (err error) {
+	switch cfg.AddrFamily {
+	case "", FamilyPreferV4, FamilyPreferV6, FamilyOnlyV4, FamilyOnlyV6:
+	default:
+		return errors.New("invalid address family: " + cfg.AddrFamily)
+	}
+	//经代理链转发时目标域名由代理解析
+	if cfg.TargetSrv != "" || (cfg.TargetDomain != "" && len(cfg.Upstreams) == 0) {
+		f.resolver = NewResolver(cfg)
+		interval, err := f.resolver.Resolve()
+		if err != nil {
+			return errors.New("resolver target err: " + err.Error())
+		}
+		f.resolver.Start(interval)
+	}
+	if cfg.HasACL() {
+		if f.acl, err = NewACL(cfg.AllowCIDRs, cfg.DenyCIDRs, cfg.AllowFile, cfg.DenyFile); err != nil {
+			return errors.New("load acl err: " + err.Error())
+		}
+	}
+	if cfg.HasQuota() {
+		if err = ValidQuotaConfig(cfg); err != nil {
+			return err
+		} else if f.quota, err = NewQuota(cfg); err != nil {
+			return errors.New("load quota err: " + err.Error())
+		}
+	}
+	if cfg.ProxyProtocol < 0 || cfg.ProxyProtocol > 2 {
+		return errors.New("invalid proxy protocol version: " + strconv.Itoa(cfg.ProxyProtocol))
+	} else if cfg.ProxyProtocol == 1 {
+		log.Warn("proxy protocol v1 only applies to tcp, udp is forwarded without header")
+	}
+	if cfg.ProxyProtocolIn != "" && cfg.ProxyProtocolIn != ProxyInAccept && cfg.ProxyProtocolIn != ProxyInRequire {
+		return errors.New("invalid proxy protocol mode: " + cfg.ProxyProtocolIn)
+	} else if cfg.ProxyHeaderTimeout <= 0 {
+		cfg.ProxyHeaderTimeout = 5
+	}
+	if cfg.PeekTimeout <= 0 {
+		cfg.PeekTimeout = 5
+	}
+	if cfg.Transparent != "" && cfg.Transparent != TransparentRedirect && cfg.Transparent != TransparentTProxy {
+		return errors.New("invalid transparent mode: " + cfg.Transparent)
+	} else if cfg.Transparent == TransparentRedirect {
+		log.Warn("redirect mode only applies to tcp, udp transparent proxy needs tproxy")
+	}
+	if _, _, isUnix := UnixPath(cfg.ListenAddr); isUnix && cfg.Transparent != "" {
+		return errors.New("transparent mode needs an ip listen addr")
+	}
+	if cfg.Transparent != "" && cfg.DnsCache {
+		log.Warn("dns cache is not supported in transparent mode, disabled")
+		cfg.DnsCache = false
+	} else if cfg.DnsCache && (cfg.SocksServer || len(cfg.SNIRoutes) != 0 || len(cfg.HTTPRoutes) != 0 || len(cfg.SniffRoutes) != 0) {
+		return errors.New("dns cache forwards to a single resolver, can not be used with socks5 server or routes")
+	} else if cfg.DnsCache {
+		if f.dnsCache, err = NewDNSCache(cfg.DnsHostsFile, cfg.DnsBlockFile); err != nil {
+			return errors.New("load dns cache err: " + err.Error())
+		}
+	}
+	if cfg.SourcePool, err = NewSourcePool(cfg.SourceAddrs); err != nil {
+		return err
+	} else if cfg.SourcePool != nil && cfg.SpoofSource {
+		log.Warn("source address pool is ignored when spoofing client ip")
+	}
+	if len(cfg.TLSCerts) != 0 {
+		if f.tls, err = NewTLSServer(cfg.TLSCerts, cfg.TLSClientCA); err != nil {
+			return errors.New("load tls certificate err: " + err.Error())
+		}
+	} else if cfg.TLSClientCA != "" {
+		return errors.New("tls client ca needs tls certificate")
+	}
+	if len(cfg.HTTPRoutes) != 0 && len(cfg.TLSCerts) != 0 {
+		return errors.New("http routing reads plaintext requests, can not be used with tls termination")
+	}
+	if cfg.RemoteTLS {
+		if f.tlsClient, err = NewTLSClient(cfg.RemoteTLSServerName, cfg.RemoteTLSCA, cfg.RemoteTLSCert, cfg.RemoteTLSPins); err != nil {
+			return errors.New("load target tls config err: " + err.Error())
+		}
+	}
+	if cfg.SocksServer && (cfg.Transparent != "" || len(cfg.TLSCerts) != 0 || len(cfg.SNIRoutes) != 0 || len(cfg.HTTPRoutes) != 0 || len(cfg.SniffRoutes) != 0) {
+		return errors.New("socks5 server can not be used with transparent mode, tls termination or routes")
+	}
+	if cfg.Tunnel != "" {
+		if f.tunnel, err = NewTunnel(cfg.Tunnel, cfg.TunnelKey); err != nil {
+			return err
+		} else if f.tunnel.server && (f.tls != nil || cfg.SocksServer || len(cfg.SNIRoutes) != 0 || len(cfg.HTTPRoutes) != 0 || len(cfg.SniffRoutes) != 0) {
+			return errors.New("tunnel server reads encrypted streams, can not be used with tls termination, socks5 server or routes")
+		} else if !f.tunnel.server && (f.tlsClient != nil || cfg.SocksServer) {
+			return errors.New("tunnel client can not be used with target tls or socks5 server")
+		}
+	}
+	if f.upstream, err = NewUpstream(cfg.Upstreams, cfg.AddrFamily); err != nil {
+		return errors.New("load upstream proxy err: " + err.Error())
+	} else if _, _, isUnix := UnixPath(cfg.RemoteAddr); isUnix && f.upstream != nil {
+		return errors.New("unix target can not be reached through upstream proxy")
+	}
 	f.eventLoop, err = poller.Create()
 	if err != nil {
 		return err
 	}
-	f.tcpServer, err = NewTCPRelay(cfg)
-	if err != nil {
-		return errors.New("start TcpServer err: " + err.Error())
+	f.stats = new(Stats)
+	if cfg.Mux != "" && cfg.UdpOverTCP != "" {
+		return errors.New("mux already carries udp, can not be used with udp over tcp")
+	} else if mode := cfg.Mux + cfg.UdpOverTCP; mode != "" {
+		//udp over tcp 为只承载udp会话的单连接多路复用
+		conns := cfg.MuxConns
+		if cfg.UdpOverTCP != "" {
+			conns = 1
+		}
+		if f.mux, err = NewMux(mode, conns, cfg, f.stats); err != nil {
+			return err
+		}
+		f.mux.udpOnly = cfg.UdpOverTCP != ""
+		if f.mux.server && (f.tls != nil || cfg.SocksServer || cfg.Transparent != "" || cfg.ProxyProtocolIn != "" || len(cfg.SNIRoutes) != 0 || len(cfg.HTTPRoutes) != 0 || len(cfg.SniffRoutes) != 0) {
+			return errors.New("mux server can not be used with tls termination, socks5 server, transparent mode, proxy protocol or routes")
+		} else if !f.mux.server && (f.upstream != nil || cfg.SocksServer || cfg.Transparent != "" || len(cfg.SNIRoutes) != 0 || len(cfg.HTTPRoutes) != 0 || len(cfg.SniffRoutes) != 0) {
+			return errors.New("mux client can not be used with upstream proxy, socks5 server, transparent mode or routes")
+		} else if f.tunnel != nil && f.tunnel.server != f.mux.server {
+			return errors.New("mux and tunnel must be both client or both server")
+		}
+		//隧道加密整条多路复用连接, 不再单独处理每个连接和报文
+		f.mux.tunnel = f.tunnel
 	}
-	f.udpServer, err = NewUDPRelay(cfg)
-	if err != nil {
-		return errors.New("start TcpServer err: " + err.Error())
+	f.limiter = NewLimiter(cfg, f.stats)
+	if f.shaper = NewShaper(cfg); f.shaper != nil {
+		f.shaper.quota = f.quota
+	}
+	if f.mux != nil {
+		//多路复用服务端的udp流不经 UDPRelay, 由 Mux 按客户端地址检查
+		f.mux.acl, f.mux.limiter, f.mux.shaper, f.mux.quota = f.acl, f.limiter, f.shaper, f.quota
+	}
+	tcpOn, udpOn := cfg.Relays()
+	if !tcpOn && !udpOn {
+		return errors.New("unix stream and datagram socket can not be bridged")
+	} else if cfg.SocksServer && !tcpOn {
+		return errors.New("socks5 server needs a stream listen addr")
+	} else if f.mux != nil && f.mux.server && !tcpOn {
+		return errors.New("mux server needs a stream listen addr")
+	} else if f.mux != nil && f.mux.server {
+		//多路复用服务端的udp经流转发
+		udpOn = false
+	} else if f.mux != nil && f.mux.udpOnly && !udpOn {
+		return errors.New("udp over tcp client needs a datagram listen addr")
+	} else if f.mux != nil && f.mux.udpOnly {
+		//对端端口为 udp over tcp 服务端, 不能再直接转发tcp连接
+		log.Warn("udp over tcp client only forwards udp, tcp relay disabled")
+		tcpOn = false
+	} else if f.mux != nil && !tcpOn {
+		return errors.New("mux client needs stream listen and target addrs")
+	} else if cfg.SocksServer {
+		//SOCKS5模式下udp经 UDP ASSOCIATE 转发
+		udpOn = false
+	} else if udpOn && !cfg.HasDefaultTarget() {
+		log.Warn("no default target, udp relay disabled")
+		udpOn = false
+	} else if udpOn && f.upstream != nil && !f.upstream.SupportsUDP() {
+		log.Warn("udp needs a single socks5 upstream proxy, udp relay disabled")
+		udpOn = false
+	}
+	var listeners []IListenSync
+	if cfg.Transparent != "" {
+		f.hostAddrs = NewHostAddrs()
+		listeners = append(listeners, f.hostAddrs)
+	}
+	if tcpOn {
+		f.tcpServer, err = NewTCPRelay(cfg, f.stats, f.limiter)
+		if err != nil {
+			return errors.New("start TcpServer err: " + err.Error())
+		}
+		f.tcpServer.acl, f.tcpServer.shaper, f.tcpServer.quota = f.acl, f.shaper, f.quota
+		f.tcpServer.dnsCache, f.tcpServer.hostAddrs = f.dnsCache, f.hostAddrs
+		f.tcpServer.tls, f.tcpServer.tlsClient = f.tls, f.tlsClient
+		f.tcpServer.upstream, f.tcpServer.tunnel = f.upstream, f.tunnel
+		if f.mux != nil {
+			f.tcpServer.mux, f.tcpServer.tunnel, f.mux.tcp = f.mux, nil, f.tcpServer
+		}
+		if f.dnsCache != nil && (f.tls != nil || (f.tcpServer.tunnel != nil && f.tcpServer.tunnel.server)) {
+			//tcp查询在tls或隧道内, 解密后的字节流不再经dns编解码器
+			log.Warn("tcp dns queries terminated by tls or tunnel are forwarded without cache")
+		}
+		f.tcpServer.AddToLoop(f.eventLoop)
+		listeners = append(listeners, f.tcpServer)
+	}
+	if udpOn && (f.tls != nil || f.tlsClient != nil) {
+		log.Warn("tls only applies to tcp, udp is forwarded as is")
+	}
+	if udpOn {
+		f.udpServer, err = NewUDPRelay(cfg, f.stats, f.limiter)
+		if err != nil {
+			return errors.New("start UdpServer err: " + err.Error())
+		}
+		f.udpServer.acl, f.udpServer.shaper, f.udpServer.quota = f.acl, f.shaper, f.quota
+		f.udpServer.dnsCache, f.udpServer.hostAddrs = f.dnsCache, f.hostAddrs
+		f.udpServer.upstream, f.udpServer.tunnel = f.upstream, f.tunnel
+		if f.mux != nil {
+			f.udpServer.mux, f.udpServer.tunnel = f.mux, nil
+		}
+		f.udpServer.AddToLoop(f.eventLoop)
+		listeners = append(listeners, f.udpServer)
+	}
+	if f.mux != nil {
+		f.mux.AddToLoop(f.eventLoop)
+	}
+	if IsInterfaceListen(cfg.ListenAddr) || f.hostAddrs != nil {
+		if f.watcher, err = NewAddrWatcher(listeners...); err != nil {
+			return errors.New("watch interface addr err: " + err.Error())
+		}
+		f.watcher.AddToLoop(f.eventLoop)
+	}
+	f.eventLoop.AddTicker(f.limiter)
+	if f.dnsCache != nil {
+		f.eventLoop.AddTicker(f.dnsCache)
+	}
+	if f.shaper != nil {
+		f.eventLoop.AddTicker(f.shaper)
+	}
+	if f.quota != nil {
+		f.eventLoop.AddTicker(f.quota)
+	}
+	if cfg.StatsAddr != "" {
+		if f.statsSrv, err = ServeStats(cfg.StatsAddr, f.stats); err != nil {
+			return errors.New("serve stats err: " + err.Error())
+		}
+	}
+	if f.tls != nil {
+		f.tls.Start()
 	}
-	f.tcpServer.AddToLoop(f.eventLoop)
-	f.udpServer.AddToLoop(f.eventLoop)
 	go f.eventLoop.Run()
 	return nil
 }
 
+//Stats 返回运行统计
+func (f *Fdd) Stats() *Stats {
+	return f.stats
+}
+
+//Reload 重新加载可热更新的配置(访问控制规则文件和TLS证书)
+func (f *Fdd) Reload() error {
+	if f.acl != nil {
+		if err := f.acl.Reload(); err != nil {
+			return err
+		}
+	}
+	if f.tls != nil {
+		return f.tls.Reload()
+	}
+	return nil
+}
+
 func (f *Fdd) Stop() {
 	log.Info("stop server ...")
-	f.tcpServer.Close()
-	f.udpServer.Close()
+	if f.resolver != nil {
+		f.resolver.Stop()
+	}
+	if f.tls != nil {
+		f.tls.Stop()
+	}
+	if f.watcher != nil {
+		f.watcher.Close()
+	}
+	if f.statsSrv != nil {
+		f.statsSrv.Close()
+	}
+	if f.mux != nil {
+		f.mux.Close()
+	}
+	if f.tcpServer != nil {
+		f.tcpServer.Close()
+	}
+	if f.udpServer != nil {
+		f.udpServer.Close()
+	}
 	if err := f.eventLoop.Close(); err != nil {
 		log.Warn(err)
 	}
 	log.Info("[eventLoop] poller exit.")
+	if f.quota != nil {
+		CheckError("[quota] save quota err: ", f.quota.Save())
+	}
 	log.Info("stop server done.")
 }
@@ -6,7 +6,6 @@ require (
 	github.com/antonfisher/nested-logrus-formatter v1.3.1
 	github.com/shuLhan/share v0.34.0
 	github.com/sirupsen/logrus v1.8.1
+	golang.org/x/net v0.0.0-20211201190559-0a0e4e1bb54c
 	golang.org/x/sys v0.0.0-20211124211545-fe61309f8881
 )
-
-require golang.org/x/net v0.0.0-20211201190559-0a0e4e1bb54c // indirect
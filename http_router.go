@@ -0,0 +1,126 @@
+package fdd
+
+import (
+	"bytes"
+	"net"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const kMaxMethodLen = 16
+
+var kHeaderEnd = []byte("\r\n\r\n")
+
+//HTTPRouter 读取第一个 HTTP/1.x 请求头, 按 Host 和路径前缀选择后端, 可选注入 X-Forwarded-For,
+//之后的数据不再解析, 直接转发
+type HTTPRouter struct {
+	table *RouteTable
+	xff   bool
+}
+
+func NewHTTPRouter(table *RouteTable, xff bool) *HTTPRouter {
+	return &HTTPRouter{table: table, xff: xff}
+}
+
+//Route 非HTTP请求或请求头不完整时使用默认项, 数据原样转发
+func (r *HTTPRouter) Route(data []byte, src unix.Sockaddr, final bool) ([]Backend, []byte, error) {
+	end := bytes.Index(data, kHeaderEnd)
+	if end < 0 && !final && maybeHTTP(data) {
+		return nil, nil, errRouteNeedMore
+	}
+	host, path := "", ""
+	if end >= 0 {
+		if req, ok := parseRequestHead(data[:end+2]); ok {
+			host, path = req.host, req.path
+			if ip := SockAddrIP(src); r.xff && ip != nil {
+				data = append(req.withForwardedFor(ip.String()), data[end+2:]...)
+			}
+		}
+	}
+	b, ok := r.table.Lookup(host, path)
+	if !ok {
+		return nil, data, nil
+	}
+	log.Debug("[http_router] ", Addr2Str(src), " host: ", host, " path: ", path, " => ", b.Addr, ":", b.Port)
+	return []Backend{b}, data, nil
+}
+
+//maybeHTTP 判断已读取的数据是否可能是HTTP请求行的开头(大写的方法名后跟空格)
+func maybeHTTP(data []byte) bool {
+	for i, c := range data {
+		if c == ' ' {
+			return i > 0
+		} else if c < 'A' || c > 'Z' || i >= kMaxMethodLen {
+			return false
+		}
+	}
+	return true
+}
+
+type requestHead struct {
+	lines []string
+	host  string
+	path  string
+}
+
+//parseRequestHead 解析以CRLF结尾的请求行和请求头, request-target 为绝对形式时以其中的主机为准
+func parseRequestHead(head []byte) (*requestHead, bool) {
+	lines := strings.Split(strings.TrimSuffix(string(head), "\r\n"), "\r\n")
+	parts := strings.SplitN(lines[0], " ", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		return nil, false
+	}
+	req := &requestHead{lines: lines, path: parts[1]}
+	for _, scheme := range []string{"http://", "https://"} {
+		if strings.HasPrefix(strings.ToLower(req.path), scheme) {
+			rest := req.path[len(scheme):]
+			if i := strings.IndexByte(rest, '/'); i >= 0 {
+				req.host, req.path = rest[:i], rest[i:]
+			} else {
+				req.host, req.path = rest, "/"
+			}
+		}
+	}
+	if i := strings.IndexByte(req.path, '?'); i >= 0 {
+		req.path = req.path[:i]
+	}
+	for _, line := range lines[1:] {
+		if req.host != "" {
+			break
+		}
+		if name, value, ok := splitHeader(line); ok && strings.EqualFold(name, "Host") {
+			req.host = value
+		}
+	}
+	if h, _, err := net.SplitHostPort(req.host); err == nil {
+		req.host = h
+	}
+	req.host = strings.Trim(req.host, "[]")
+	return req, true
+}
+
+//withForwardedFor 返回追加了客户端ip的请求头(以CRLF结尾, 不含空行), 已有 X-Forwarded-For 时追加到末尾
+func (req *requestHead) withForwardedFor(ip string) []byte {
+	var buf bytes.Buffer
+	found := false
+	for _, line := range req.lines {
+		if name, value, ok := splitHeader(line); ok && !found && strings.EqualFold(name, "X-Forwarded-For") {
+			line, found = name+": "+value+", "+ip, true
+		}
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	if !found {
+		buf.WriteString("X-Forwarded-For: " + ip + "\r\n")
+	}
+	return buf.Bytes()
+}
+
+func splitHeader(line string) (name, value string, ok bool) {
+	i := strings.IndexByte(line, ':')
+	if i <= 0 {
+		return "", "", false
+	}
+	return line[:i], strings.TrimSpace(line[i+1:]), true
+}
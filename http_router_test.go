@@ -0,0 +1,115 @@
+package fdd
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseRequestHead(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		ok   bool
+		host string
+		path string
+	}{
+		{"host header", "GET /a/b?x=1 HTTP/1.1\r\nHost: Example.com:8080\r\n", true, "Example.com", "/a/b"},
+		{"absolute form", "GET http://a.com/x HTTP/1.1\r\nHost: b.com\r\n", true, "a.com", "/x"},
+		{"absolute no path", "GET HTTPS://a.com HTTP/1.1\r\n", true, "a.com", "/"},
+		{"ipv6 host", "GET / HTTP/1.0\r\nhost: [::1]:80\r\n", true, "::1", "/"},
+		{"no host", "GET / HTTP/1.1\r\nAccept: */*\r\n", true, "", "/"},
+		{"header without colon", "GET / HTTP/1.1\r\nbroken\r\n:empty\r\nHost: a\r\n", true, "a", "/"},
+		{"http2 preface", "PRI * HTTP/2.0\r\n", false, "", ""},
+		{"missing version", "GET /\r\nHost: a\r\n", false, "", ""},
+		{"empty", "", false, "", ""},
+		{"only crlf", "\r\n", false, "", ""},
+	}
+	for _, tt := range tests {
+		req, ok := parseRequestHead([]byte(tt.head))
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v", tt.name, ok)
+			continue
+		}
+		if ok && (req.host != tt.host || req.path != tt.path) {
+			t.Errorf("%s: got %q %q, want %q %q", tt.name, req.host, req.path, tt.host, tt.path)
+		}
+	}
+}
+
+func TestWithForwardedFor(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want string
+	}{
+		{
+			"add",
+			"GET / HTTP/1.1\r\nHost: a\r\n",
+			"GET / HTTP/1.1\r\nHost: a\r\nX-Forwarded-For: 10.0.0.1\r\n",
+		},
+		{
+			"append to existing",
+			"GET / HTTP/1.1\r\nx-forwarded-for:1.1.1.1 \r\nHost: a\r\n",
+			"GET / HTTP/1.1\r\nx-forwarded-for: 1.1.1.1, 10.0.0.1\r\nHost: a\r\n",
+		},
+		{
+			"only first header",
+			"GET / HTTP/1.1\r\nX-Forwarded-For: 1.1.1.1\r\nX-Forwarded-For: 2.2.2.2\r\n",
+			"GET / HTTP/1.1\r\nX-Forwarded-For: 1.1.1.1, 10.0.0.1\r\nX-Forwarded-For: 2.2.2.2\r\n",
+		},
+	}
+	for _, tt := range tests {
+		req, ok := parseRequestHead([]byte(tt.head))
+		if !ok {
+			t.Fatalf("%s: parse failed", tt.name)
+		}
+		if got := string(req.withForwardedFor("10.0.0.1")); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPRouterRoute(t *testing.T) {
+	table, err := ParseRouteTable([]string{"a.com=127.0.0.1:81", "*=127.0.0.1:80"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewHTTPRouter(table, true)
+	src := &unix.SockaddrInet4{Addr: [4]byte{10, 0, 0, 1}, Port: 1234}
+	big := "GET / HTTP/1.1\r\nHost: a.com\r\nX: " + strings.Repeat("a", kMaxPeekSize)
+	tests := []struct {
+		name  string
+		data  string
+		final bool
+		more  bool
+		port  int
+		out   string
+	}{
+		{"partial", "GET / HTTP/1.1\r\nHost: a.com\r\n", false, true, 0, ""},
+		{"routed", "GET / HTTP/1.1\r\nHost: a.com\r\n\r\nbody", false, false, 81, "GET / HTTP/1.1\r\nHost: a.com\r\nX-Forwarded-For: 10.0.0.1\r\n\r\nbody"},
+		{"not http", "\x16\x03\x01", false, false, 80, "\x16\x03\x01"},
+		{"lowercase method", "get / HTTP/1.1\r\n", false, false, 80, "get / HTTP/1.1\r\n"},
+		{"long method", strings.Repeat("A", kMaxMethodLen+1), false, false, 80, strings.Repeat("A", kMaxMethodLen+1)},
+		{"oversized head", big, true, false, 80, big},
+		{"malformed head", "GET /\r\nHost: a.com\r\n\r\n", false, false, 80, "GET /\r\nHost: a.com\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		backends, out, err := r.Route([]byte(tt.data), src, tt.final)
+		if tt.more {
+			if err != errRouteNeedMore {
+				t.Errorf("%s: err = %v, want need more", tt.name, err)
+			}
+			continue
+		}
+		if err != nil || len(backends) != 1 || backends[0].Port != tt.port || string(out) != tt.out {
+			t.Errorf("%s: got %v %q %v", tt.name, backends, out, err)
+		}
+	}
+	//unix socket客户端没有ip, 不注入请求头
+	data := "GET / HTTP/1.1\r\nHost: a.com\r\n\r\n"
+	if _, out, _ := r.Route([]byte(data), &unix.SockaddrUnix{Name: "@x"}, false); string(out) != data {
+		t.Errorf("unix client: got %q", out)
+	}
+}
@@ -0,0 +1,159 @@
+package fdd
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	kLimiterExpire = time.Minute
+)
+
+//tokenBucket 令牌桶, rate为每秒补充的令牌数, burst为桶容量
+type tokenBucket struct {
+	tokens float64
+	rate   float64
+	burst  float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return tokenBucket{tokens: burst, rate: rate, burst: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if b.tokens += now.Sub(b.last).Seconds() * b.rate; b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+//take 取n个令牌, 不足时返回false
+func (b *tokenBucket) take(n float64, now time.Time) bool {
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+type sourceLimit struct {
+	connRate    tokenBucket
+	tcpFlows    int
+	udpSessions int
+	lastSeen    time.Time
+}
+
+//Limiter 按来源ip限制新建连接速率和并发tcp/udp数量, 以及整条规则的并发上限, 仅在eventLoop线程中使用
+type Limiter struct {
+	cfg         *Config
+	stats       *Stats
+	sources     map[string]*sourceLimit
+	tcpFlows    int
+	udpSessions int
+	lastSweep   time.Time
+}
+
+func NewLimiter(cfg *Config, stats *Stats) *Limiter {
+	return &Limiter{
+		cfg:     cfg,
+		stats:   stats,
+		sources: make(map[string]*sourceLimit, cfg.HandlerCap),
+	}
+}
+
+func (l *Limiter) source(ip net.IP, now time.Time) *sourceLimit {
+	key := string(ip.To16())
+	s, ok := l.sources[key]
+	if !ok {
+		s = &sourceLimit{connRate: newTokenBucket(l.cfg.ConnRate, float64(l.cfg.ConnBurst), now)}
+		l.sources[key] = s
+	}
+	s.lastSeen = now
+	return s
+}
+
+//allowConn 检查来源ip的新建连接速率
+func (l *Limiter) allowConn(s *sourceLimit, now time.Time) bool {
+	if l.cfg.ConnRate > 0 && !s.connRate.take(1, now) {
+		l.stats.add(&l.stats.ConnRateHits)
+		return false
+	}
+	return true
+}
+
+//AcquireTcp 申请一个tcp流配额
+func (l *Limiter) AcquireTcp(ip net.IP) bool {
+	now := time.Now()
+	s := l.source(ip, now)
+	if l.cfg.MaxTcpFlows > 0 && l.tcpFlows >= l.cfg.MaxTcpFlows {
+		l.stats.add(&l.stats.GlobalTcpHits)
+		return false
+	}
+	if l.cfg.MaxTcpPerIP > 0 && s.tcpFlows >= l.cfg.MaxTcpPerIP {
+		l.stats.add(&l.stats.TcpLimitHits)
+		return false
+	}
+	if !l.allowConn(s, now) {
+		return false
+	}
+	s.tcpFlows++
+	l.tcpFlows++
+	return true
+}
+
+func (l *Limiter) ReleaseTcp(ip net.IP) {
+	l.tcpFlows--
+	if s, ok := l.sources[string(ip.To16())]; ok {
+		s.tcpFlows--
+	}
+}
+
+//AcquireUdp 申请一个udp会话配额
+func (l *Limiter) AcquireUdp(ip net.IP) bool {
+	now := time.Now()
+	s := l.source(ip, now)
+	if l.cfg.MaxUdpSessions > 0 && l.udpSessions >= l.cfg.MaxUdpSessions {
+		l.stats.add(&l.stats.GlobalUdpHits)
+		return false
+	}
+	if l.cfg.MaxUdpPerIP > 0 && s.udpSessions >= l.cfg.MaxUdpPerIP {
+		l.stats.add(&l.stats.UdpLimitHits)
+		return false
+	}
+	if !l.allowConn(s, now) {
+		return false
+	}
+	s.udpSessions++
+	l.udpSessions++
+	return true
+}
+
+func (l *Limiter) ReleaseUdp(ip net.IP) {
+	l.udpSessions--
+	if s, ok := l.sources[string(ip.To16())]; ok {
+		s.udpSessions--
+	}
+}
+
+//HandleTick 清理空闲且令牌已满的来源状态
+func (l *Limiter) HandleTick(now time.Time) {
+	if now.Sub(l.lastSweep) < kLimiterExpire/6 {
+		return
+	}
+	l.lastSweep = now
+	for k, s := range l.sources {
+		if s.tcpFlows == 0 && s.udpSessions == 0 && now.Sub(s.lastSeen) > kLimiterExpire && s.connRate.full(now) {
+			delete(l.sources, k)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package fdd
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/rocinan/fdd/poller"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	kListenFamilyV4 = ":v4"
+	kListenFamilyV6 = ":v6"
+)
+
+//IsInterfaceListen 判断监听地址是否为网卡名(可带 :v4/:v6 后缀)
+func IsInterfaceListen(spec string) bool {
+	_, _, isUnix := UnixPath(spec)
+	return !isUnix && net.ParseIP(spec) == nil
+}
+
+//ResolveListenAddrs 解析监听地址, ip直接返回, 网卡名返回网卡当前的全部地址,
+//带 :v4/:v6 后缀时只返回对应地址族, 不支持需要指定zone的ipv6链路本地地址
+func ResolveListenAddrs(spec string) ([]string, error) {
+	if ip := net.ParseIP(spec); ip != nil {
+		return []string{ip.String()}, nil
+	} else if _, _, ok := UnixPath(spec); ok {
+		return []string{spec}, nil
+	}
+	name, family := spec, 0
+	if strings.HasSuffix(spec, kListenFamilyV4) {
+		name, family = strings.TrimSuffix(spec, kListenFamilyV4), unix.AF_INET
+	} else if strings.HasSuffix(spec, kListenFamilyV6) {
+		name, family = strings.TrimSuffix(spec, kListenFamilyV6), unix.AF_INET6
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, errors.New("invalid listen addr " + spec + ": not an ip or interface name")
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if (family == unix.AF_INET && n.IP.To4() == nil) || (family == unix.AF_INET6 && n.IP.To4() != nil) {
+			continue
+		}
+		list = append(list, n.IP.String())
+	}
+	return list, nil
+}
+
+//IListenSync 网卡地址变化时同步监听socket
+type IListenSync interface {
+	SyncListeners() error
+}
+
+//AddrWatcher 通过netlink订阅网卡地址变化, 在eventLoop中通知监听地址为网卡名的服务并刷新透明代理的本机地址缓存
+type AddrWatcher struct {
+	fd        int
+	listeners []IListenSync
+	eventLoop *poller.EventLoop
+}
+
+func NewAddrWatcher(listeners ...IListenSync) (*AddrWatcher, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	sa := &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR}
+	if err := unix.Bind(fd, sa); err != nil {
+		CloseSocket(fd)
+		return nil, err
+	}
+	return &AddrWatcher{fd: fd, listeners: listeners}, nil
+}
+
+func (aw *AddrWatcher) AddToLoop(ep *poller.EventLoop) error {
+	aw.eventLoop = ep
+	return aw.eventLoop.Register(aw.fd, kPollIn|kPollErr, aw)
+}
+
+//HandleEvent 读空netlink消息后统一同步一次, 不解析具体的地址变更
+func (aw *AddrWatcher) HandleEvent(fd, ev int) {
+	buf := make([]byte, kBuffSize)
+	changed := false
+	for {
+		n, err := unix.Read(fd, buf)
+		if err != nil || n <= 0 {
+			//ENOBUFS 表示消息溢出丢失, 同样需要重新同步
+			changed = changed || err == unix.ENOBUFS
+			break
+		}
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	for _, l := range aw.listeners {
+		CheckError("[addr_watcher] sync listeners err: ", l.SyncListeners())
+	}
+}
+
+func (aw *AddrWatcher) Close() {
+	aw.eventLoop.UnRegister(aw.fd)
+	CloseSocket(aw.fd)
+}
+
+//diffListenAddrs 对比当前监听与目标地址, 返回需要新增和关闭的地址
+func diffListenAddrs(current map[string]int, want []string) (add []string, remove []string) {
+	set := make(map[string]bool, len(want))
+	for _, a := range want {
+		set[a] = true
+		if _, ok := current[a]; !ok {
+			add = append(add, a)
+		}
+	}
+	for a := range current {
+		if !set[a] {
+			remove = append(remove, a)
+		}
+	}
+	return add, remove
+}
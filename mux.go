@@ -0,0 +1,877 @@
+package fdd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/rocinan/fdd/poller"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	MuxClient = "client"
+	MuxServer = "server"
+)
+
+//帧类型
+const (
+	kMuxSyn = iota
+	kMuxData
+	kMuxWindow
+	kMuxFin
+	kMuxPing
+	kMuxPong
+)
+
+//流类型, 随 kMuxSyn 发送
+const (
+	kMuxStreamTCP = iota
+	kMuxStreamUDP
+)
+
+const (
+	kMuxHeaderSize  = 7
+	kMuxMaxPayload  = 16 * 1024
+	kMuxWindowSize  = 256 * 1024
+	kMuxMaxPending  = 1024 * 1024
+	kMuxKeepalive   = 10 * time.Second
+	kMuxDeadTimeout = 30 * time.Second
+	kMuxMaxBackoff  = 30 * time.Second
+	kMuxUdpBacklog  = 64 * 1024
+	kMuxUdpQueue    = 64
+)
+
+var (
+	errMuxNoSession = errors.New("mux: no connected session")
+	errMuxProtocol  = errors.New("mux: protocol error")
+	errMuxWindow    = errors.New("mux: stream window exceeded")
+)
+
+//Mux 两个fdd之间的多路复用: client 端维持 MuxConns 条到目标的持久连接, 每个tcp连接和udp会话作为一个流在其上传输,
+//server 端接受这些连接并把每个流转发到自己的目标. 流在本地以 socketpair 表示, 一端由 Mux 读写,
+//另一端交给 TCPRelay/UDPRelay 当作普通的后端socket, 因此限速、配额、PROXY头等功能不需要改动.
+//打开流时携带原始客户端地址, server 端对可信的对端按该地址做访问控制和限流: tcp流经 TCPRelay, udp流由 Mux 自己检查
+type Mux struct {
+	server    bool
+	udpOnly   bool
+	cfg       *Config
+	trusted   []*net.IPNet
+	stats     *Stats
+	tunnel    *Tunnel
+	tcp       *TCPRelay
+	acl       *ACL
+	limiter   *Limiter
+	shaper    *Shaper
+	quota     *Quota
+	slots     []*muxSlot
+	sessions  map[*muxSession]struct{}
+	next      int
+	lastSweep time.Time
+	eventLoop *poller.EventLoop
+}
+
+//muxSlot client 端的一条持久连接, 断开后按指数退避重连
+type muxSlot struct {
+	session *muxSession
+	fails   int
+	backoff time.Duration
+	retryAt time.Time
+}
+
+//NewMux mode 为 client 或 server, client 端的连接数为 conns; udpOnly 为true时只承载udp会话(udp over tcp)
+func NewMux(mode string, conns int, cfg *Config, stats *Stats) (*Mux, error) {
+	if mode != MuxClient && mode != MuxServer {
+		return nil, errors.New("invalid mux mode: " + mode)
+	}
+	trusted, err := ParseCIDRs(cfg.ProxyTrusted)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mux{server: mode == MuxServer, cfg: cfg, trusted: trusted, stats: stats, sessions: make(map[*muxSession]struct{})}
+	if !m.server {
+		if conns <= 0 {
+			conns = 1
+		}
+		for i := 0; i < conns; i++ {
+			m.slots = append(m.slots, &muxSlot{})
+		}
+	}
+	return m, nil
+}
+
+func (m *Mux) AddToLoop(ep *poller.EventLoop) {
+	m.eventLoop = ep
+	m.eventLoop.AddTicker(m)
+}
+
+//HandleTick client 端重连断开的连接, 检查连接超时和保活, server 端每秒关闭空闲的udp流
+func (m *Mux) HandleTick(now time.Time) {
+	for i, slot := range m.slots {
+		if slot.session == nil && !now.Before(slot.retryAt) {
+			m.dial(i)
+		}
+	}
+	sweep := m.server && m.cfg.UdpTimeOut > 0 && now.Sub(m.lastSweep) >= time.Second
+	if sweep {
+		m.lastSweep = now
+	}
+	for s := range m.sessions {
+		s.tick(now, sweep)
+	}
+}
+
+//dial 非阻塞连接目标, 连接结果在eventLoop中处理, 多个后端时每次失败后换下一个
+func (m *Mux) dial(slot int) {
+	backends := OrderBackends(m.cfg.RemoteBackends())
+	b := backends[m.slots[slot].fails%len(backends)]
+	fd, done, err := connectNoBlock(b.Addr, b.Port, m.cfg.RemoteSocketOpts(nil))
+	if err != nil {
+		log.Warn("[mux] connect ", b.Addr, ":", b.Port, " err: ", err)
+		m.retry(slot)
+		return
+	}
+	s := &muxSession{
+		mux:        m,
+		fd:         fd,
+		slot:       slot,
+		connecting: !done,
+		deadline:   time.Now().Add(kConnTimeout),
+		streams:    make(map[uint32]*muxStream),
+	}
+	m.slots[slot].session, m.sessions[s] = s, struct{}{}
+	if err := m.eventLoop.Register(fd, kPollOut|kPollErr, s); err != nil {
+		log.Warn("[mux] reg session conn err: ", err)
+		s.close()
+		return
+	}
+	s.mode = kPollOut | kPollErr
+	if done {
+		s.established()
+	}
+}
+
+//retry 连接断开或失败后安排重连, 间隔从1秒开始加倍, 最长 kMuxMaxBackoff
+func (m *Mux) retry(slot int) {
+	sl := m.slots[slot]
+	sl.session, sl.fails = nil, sl.fails+1
+	if sl.backoff < time.Second {
+		sl.backoff = time.Second
+	} else if sl.backoff *= 2; sl.backoff > kMuxMaxBackoff {
+		sl.backoff = kMuxMaxBackoff
+	}
+	sl.retryAt = time.Now().Add(sl.backoff)
+}
+
+//Accept server 端接管一条来自 client 端的连接
+func (m *Mux) Accept(fd int, sa unix.Sockaddr) {
+	s := &muxSession{mux: m, fd: fd, slot: -1, peer: sa, streams: make(map[uint32]*muxStream)}
+	m.sessions[s] = struct{}{}
+	if err := m.eventLoop.Register(fd, kPollIn|kPollErr, s); err != nil {
+		log.Warn("[mux] reg session conn err: ", err)
+		s.close()
+		return
+	}
+	s.mode = kPollIn | kPollErr
+	s.established()
+}
+
+//Open client 端在流最少的连接上打开一个流, 返回交给调用方的 socketpair 一端,
+//tcp流为 SOCK_STREAM, udp流为保留报文边界的 SOCK_SEQPACKET; src 为客户端地址, dst 为其连接的原始目的地址
+func (m *Mux) Open(kind int, src, dst unix.Sockaddr) (int, error) {
+	var best *muxSession
+	for i := range m.slots {
+		s := m.slots[(m.next+i)%len(m.slots)].session
+		if s != nil && !s.connecting && (best == nil || len(s.streams) < len(best.streams)) {
+			best = s
+		}
+	}
+	m.next++
+	if best == nil {
+		return INVALID_SOCKET, errMuxNoSession
+	}
+	sotype := unix.SOCK_STREAM
+	if kind == kMuxStreamUDP {
+		sotype = unix.SOCK_SEQPACKET
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, sotype|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return INVALID_SOCKET, err
+	}
+	best.nextID++
+	if st := best.addStream(best.nextID, fds[0], kind); st == nil {
+		CloseSocket(fds[1])
+		return INVALID_SOCKET, errMuxNoSession
+	}
+	best.send(kMuxSyn, best.nextID, muxSynPayload(kind, src, dst))
+	return fds[1], nil
+}
+
+//muxSynPayload 生成 kMuxSyn 的数据: 流类型(1) + 客户端地址 + 目的地址, 地址为SOCKS5格式;
+//客户端没有ip(unix socket)时不携带地址, 目的地址未知时为 0.0.0.0:0
+func muxSynPayload(kind int, src, dst unix.Sockaddr) []byte {
+	payload := []byte{byte(kind)}
+	ip := SockAddrIP(src)
+	if ip == nil {
+		return payload
+	}
+	payload = appendSocksIP(payload, ip, SockAddrPort(src))
+	return appendSocksIP(payload, SockAddrIP(dst), SockAddrPort(dst))
+}
+
+//parseMuxSyn 解析 kMuxSyn 的数据, 未携带的地址返回nil
+func parseMuxSyn(payload []byte) (kind int, src, dst unix.Sockaddr, err error) {
+	if len(payload) < 1 {
+		return 0, nil, nil, errMuxProtocol
+	}
+	kind, payload = int(payload[0]), payload[1:]
+	if len(payload) == 0 {
+		return kind, nil, nil, nil
+	}
+	var addrs [2]unix.Sockaddr
+	for i := range addrs {
+		host, port, n, err := ParseSocksAddr(payload)
+		if err != nil || net.ParseIP(host) == nil {
+			return 0, nil, nil, errMuxProtocol
+		}
+		if port != 0 {
+			addrs[i] = SockAddrParse(host, port)
+		}
+		payload = payload[n:]
+	}
+	if len(payload) != 0 || addrs[0] == nil {
+		return 0, nil, nil, errMuxProtocol
+	}
+	return kind, addrs[0], addrs[1], nil
+}
+
+func (m *Mux) Close() {
+	for s := range m.sessions {
+		s.close()
+	}
+	m.slots = nil
+}
+
+//muxSession 一条承载多个流的连接, 帧格式为 类型(1) + 流id(4) + 长度(2) + 数据,
+//配置了隧道时整条连接经 tunnelCodec 加密
+type muxSession struct {
+	mux        *Mux
+	fd         int
+	slot       int
+	connecting bool
+	deadline   time.Time
+	peer       unix.Sockaddr
+	local      unix.Sockaddr
+	codec      StreamCodec
+	mode       int
+	in         []byte
+	out        []byte
+	congested  bool
+	streams    map[uint32]*muxStream
+	ready      []*muxStream
+	nextID     uint32
+	lastRecv   time.Time
+	lastSend   time.Time
+}
+
+//established 连接建立后创建编解码器并开始读取
+func (s *muxSession) established() {
+	s.connecting = false
+	if s.peer == nil {
+		s.peer, _ = unix.Getpeername(s.fd)
+	}
+	s.local, _ = unix.Getsockname(s.fd)
+	s.lastRecv, s.lastSend = time.Now(), time.Now()
+	if s.slot >= 0 {
+		sl := s.mux.slots[s.slot]
+		sl.fails, sl.backoff = 0, 0
+	}
+	s.mux.stats.gauge(&s.mux.stats.MuxSessions, 1)
+	log.Info("[mux] session established with ", Addr2Str(s.peer))
+	if s.mux.tunnel != nil {
+		s.codec = s.mux.tunnel.NewCodec(s.mux.eventLoop)
+		s.codec.SetNotify(s.onCodecEvent)
+		s.write(s.codec.Output())
+	}
+	s.update()
+}
+
+func (s *muxSession) HandleEvent(fd, ev int) {
+	if s.connecting {
+		if soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR); err != nil || soErr != 0 {
+			if err == nil {
+				err = unix.Errno(soErr)
+			}
+			log.Warn("[mux] connect err: ", err)
+			s.close()
+			return
+		}
+		s.established()
+		return
+	}
+	if Judge(ev & kPollIn) {
+		s.onRead()
+	}
+	if Judge(ev&kPollOut) && s.fd != INVALID_SOCKET {
+		s.flush()
+	}
+}
+
+func (s *muxSession) onRead() {
+	buf := make([]byte, kBuffSize)
+	n, err := BufferRecv(s.fd, &buf)
+	if err == unix.EAGAIN {
+		return
+	} else if err != nil || n <= 0 {
+		if err != nil {
+			log.Warn("[mux] session read err: ", err)
+		}
+		s.close()
+		return
+	}
+	s.lastRecv = time.Now()
+	s.onInput(buf[:n])
+}
+
+//onCodecEvent 隧道握手失败时关闭连接
+func (s *muxSession) onCodecEvent(err error) {
+	if s.fd == INVALID_SOCKET {
+		return
+	} else if err != nil {
+		log.Info("[mux] handshake with ", Addr2Str(s.peer), " err: ", err)
+		s.close()
+		return
+	}
+	s.onInput(nil)
+}
+
+//onInput 解密后按帧分发
+func (s *muxSession) onInput(data []byte) {
+	if s.codec != nil {
+		plain, err := s.codec.Decode(data)
+		s.write(s.codec.Output())
+		if err != nil {
+			if err != io.EOF {
+				log.Info("[mux] decode stream from ", Addr2Str(s.peer), " err: ", err)
+			}
+			s.close()
+			return
+		}
+		data = plain
+	}
+	s.in = append(s.in, data...)
+	for len(s.in) >= kMuxHeaderSize && s.fd != INVALID_SOCKET {
+		n := int(binary.BigEndian.Uint16(s.in[5:]))
+		if len(s.in) < kMuxHeaderSize+n {
+			break
+		}
+		typ, id, payload := s.in[0], binary.BigEndian.Uint32(s.in[1:]), s.in[kMuxHeaderSize:kMuxHeaderSize+n]
+		s.in = s.in[kMuxHeaderSize+n:]
+		if err := s.onFrame(typ, id, payload); err != nil {
+			log.Warn("[mux] session with ", Addr2Str(s.peer), " err: ", err)
+			s.close()
+			return
+		}
+	}
+	if len(s.in) == 0 {
+		s.in = nil
+	}
+}
+
+func (s *muxSession) onFrame(typ byte, id uint32, payload []byte) error {
+	st := s.streams[id]
+	switch typ {
+	case kMuxSyn:
+		kind, src, dst, err := parseMuxSyn(payload)
+		if !s.mux.server || st != nil || err != nil {
+			return errMuxProtocol
+		}
+		s.accept(id, kind, src, dst)
+	case kMuxData:
+		if st != nil {
+			st.onData(payload)
+		}
+	case kMuxWindow:
+		if len(payload) != 4 {
+			return errMuxProtocol
+		} else if st != nil {
+			st.sendWindow += int(binary.BigEndian.Uint32(payload))
+			st.update()
+		}
+	case kMuxFin:
+		if st != nil {
+			st.onFin()
+		}
+	case kMuxPing:
+		s.send(kMuxPong, 0, payload)
+	case kMuxPong:
+	default:
+		return errMuxProtocol
+	}
+	return nil
+}
+
+//accept server 端打开流: tcp流的另一端经 TCPRelay.admit 连接目标, udp流按 UDPRelay 的规则检查后直接使用连接到目标的udp socket.
+//对端在 ProxyTrusted 中时以其携带的客户端地址 src 做访问控制、限流和PROXY头, 否则视为来自对端本身
+func (s *muxSession) accept(id uint32, kind int, src, dst unix.Sockaddr) {
+	m := s.mux
+	if src == nil || !TrustedIP(m.trusted, SockAddrIP(s.peer)) {
+		src, dst = s.peer, s.local
+	} else if dst == nil {
+		dst = s.local
+	}
+	if kind == kMuxStreamTCP && !m.udpOnly {
+		fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			log.Warn("[mux] create stream err: ", err)
+			s.send(kMuxFin, id, nil)
+			return
+		}
+		if st := s.addStream(id, fds[0], kind); st == nil {
+			CloseSocket(fds[1])
+			return
+		}
+		//admit 失败时关闭 fds[1], 流随之结束
+		m.tcp.admit(fds[1], src, dst, nil, false, false)
+		return
+	} else if kind != kMuxStreamUDP {
+		s.send(kMuxFin, id, nil)
+		return
+	}
+	ip := SockAddrIP(src)
+	if m.acl != nil && ip != nil && !m.acl.Allowed(ip) {
+		log.Debug("[mux] reject udp stream from: ", Addr2Str(src))
+		m.stats.add(&m.stats.UdpDropped)
+		s.send(kMuxFin, id, nil)
+		return
+	} else if m.quota != nil && !m.quota.Allow(ip) {
+		log.Debug("[mux] quota exceeded, reject udp stream from: ", Addr2Str(src))
+		m.stats.add(&m.stats.UdpDropped)
+		s.send(kMuxFin, id, nil)
+		return
+	} else if m.limiter != nil && !m.limiter.AcquireUdp(ip) {
+		log.Debug("[mux] limit udp stream from: ", Addr2Str(src))
+		m.stats.add(&m.stats.UdpDropped)
+		s.send(kMuxFin, id, nil)
+		return
+	}
+	backend := OrderBackends(m.cfg.RemoteBackends())[0]
+	target := TargetSockAddr(backend.Addr, backend.Port)
+	fd, err := CreateUdpRemoteSocket(SockAddrFamily(target), m.cfg.RemoteSocketOpts(src))
+	if err == nil {
+		if err = unix.Connect(fd, target); err != nil {
+			CloseSocket(fd)
+		}
+	}
+	if err != nil {
+		log.Warn("[mux] create udp stream to ", Addr2Str(target), " err: ", err)
+		s.send(kMuxFin, id, nil)
+		m.releaseUdp(ip)
+		return
+	}
+	st := s.addStream(id, fd, kind)
+	if st == nil {
+		m.releaseUdp(ip)
+		return
+	}
+	st.srcIP = ip
+	m.stats.add(&m.stats.UdpSessions)
+	m.stats.gauge(&m.stats.UdpActive, 1)
+}
+
+//releaseUdp 归还server端udp流占用的会话配额
+func (m *Mux) releaseUdp(ip net.IP) {
+	if m.limiter != nil {
+		m.limiter.ReleaseUdp(ip)
+	}
+}
+
+func (s *muxSession) addStream(id uint32, fd int, kind int) *muxStream {
+	st := &muxStream{session: s, id: id, fd: fd, kind: kind, sendWindow: kMuxWindowSize, lastActive: time.Now()}
+	if err := s.mux.eventLoop.Register(fd, kPollIn|kPollErr, st); err != nil {
+		log.Warn("[mux] reg stream err: ", err)
+		CloseSocket(fd)
+		return nil
+	}
+	st.mode = kPollIn | kPollErr
+	s.streams[id] = st
+	s.mux.stats.gauge(&s.mux.stats.MuxStreams, 1)
+	st.update()
+	return st
+}
+
+//send 编码一帧并发送, 发不完的部分缓存在 out 中
+func (s *muxSession) send(typ byte, id uint32, payload []byte) {
+	if s.fd == INVALID_SOCKET || s.connecting {
+		return
+	}
+	frame := make([]byte, kMuxHeaderSize, kMuxHeaderSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint16(frame[5:], uint16(len(payload)))
+	frame = append(frame, payload...)
+	if s.codec != nil {
+		if err := s.codec.Encode(frame); err != nil {
+			log.Warn("[mux] encode frame err: ", err)
+			s.close()
+			return
+		}
+		frame = s.codec.Output()
+	}
+	s.lastSend = time.Now()
+	s.write(frame)
+}
+
+func (s *muxSession) write(data []byte) {
+	if len(data) == 0 || s.fd == INVALID_SOCKET {
+		return
+	}
+	if len(s.out) == 0 {
+		n, err := BufferSend(s.fd, &data)
+		if err != nil && err != unix.EAGAIN {
+			log.Warn("[mux] session send err: ", err)
+			s.close()
+			return
+		} else if err == nil {
+			data = data[n:]
+		}
+	}
+	s.out = append(s.out, data...)
+	s.update()
+}
+
+func (s *muxSession) flush() {
+	if len(s.out) != 0 {
+		n, err := BufferSend(s.fd, &s.out)
+		if err != nil && err != unix.EAGAIN {
+			log.Warn("[mux] session send err: ", err)
+			s.close()
+			return
+		} else if err == nil {
+			s.out = s.out[n:]
+		}
+	}
+	if len(s.out) == 0 {
+		s.out = nil
+	}
+	s.drain()
+	s.update()
+}
+
+//sendDatagram 发送一个udp报文: 连接发送缓冲较少且没有排队的报文时直接发送, 否则放入流自己的队列,
+//由 drain 轮流从每个流取一个报文发送, 发送量大的会话队列满时只丢弃自己的报文
+func (s *muxSession) sendDatagram(st *muxStream, pkt []byte) {
+	if len(s.ready) == 0 && len(s.out) < kMuxUdpBacklog {
+		s.send(kMuxData, st.id, pkt)
+		return
+	} else if len(st.queued) >= kMuxUdpQueue {
+		s.mux.stats.add(&s.mux.stats.UdpDropped)
+		return
+	}
+	if len(st.queued) == 0 {
+		s.ready = append(s.ready, st)
+	}
+	st.queued = append(st.queued, pkt)
+}
+
+//drain 发送缓冲降到 kMuxUdpBacklog 以下时按轮询顺序发送排队的udp报文
+func (s *muxSession) drain() {
+	for len(s.ready) != 0 && len(s.out) < kMuxUdpBacklog && s.fd != INVALID_SOCKET {
+		st := s.ready[0]
+		s.ready = s.ready[1:]
+		if st.fd == INVALID_SOCKET || len(st.queued) == 0 {
+			continue
+		}
+		pkt := st.queued[0]
+		st.queued = st.queued[1:]
+		if len(st.queued) != 0 {
+			s.ready = append(s.ready, st)
+		}
+		s.send(kMuxData, st.id, pkt)
+	}
+	if len(s.ready) == 0 {
+		s.ready = nil
+	}
+}
+
+//update 按待发送数据更新epoll事件; 待发送数据过多时暂停所有流的读取, 降到一半以下后恢复
+func (s *muxSession) update() {
+	if s.fd == INVALID_SOCKET {
+		return
+	}
+	mode := kPollIn | kPollErr
+	if len(s.out) != 0 {
+		mode |= kPollOut
+	}
+	if mode != s.mode {
+		s.mode = mode
+		s.mux.eventLoop.Modify(s.fd, mode)
+	}
+	congested := len(s.out) > kMuxMaxPending || (s.congested && len(s.out) > kMuxMaxPending/2)
+	if congested != s.congested {
+		s.congested = congested
+		for _, st := range s.streams {
+			st.update()
+		}
+	}
+}
+
+//tick 检查连接超时和保活, sweep 为true时关闭超过 UdpTimeOut 秒无数据的udp流
+func (s *muxSession) tick(now time.Time, sweep bool) {
+	if s.connecting {
+		if now.After(s.deadline) {
+			log.Warn("[mux] connect timeout")
+			s.close()
+		}
+		return
+	} else if now.Sub(s.lastRecv) > kMuxDeadTimeout {
+		log.Warn("[mux] session with ", Addr2Str(s.peer), " keepalive timeout")
+		s.close()
+		return
+	} else if now.Sub(s.lastSend) >= kMuxKeepalive {
+		var ping [8]byte
+		binary.BigEndian.PutUint64(ping[:], uint64(now.UnixNano()))
+		s.send(kMuxPing, 0, ping[:])
+	}
+	if !sweep {
+		return
+	}
+	timeout := time.Duration(s.mux.cfg.UdpTimeOut) * time.Second
+	for _, st := range s.streams {
+		if st.kind == kMuxStreamUDP && now.Sub(st.lastActive) > timeout {
+			st.close(true)
+		}
+	}
+}
+
+//close 关闭连接和其上的所有流, client 端安排重连
+func (s *muxSession) close() {
+	if s.fd == INVALID_SOCKET {
+		return
+	}
+	for _, st := range s.streams {
+		st.close(false)
+	}
+	if s.codec != nil {
+		s.codec.Close()
+	}
+	s.mux.eventLoop.UnRegister(s.fd)
+	CloseSocket(s.fd)
+	s.fd = INVALID_SOCKET
+	if !s.connecting {
+		s.mux.stats.gauge(&s.mux.stats.MuxSessions, -1)
+		log.Info("[mux] session with ", Addr2Str(s.peer), " closed")
+	}
+	delete(s.mux.sessions, s)
+	if s.slot >= 0 && s.slot < len(s.mux.slots) && s.mux.slots[s.slot].session == s {
+		s.mux.retry(s.slot)
+	}
+}
+
+//muxStream 连接上的一个流: tcp流按窗口流控, 对端确认消费前最多发送 kMuxWindowSize 字节; udp流每帧一个报文, 连接拥塞时在 queued 中排队
+type muxStream struct {
+	session    *muxSession
+	id         uint32
+	fd         int
+	kind       int
+	mode       int
+	detached   bool
+	sendWindow int
+	consumed   int
+	out        []byte
+	queued     [][]byte
+	fin        bool
+	lastActive time.Time
+	//srcIP server 端udp流的客户端地址, 用于限速和配额
+	srcIP net.IP
+}
+
+func (st *muxStream) HandleEvent(fd, ev int) {
+	if Judge(ev & kPollOut) {
+		st.flush()
+	}
+	if Judge(ev&kPollIn) && st.fd != INVALID_SOCKET {
+		st.onRead()
+	} else if ev == 0 && st.fd != INVALID_SOCKET {
+		//未监听读事件时对端关闭只会报告 EPOLLHUP, 暂时移出epoll, 窗口恢复后再读取剩余数据
+		st.session.mux.eventLoop.UnRegister(st.fd)
+		st.detached = true
+	}
+}
+
+func (st *muxStream) readable() bool {
+	if st.kind == kMuxStreamUDP {
+		return true
+	}
+	return st.sendWindow > 0 && !st.session.congested && !st.fin
+}
+
+func (st *muxStream) onRead() {
+	if !st.readable() {
+		return
+	}
+	size := kMuxMaxPayload
+	if st.kind == kMuxStreamTCP && st.sendWindow < size {
+		size = st.sendWindow
+	} else if st.kind == kMuxStreamUDP {
+		size = kBuffSize
+	}
+	buf := make([]byte, size)
+	n, err := BufferRecv(st.fd, &buf)
+	if err == unix.EAGAIN {
+		return
+	} else if st.kind == kMuxStreamUDP && err != nil {
+		//已连接的udp socket会收到ICMP错误, 不影响会话
+		log.Debug("[mux] udp stream read err: ", err)
+		return
+	} else if err != nil || (n <= 0 && (st.kind == kMuxStreamTCP || !st.session.mux.server)) {
+		//tcp流和 client 端的 SOCK_SEQPACKET 读到0表示对端已关闭
+		st.close(true)
+		return
+	}
+	st.lastActive = time.Now()
+	if st.kind == kMuxStreamUDP {
+		if n > 0xffff {
+			st.session.mux.stats.add(&st.session.mux.stats.UdpDropped)
+			return
+		}
+		if st.allow(kStreamDown, n) {
+			st.session.sendDatagram(st, buf[:n])
+		}
+		return
+	}
+	st.sendWindow -= n
+	st.session.send(kMuxData, st.id, buf[:n])
+	st.update()
+}
+
+//onData 对端发来的数据: udp报文直接发送, 无法发送时丢弃; tcp数据按顺序写入, 写入后向对端归还窗口
+func (st *muxStream) onData(data []byte) {
+	st.lastActive = time.Now()
+	if st.kind == kMuxStreamUDP {
+		if !st.allow(kStreamUp, len(data)) {
+			return
+		} else if _, err := BufferSend(st.fd, &data); err != nil {
+			st.session.mux.stats.add(&st.session.mux.stats.UdpDropped)
+		}
+		return
+	}
+	if len(st.out)+len(data) > kMuxWindowSize {
+		log.Warn("[mux] stream ", st.id, " err: ", errMuxWindow)
+		st.close(true)
+		return
+	}
+	st.out = append(st.out, data...)
+	st.flush()
+}
+
+//allow server 端udp报文的配额和限速检查: 配额用尽时关闭流, 令牌不足时丢弃报文
+func (st *muxStream) allow(dir, n int) bool {
+	m := st.session.mux
+	if !m.server {
+		return true
+	} else if m.quota != nil && !m.quota.Allow(st.srcIP) {
+		log.Debug("[mux] quota exceeded, close udp stream from: ", st.srcIP)
+		m.stats.add(&m.stats.UdpDropped)
+		st.close(true)
+		return false
+	}
+	if m.shaper != nil {
+		if m.shaper.Available(rateLimit{}, st.srcIP, dir, 1) <= 0 {
+			m.stats.add(&m.stats.UdpDropped)
+			return false
+		}
+		m.shaper.Consume(rateLimit{}, st.srcIP, dir, n)
+	}
+	if m.quota != nil {
+		m.quota.Add(st.srcIP, dir, n)
+	}
+	return true
+}
+
+//onFin 对端关闭流, 已收到的数据写完后关闭
+func (st *muxStream) onFin() {
+	st.fin = true
+	if len(st.out) == 0 {
+		st.close(false)
+		return
+	}
+	st.update()
+}
+
+func (st *muxStream) flush() {
+	if len(st.out) != 0 {
+		n, err := BufferSend(st.fd, &st.out)
+		if err != nil && err != unix.EAGAIN {
+			st.close(true)
+			return
+		} else if err == nil {
+			st.out, st.consumed = st.out[n:], st.consumed+n
+		}
+	}
+	if st.consumed >= kMuxWindowSize/4 {
+		var inc [4]byte
+		binary.BigEndian.PutUint32(inc[:], uint32(st.consumed))
+		st.session.send(kMuxWindow, st.id, inc[:])
+		st.consumed = 0
+	}
+	if len(st.out) == 0 {
+		st.out = nil
+		if st.fin {
+			st.close(false)
+			return
+		}
+	}
+	st.update()
+}
+
+//update 按窗口、连接拥塞状态和待写数据更新epoll事件
+func (st *muxStream) update() {
+	if st.fd == INVALID_SOCKET {
+		return
+	}
+	mode := kPollErr
+	if st.readable() {
+		mode |= kPollIn
+	}
+	if len(st.out) != 0 {
+		mode |= kPollOut
+	}
+	if st.detached {
+		if !Judge(mode & kPollIn) {
+			return
+		}
+		st.detached = false
+		st.mode = mode
+		st.session.mux.eventLoop.Register(st.fd, mode, st)
+		return
+	}
+	if mode != st.mode {
+		st.mode = mode
+		st.session.mux.eventLoop.Modify(st.fd, mode)
+	}
+}
+
+//close 关闭流, sendFin 为true时通知对端
+func (st *muxStream) close(sendFin bool) {
+	if st.fd == INVALID_SOCKET {
+		return
+	}
+	s, m := st.session, st.session.mux
+	if !st.detached {
+		m.eventLoop.UnRegister(st.fd)
+	}
+	CloseSocket(st.fd)
+	st.fd, st.queued = INVALID_SOCKET, nil
+	delete(s.streams, st.id)
+	m.stats.gauge(&m.stats.MuxStreams, -1)
+	if m.server && st.kind == kMuxStreamUDP {
+		m.stats.gauge(&m.stats.UdpActive, -1)
+		m.releaseUdp(st.srcIP)
+	}
+	if sendFin {
+		s.send(kMuxFin, st.id, nil)
+	}
+}
@@ -0,0 +1,611 @@
+package fdd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rocinan/fdd/poller"
+	"golang.org/x/sys/unix"
+)
+
+//onLoop 在eventLoop线程中执行fn并等待其返回
+func onLoop(ep *poller.EventLoop, fn func()) {
+	done := make(chan struct{})
+	ep.Post(func() {
+		fn()
+		close(done)
+	})
+	<-done
+}
+
+//fdConn 把fd包装成 net.Conn, 原fd随之关闭
+func fdConn(t *testing.T, fd int) net.Conn {
+	f := os.NewFile(uintptr(fd), "mux-test")
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+//newTestMuxClient 创建 client 端 Mux, 其唯一的连接是 socketpair 的一端, 返回测试中扮演 server 端的另一端
+func newTestMuxClient(t *testing.T) (*Mux, *poller.EventLoop, net.Conn) {
+	cfg := NewConfig("127.0.0.1", "127.0.0.1", 0, 1, 1024, 60)
+	m, err := NewMux(MuxClient, 1, &cfg, new(Stats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := poller.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//不注册ticker, 避免按配置去连接目标
+	m.eventLoop = ep
+	go ep.Run()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetNoBlock(fds[0])
+	onLoop(ep, func() {
+		s := &muxSession{mux: m, fd: fds[0], slot: 0, streams: make(map[uint32]*muxStream)}
+		m.slots[0].session, m.sessions[s] = s, struct{}{}
+		if err = ep.Register(fds[0], kPollIn|kPollErr, s); err == nil {
+			s.mode = kPollIn | kPollErr
+			s.established()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { onLoop(ep, m.Close) })
+	return m, ep, fdConn(t, fds[1])
+}
+
+//openStream 在 client 端打开一个tcp流, 返回应用侧连接和对端收到的 kMuxSyn 数据
+func openStream(t *testing.T, m *Mux, ep *poller.EventLoop, raw net.Conn, src, dst unix.Sockaddr) (net.Conn, uint32, []byte) {
+	var fd int
+	var err error
+	onLoop(ep, func() { fd, err = m.Open(kMuxStreamTCP, src, dst) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	typ, id, payload := readFrame(t, raw)
+	if typ != kMuxSyn {
+		t.Fatalf("got frame type %d, want syn", typ)
+	}
+	return fdConn(t, fd), id, payload
+}
+
+func writeFrame(t *testing.T, raw net.Conn, typ byte, id uint32, payload []byte) {
+	frame := make([]byte, kMuxHeaderSize, kMuxHeaderSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint16(frame[5:], uint16(len(payload)))
+	raw.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := raw.Write(append(frame, payload...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFrame(t *testing.T, raw net.Conn) (byte, uint32, []byte) {
+	typ, id, payload, err := readFrameTimeout(raw, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return typ, id, payload
+}
+
+func readFrameTimeout(raw net.Conn, timeout time.Duration) (byte, uint32, []byte, error) {
+	raw.SetReadDeadline(time.Now().Add(timeout))
+	header := make([]byte, kMuxHeaderSize)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		return 0, 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[5:]))
+	if _, err := io.ReadFull(raw, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return header[0], binary.BigEndian.Uint32(header[1:]), payload, nil
+}
+
+//readData 读取流 id 的数据帧直到 timeout 内没有新帧, 返回数据总长度, 跳过窗口更新
+func readData(t *testing.T, raw net.Conn, id uint32, timeout time.Duration) int {
+	total := 0
+	for {
+		typ, fid, payload, err := readFrameTimeout(raw, timeout)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return total
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if typ == kMuxData && fid == id {
+			total += len(payload)
+		} else if typ != kMuxWindow {
+			t.Fatalf("unexpected frame type %d for stream %d", typ, fid)
+		}
+	}
+}
+
+func TestMuxSynPayload(t *testing.T) {
+	src4, dst4 := SockAddrParse("10.0.0.1", 1234), SockAddrParse("10.0.0.2", 80)
+	src6 := SockAddrParse("2001:db8::1", 1234)
+	full := muxSynPayload(kMuxStreamTCP, src4, dst4)
+	domain, _ := AppendSocksAddr([]byte{kMuxStreamTCP}, "example.com", 80)
+	domain = appendSocksIP(domain, nil, 0)
+	tests := []struct {
+		name     string
+		in       []byte
+		kind     int
+		src, dst unix.Sockaddr
+		err      error
+	}{
+		{"kind only", []byte{kMuxStreamUDP}, kMuxStreamUDP, nil, nil, nil},
+		{"src and dst", full, kMuxStreamTCP, src4, dst4, nil},
+		{"no dst", muxSynPayload(kMuxStreamUDP, src6, nil), kMuxStreamUDP, src6, nil, nil},
+		{"unix client", muxSynPayload(kMuxStreamTCP, &unix.SockaddrUnix{Name: "/tmp/x"}, dst4), kMuxStreamTCP, nil, nil, nil},
+		{"empty", nil, 0, nil, nil, errMuxProtocol},
+		{"truncated", full[:len(full)-1], 0, nil, nil, errMuxProtocol},
+		{"trailing", append(append([]byte(nil), full...), 0), 0, nil, nil, errMuxProtocol},
+		{"domain", domain, 0, nil, nil, errMuxProtocol},
+		{"zero src", muxSynPayload(kMuxStreamTCP, SockAddrParse("10.0.0.1", 0), dst4), 0, nil, nil, errMuxProtocol},
+	}
+	for _, tt := range tests {
+		kind, src, dst, err := parseMuxSyn(tt.in)
+		if err != tt.err {
+			t.Errorf("%s: err %v, want %v", tt.name, err, tt.err)
+		} else if kind != tt.kind || Addr2Str(src) != Addr2Str(tt.src) || Addr2Str(dst) != Addr2Str(tt.dst) {
+			t.Errorf("%s: got %d %s -> %s", tt.name, kind, Addr2Str(src), Addr2Str(dst))
+		}
+	}
+}
+
+func TestMuxFraming(t *testing.T) {
+	m, ep, raw := newTestMuxClient(t)
+	defer raw.Close()
+	src, dst := SockAddrParse("10.0.0.1", 1234), SockAddrParse("10.0.0.2", 80)
+	app, id, syn := openStream(t, m, ep, raw, src, dst)
+	defer app.Close()
+	if _, psrc, pdst, err := parseMuxSyn(syn); err != nil || Addr2Str(psrc) != Addr2Str(src) || Addr2Str(pdst) != Addr2Str(dst) {
+		t.Fatalf("syn carries %s -> %s, err %v", Addr2Str(psrc), Addr2Str(pdst), err)
+	}
+
+	app.Write([]byte("hello"))
+	if typ, fid, payload := readFrame(t, raw); typ != kMuxData || fid != id || string(payload) != "hello" {
+		t.Fatalf("got frame %d/%d %q", typ, fid, payload)
+	}
+	writeFrame(t, raw, kMuxData, id, []byte("world"))
+	buf := make([]byte, 16)
+	app.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := app.Read(buf); err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("stream read %q %v", buf[:n], err)
+	}
+	//发给不存在的流的数据被忽略
+	writeFrame(t, raw, kMuxData, id+100, []byte("lost"))
+	writeFrame(t, raw, kMuxPing, 0, []byte("12345678"))
+	if typ, _, payload := readFrame(t, raw); typ != kMuxPong || string(payload) != "12345678" {
+		t.Fatalf("got frame %d %q, want pong", typ, payload)
+	}
+
+	//未知帧类型关闭整条连接和其上的流
+	writeFrame(t, raw, 0xff, 0, nil)
+	if _, _, _, err := readFrameTimeout(raw, 2*time.Second); err != io.EOF {
+		t.Fatalf("session read after protocol error: %v", err)
+	}
+	app.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := app.Read(buf); err != io.EOF {
+		t.Fatalf("stream read after protocol error: %v", err)
+	}
+}
+
+func TestMuxWindow(t *testing.T) {
+	m, ep, raw := newTestMuxClient(t)
+	defer raw.Close()
+	app, id, _ := openStream(t, m, ep, raw, nil, nil)
+	defer app.Close()
+
+	//发送方向: 对端未归还窗口前最多收到 kMuxWindowSize 字节
+	extra := kMuxWindowSize / 4
+	go app.Write(make([]byte, kMuxWindowSize+extra))
+	if n := readData(t, raw, id, 300*time.Millisecond); n != kMuxWindowSize {
+		t.Fatalf("received %d bytes before window update, want %d", n, kMuxWindowSize)
+	}
+	var inc [4]byte
+	binary.BigEndian.PutUint32(inc[:], uint32(extra))
+	writeFrame(t, raw, kMuxWindow, id, inc[:])
+	if n := readData(t, raw, id, 300*time.Millisecond); n != extra {
+		t.Fatalf("received %d bytes after window update, want %d", n, extra)
+	}
+
+	//接收方向: 应用读取后归还窗口
+	chunk := bytes.Repeat([]byte("x"), kMuxMaxPayload)
+	for sent := 0; sent < kMuxWindowSize/2; sent += len(chunk) {
+		writeFrame(t, raw, kMuxData, id, chunk)
+	}
+	if _, err := io.ReadFull(app, make([]byte, kMuxWindowSize/2)); err != nil {
+		t.Fatal(err)
+	}
+	returned := 0
+	for returned < kMuxWindowSize/2 {
+		typ, fid, payload := readFrame(t, raw)
+		if typ != kMuxWindow || fid != id {
+			t.Fatalf("got frame %d/%d, want window update", typ, fid)
+		}
+		returned += int(binary.BigEndian.Uint32(payload))
+	}
+	if returned != kMuxWindowSize/2 {
+		t.Fatalf("window returned %d, want %d", returned, kMuxWindowSize/2)
+	}
+}
+
+func TestMuxWindowExceeded(t *testing.T) {
+	m, ep, raw := newTestMuxClient(t)
+	defer raw.Close()
+	app, id, _ := openStream(t, m, ep, raw, nil, nil)
+	defer app.Close()
+	//应用不读取, 对端无视窗口持续发送, 超出后流被关闭并通知对端
+	frame := make([]byte, kMuxHeaderSize+kMuxMaxPayload)
+	frame[0] = kMuxData
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint16(frame[5:], kMuxMaxPayload)
+	go func() {
+		//测试结束关闭连接后写入失败即退出
+		for i := 0; i < 8*kMuxWindowSize/kMuxMaxPayload; i++ {
+			if _, err := raw.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		typ, fid, _ := readFrame(t, raw)
+		if typ == kMuxFin && fid == id {
+			break
+		} else if typ != kMuxWindow {
+			t.Fatalf("got frame %d/%d, want fin", typ, fid)
+		}
+	}
+	onLoop(ep, func() {
+		if s := m.slots[0].session; s == nil || len(s.streams) != 0 {
+			t.Error("session closed or stream still open")
+		}
+	})
+}
+
+func TestMuxStreamClose(t *testing.T) {
+	m, ep, raw := newTestMuxClient(t)
+	defer raw.Close()
+
+	//本地关闭: 通知对端
+	app, id, _ := openStream(t, m, ep, raw, nil, nil)
+	app.Close()
+	if typ, fid, _ := readFrame(t, raw); typ != kMuxFin || fid != id {
+		t.Fatalf("got frame %d/%d, want fin", typ, fid)
+	}
+
+	//对端关闭: 已收到的数据写完后关闭
+	app, id, _ = openStream(t, m, ep, raw, nil, nil)
+	defer app.Close()
+	writeFrame(t, raw, kMuxData, id, []byte("bye"))
+	writeFrame(t, raw, kMuxFin, id, nil)
+	app.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if data, err := io.ReadAll(app); err != nil || string(data) != "bye" {
+		t.Fatalf("stream read %q %v", data, err)
+	}
+	onLoop(ep, func() {
+		if n := len(m.slots[0].session.streams); n != 0 {
+			t.Errorf("%d streams left", n)
+		}
+	})
+}
+
+//TestMuxServerSource server 端以流携带的客户端地址连接目标, 对端不可信时使用对端地址
+func TestMuxServerSource(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	headers := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			headers <- line
+			conn.Close()
+		}
+	}()
+
+	cfg := NewConfig("127.0.0.1", "127.0.0.1", 0, ln.Addr().(*net.TCPAddr).Port, 1024, 60)
+	cfg.ProxyProtocol, cfg.Mux = 1, MuxServer
+	stats := new(Stats)
+	m, err := NewMux(MuxServer, 0, &cfg, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := NewTCPRelay(&cfg, stats, NewLimiter(&cfg, stats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.mux, m.tcp = m, relay
+	ep, err := poller.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.AddToLoop(ep)
+	m.AddToLoop(ep)
+	go ep.Run()
+	defer onLoop(ep, func() {
+		m.Close()
+		relay.Close()
+	})
+
+	//mux连接使用tcp, 不可信时PROXY头中为对端和本端的地址
+	peerLn, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerLn.Close()
+	raw, err := net.Dial("tcp4", peerLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	conn, err := peerLn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := conn.(*net.TCPConn).File()
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, _ := unix.Dup(int(f.Fd()))
+	f.Close()
+	SetNoBlock(fd)
+	peer := raw.LocalAddr().(*net.TCPAddr)
+	onLoop(ep, func() { m.Accept(fd, SockAddrParse(peer.IP.String(), peer.Port)) })
+
+	src, dst := SockAddrParse("203.0.113.7", 4242), SockAddrParse("198.51.100.1", 443)
+	tests := []struct {
+		name    string
+		trusted []string
+		want    string
+	}{
+		{"trusted", nil, "PROXY TCP4 203.0.113.7 198.51.100.1 4242 443\r\n"},
+		{"trusted cidr", []string{"127.0.0.0/8"}, "PROXY TCP4 203.0.113.7 198.51.100.1 4242 443\r\n"},
+		{"untrusted", []string{"10.0.0.0/8"}, fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %d\r\n", peer.Port, peerLn.Addr().(*net.TCPAddr).Port)},
+	}
+	for i, tt := range tests {
+		nets, _ := ParseCIDRs(tt.trusted)
+		onLoop(ep, func() { m.trusted = nets })
+		writeFrame(t, raw, kMuxSyn, uint32(i+1), muxSynPayload(kMuxStreamTCP, src, dst))
+		select {
+		case header := <-headers:
+			if header != tt.want {
+				t.Errorf("%s: backend got %q, want %q", tt.name, header, tt.want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: backend not connected", tt.name)
+		}
+	}
+}
+
+//openUdpStreams 在 client 端打开 n 个udp流, 返回其在连接上的流
+func openUdpStreams(t *testing.T, m *Mux, ep *poller.EventLoop, raw net.Conn, n int) []*muxStream {
+	var streams []*muxStream
+	for i := 0; i < n; i++ {
+		var err error
+		onLoop(ep, func() { _, err = m.Open(kMuxStreamUDP, nil, nil) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		typ, id, _ := readFrame(t, raw)
+		if typ != kMuxSyn {
+			t.Fatalf("got frame type %d, want syn", typ)
+		}
+		onLoop(ep, func() { streams = append(streams, m.slots[0].session.streams[id]) })
+	}
+	return streams
+}
+
+//congest 在eventLoop中模拟连接发送缓冲超过 kMuxUdpBacklog, 执行fn后恢复并发送排队的报文
+func congest(t *testing.T, m *Mux, ep *poller.EventLoop, fn func(s *muxSession)) {
+	onLoop(ep, func() {
+		s := m.slots[0].session
+		if len(s.out) != 0 {
+			t.Errorf("%d bytes pending before test", len(s.out))
+		}
+		s.out = make([]byte, kMuxUdpBacklog)
+		fn(s)
+		s.out = nil
+		s.drain()
+	})
+}
+
+//TestMuxUdpFairness 连接拥塞时各udp流的报文轮流发送, 各流内保持顺序
+func TestMuxUdpFairness(t *testing.T) {
+	m, ep, raw := newTestMuxClient(t)
+	defer raw.Close()
+	st := openUdpStreams(t, m, ep, raw, 2)
+	a, b := st[0], st[1]
+	congest(t, m, ep, func(s *muxSession) {
+		for i := 0; i < 4; i++ {
+			s.sendDatagram(a, []byte{'a', byte('0' + i)})
+		}
+		s.sendDatagram(b, []byte("b0"))
+		s.sendDatagram(b, []byte("b1"))
+	})
+	want := []struct {
+		id   uint32
+		data string
+	}{{a.id, "a0"}, {b.id, "b0"}, {a.id, "a1"}, {b.id, "b1"}, {a.id, "a2"}, {a.id, "a3"}}
+	for i, w := range want {
+		if typ, id, payload := readFrame(t, raw); typ != kMuxData || id != w.id || string(payload) != w.data {
+			t.Fatalf("frame %d: got %d/%d %q, want %d %q", i, typ, id, payload, w.id, w.data)
+		}
+	}
+}
+
+//TestMuxUdpQueueDrop 流的队列满 kMuxUdpQueue 后只丢弃该流的报文
+func TestMuxUdpQueueDrop(t *testing.T) {
+	m, ep, raw := newTestMuxClient(t)
+	defer raw.Close()
+	st := openUdpStreams(t, m, ep, raw, 2)
+	a, b := st[0], st[1]
+	congest(t, m, ep, func(s *muxSession) {
+		for i := 0; i < kMuxUdpQueue+3; i++ {
+			s.sendDatagram(a, []byte("a"))
+		}
+		s.sendDatagram(b, []byte("b"))
+		if len(a.queued) != kMuxUdpQueue || len(b.queued) != 1 {
+			t.Errorf("queued a=%d b=%d, want %d 1", len(a.queued), len(b.queued), kMuxUdpQueue)
+		}
+		if dropped := atomic.LoadUint64(&m.stats.UdpDropped); dropped != 3 {
+			t.Errorf("dropped %d, want 3", dropped)
+		}
+	})
+	counts := make(map[uint32]int)
+	for i := 0; i < kMuxUdpQueue+1; i++ {
+		typ, id, _ := readFrame(t, raw)
+		if typ != kMuxData {
+			t.Fatalf("got frame type %d, want data", typ)
+		} else if i == 1 && id != b.id {
+			t.Fatalf("second frame from stream %d, want %d", id, b.id)
+		}
+		counts[id]++
+	}
+	if counts[a.id] != kMuxUdpQueue || counts[b.id] != 1 {
+		t.Fatalf("sent a=%d b=%d", counts[a.id], counts[b.id])
+	}
+}
+
+//newTestMuxServer 创建 server 端 Mux 并接受一条 socketpair 连接, 返回测试中扮演 client 端的另一端; 不注册ticker, 由测试调用 tick
+func newTestMuxServer(t *testing.T, cfg *Config, stats *Stats) (*Mux, *poller.EventLoop, net.Conn) {
+	m, err := NewMux(MuxServer, 0, cfg, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := poller.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.eventLoop = ep
+	go ep.Run()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetNoBlock(fds[0])
+	onLoop(ep, func() { m.Accept(fds[0], SockAddrParse("127.0.0.1", 40000)) })
+	t.Cleanup(func() { onLoop(ep, m.Close) })
+	return m, ep, fdConn(t, fds[1])
+}
+
+//newUdpTarget 创建udp目标, 返回配置好目标端口的配置
+func newUdpTarget(t *testing.T) (net.PacketConn, *Config) {
+	target, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+	cfg := NewConfig("127.0.0.1", "127.0.0.1", 0, target.LocalAddr().(*net.UDPAddr).Port, 1024, 60)
+	return target, &cfg
+}
+
+//expectRelayed 经流 id 发送一个报文, 确认目标收到
+func expectRelayed(t *testing.T, raw net.Conn, target net.PacketConn, id uint32) {
+	msg := fmt.Sprintf("stream %d", id)
+	writeFrame(t, raw, kMuxData, id, []byte(msg))
+	buf := make([]byte, 64)
+	target.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, _, err := target.ReadFrom(buf); err != nil || string(buf[:n]) != msg {
+		t.Fatalf("target got %q %v, want %q", buf[:n], err, msg)
+	}
+}
+
+//TestMuxServerUdpOnly udp over tcp 服务端拒绝tcp流, udp流按访问控制检查
+func TestMuxServerUdpOnly(t *testing.T) {
+	target, cfg := newUdpTarget(t)
+	m, ep, raw := newTestMuxServer(t, cfg, new(Stats))
+	defer raw.Close()
+	acl, err := NewACL(nil, []string{"203.0.113.0/24"}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	onLoop(ep, func() { m.udpOnly, m.acl = true, acl })
+	allowed, denied := SockAddrParse("198.51.100.7", 1000), SockAddrParse("203.0.113.7", 1000)
+	tests := []struct {
+		name string
+		kind int
+		src  unix.Sockaddr
+	}{
+		{"tcp stream", kMuxStreamTCP, allowed},
+		{"denied udp stream", kMuxStreamUDP, denied},
+	}
+	for i, tt := range tests {
+		id := uint32(i + 1)
+		writeFrame(t, raw, kMuxSyn, id, muxSynPayload(tt.kind, tt.src, nil))
+		if typ, fid, _ := readFrame(t, raw); typ != kMuxFin || fid != id {
+			t.Fatalf("%s: got frame %d/%d, want fin", tt.name, typ, fid)
+		}
+	}
+	writeFrame(t, raw, kMuxSyn, 10, muxSynPayload(kMuxStreamUDP, allowed, nil))
+	expectRelayed(t, raw, target, 10)
+}
+
+//TestMuxServerUdpExpiry tick 关闭空闲的udp流并归还限流配额, 活跃的流不受影响
+func TestMuxServerUdpExpiry(t *testing.T) {
+	target, cfg := newUdpTarget(t)
+	cfg.UdpTimeOut, cfg.MaxUdpPerIP = 1, 1
+	stats := new(Stats)
+	m, ep, raw := newTestMuxServer(t, cfg, stats)
+	defer raw.Close()
+	onLoop(ep, func() { m.limiter = NewLimiter(cfg, stats) })
+	src1, src2 := SockAddrParse("203.0.113.7", 1000), SockAddrParse("203.0.113.8", 1000)
+
+	writeFrame(t, raw, kMuxSyn, 1, muxSynPayload(kMuxStreamUDP, src1, nil))
+	expectRelayed(t, raw, target, 1)
+	//同一客户端超过 MaxUdpPerIP
+	writeFrame(t, raw, kMuxSyn, 2, muxSynPayload(kMuxStreamUDP, src1, nil))
+	if typ, id, _ := readFrame(t, raw); typ != kMuxFin || id != 2 {
+		t.Fatalf("got frame %d/%d, want fin for stream 2", typ, id)
+	}
+	writeFrame(t, raw, kMuxSyn, 3, muxSynPayload(kMuxStreamUDP, src2, nil))
+	expectRelayed(t, raw, target, 3)
+
+	onLoop(ep, func() {
+		for s := range m.sessions {
+			s.streams[1].lastActive = time.Now().Add(-2 * time.Second)
+			s.tick(time.Now(), true)
+		}
+	})
+	if typ, id, _ := readFrame(t, raw); typ != kMuxFin || id != 1 {
+		t.Fatalf("got frame %d/%d, want fin for idle stream 1", typ, id)
+	}
+	onLoop(ep, func() {
+		for s := range m.sessions {
+			if _, ok := s.streams[3]; !ok || len(s.streams) != 1 {
+				t.Errorf("streams left %d, active stream 3 open %v", len(s.streams), ok)
+			}
+		}
+	})
+	if active := atomic.LoadInt64(&stats.UdpActive); active != 1 {
+		t.Fatalf("udp active %d, want 1", active)
+	}
+	//过期的流归还了配额, 同一客户端可以再次打开
+	writeFrame(t, raw, kMuxSyn, 4, muxSynPayload(kMuxStreamUDP, src1, nil))
+	expectRelayed(t, raw, target, 4)
+}
@@ -5,6 +5,7 @@ package poller
 import (
 	"errors"
 	"log"
+	"sync"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -15,7 +16,13 @@ type EventLoop struct {
 	isStop   bool
 	handler  map[int]ISockNotify
 	sockMode map[int]int
+	tickers  []ITickNotify
+	lastTick time.Time
 	waitDone chan struct{}
+
+	wakeFd int
+	postMu sync.Mutex
+	posted []func()
 }
 
 //Create 创建Poller
@@ -24,13 +31,54 @@ func Create() (*EventLoop, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &EventLoop{
+	wfd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	e := &EventLoop{
 		fd:       fd,
 		isStop:   false,
 		handler:  make(map[int]ISockNotify, kEpollSize),
 		sockMode: make(map[int]int, kEpollSize),
 		waitDone: make(chan struct{}),
-	}, nil
+		wakeFd:   wfd,
+	}
+	if err := e.Register(wfd, kPollIn, wakeNotify{e}); err != nil {
+		unix.Close(wfd)
+		unix.Close(fd)
+		return nil, err
+	}
+	return e, nil
+}
+
+type wakeNotify struct {
+	e *EventLoop
+}
+
+func (w wakeNotify) HandleEvent(fd, event int) {
+	var buf [8]byte
+	unix.Read(fd, buf[:])
+	w.e.runPosted()
+}
+
+//Post 从其他goroutine投递回调, 在eventLoop线程中执行
+func (e *EventLoop) Post(fn func()) {
+	e.postMu.Lock()
+	e.posted = append(e.posted, fn)
+	e.postMu.Unlock()
+	one := [8]byte{1}
+	unix.Write(e.wakeFd, one[:])
+}
+
+func (e *EventLoop) runPosted() {
+	e.postMu.Lock()
+	fns := e.posted
+	e.posted = nil
+	e.postMu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
 }
 
 //Register 注册事件
@@ -77,11 +125,28 @@ func (e *EventLoop) Modify(s int, mode int) error {
 	return unix.EpollCtl(e.fd, unix.EPOLL_CTL_MOD, s, ev)
 }
 
+//AddTicker 注册定时回调, 需在Run之前调用
+func (e *EventLoop) AddTicker(obj ITickNotify) {
+	e.tickers = append(e.tickers, obj)
+}
+
+func (e *EventLoop) tick() {
+	now := time.Now()
+	if now.Sub(e.lastTick) < kTickInterval {
+		return
+	}
+	e.lastTick = now
+	for _, obj := range e.tickers {
+		obj.HandleTick(now)
+	}
+}
+
 //Run 启动epoll循环
 func (e *EventLoop) Run() {
 	defer close(e.waitDone)
 	events, timeout := make([]unix.EpollEvent, kEpollSize), 0
 	for !e.isStop {
+		e.tick()
 		nfds, err := unix.EpollWait(e.fd, events, timeout)
 		if err != nil && err == unix.EINTR {
 			continue
@@ -91,7 +156,7 @@ func (e *EventLoop) Run() {
 			return
 		}
 		if nfds == 0 {
-			timeout = 1000
+			timeout = int(kTickInterval / time.Millisecond)
 			continue
 		}
 		timeout = 0
@@ -117,6 +182,7 @@ func (e *EventLoop) Close() error {
 	e.isStop = true
 	select {
 	case <-e.waitDone:
+		_ = unix.Close(e.wakeFd)
 		_ = unix.Close(e.fd)
 		return nil
 	case <-time.After(time.Second * 15):
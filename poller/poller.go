@@ -1,8 +1,11 @@
 package poller
 
+import "time"
+
 const (
 	kEpollSize    = 1024
 	kMaxEpollSize = 102400
+	kTickInterval = 100 * time.Millisecond
 )
 
 const (
@@ -20,6 +23,11 @@ type ISockNotify interface {
 	HandleEvent(fd, event int)
 }
 
+//ITickNotify 定时回调, 在eventLoop线程中约每 kTickInterval 调用一次
+type ITickNotify interface {
+	HandleTick(now time.Time)
+}
+
 func Judge(v int) bool {
 	return v != 0
 }
@@ -0,0 +1,172 @@
+package fdd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var kProxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	kProxyV2Local = 0x20
+	kProxyV2Proxy = 0x21
+	kProxyV2Inet  = 0x10
+	kProxyV2Inet6 = 0x20
+	kProxyV2Unix  = 0x30
+	kProxyV2Strm  = 0x01
+	kProxyV2Dgram = 0x02
+)
+
+//BuildProxyHeaderV1 生成PROXY protocol v1文本头, 两端地址族不同时统一为ipv6
+func BuildProxyHeaderV1(src, dst unix.Sockaddr) []byte {
+	srcIP, dstIP := SockAddrIP(src), SockAddrIP(dst)
+	if srcIP == nil || dstIP == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto := "TCP4"
+	if srcIP.To4() == nil || dstIP.To4() == nil {
+		proto = "TCP6"
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	} else {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	}
+	return []byte("PROXY " + proto + " " + ipString(srcIP) + " " + ipString(dstIP) + " " +
+		strconv.Itoa(SockAddrPort(src)) + " " + strconv.Itoa(SockAddrPort(dst)) + "\r\n")
+}
+
+//BuildProxyHeaderV2 生成PROXY protocol v2二进制头, dgram为true时协议标记为udp
+func BuildProxyHeaderV2(src, dst unix.Sockaddr, dgram bool) []byte {
+	header := append(make([]byte, 0, 16+36), kProxyV2Sig...)
+	srcIP, dstIP := SockAddrIP(src), SockAddrIP(dst)
+	if srcIP == nil || dstIP == nil {
+		return append(header, kProxyV2Local, 0, 0, 0)
+	}
+	transport := byte(kProxyV2Strm)
+	if dgram {
+		transport = kProxyV2Dgram
+	}
+	var addrs []byte
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		header = append(header, kProxyV2Proxy, kProxyV2Inet|transport)
+		addrs = append(append(addrs, srcIP.To4()...), dstIP.To4()...)
+	} else {
+		header = append(header, kProxyV2Proxy, kProxyV2Inet6|transport)
+		addrs = append(append(addrs, srcIP.To16()...), dstIP.To16()...)
+	}
+	addrs = appendUint16(addrs, uint16(SockAddrPort(src)))
+	addrs = appendUint16(addrs, uint16(SockAddrPort(dst)))
+	header = appendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+//BuildProxyHeader 按版本生成PROXY protocol头
+func BuildProxyHeader(version int, src, dst unix.Sockaddr, dgram bool) []byte {
+	if version == 1 {
+		return BuildProxyHeaderV1(src, dst)
+	}
+	return BuildProxyHeaderV2(src, dst, dgram)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+//ipString ipv4映射的ipv6地址也按ipv6格式输出
+func ipString(ip net.IP) string {
+	if len(ip) == net.IPv6len && ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
+
+var (
+	errProxyNeedMore = errors.New("proxy protocol: need more data")
+	errProxyInvalid  = errors.New("proxy protocol: invalid header")
+	kProxyV1Prefix   = []byte("PROXY ")
+)
+
+const kProxyV1MaxLen = 107
+
+//ParseProxyHeader 增量解析PROXY protocol v1/v2头, 数据不足时返回 errProxyNeedMore,
+//不是PROXY头时 consumed 为0且无错误, LOCAL/UNKNOWN 命令返回的地址为nil
+func ParseProxyHeader(buf []byte) (src, dst unix.Sockaddr, consumed int, err error) {
+	if n := minInt(len(buf), len(kProxyV2Sig)); bytes.Equal(buf[:n], kProxyV2Sig[:n]) {
+		if len(buf) < 16 {
+			return nil, nil, 0, errProxyNeedMore
+		}
+		return parseProxyV2(buf)
+	}
+	if n := minInt(len(buf), len(kProxyV1Prefix)); bytes.Equal(buf[:n], kProxyV1Prefix[:n]) {
+		return parseProxyV1(buf)
+	}
+	return nil, nil, 0, nil
+}
+
+func parseProxyV1(buf []byte) (src, dst unix.Sockaddr, consumed int, err error) {
+	end := bytes.Index(buf, []byte("\r\n"))
+	if end < 0 {
+		if len(buf) >= kProxyV1MaxLen {
+			return nil, nil, 0, errProxyInvalid
+		}
+		return nil, nil, 0, errProxyNeedMore
+	}
+	fields := strings.Fields(string(buf[:end]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, end + 2, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, 0, errProxyInvalid
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.Atoi(fields[4])
+	dstPort, err2 := strconv.Atoi(fields[5])
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, 0, errProxyInvalid
+	}
+	return SockAddrParse(srcIP.String(), srcPort), SockAddrParse(dstIP.String(), dstPort), end + 2, nil
+}
+
+//parseProxyV2 解析v2头, 地址之后的TLV一并跳过
+func parseProxyV2(buf []byte) (src, dst unix.Sockaddr, consumed int, err error) {
+	if len(buf) < 16 {
+		return nil, nil, 0, errProxyNeedMore
+	} else if buf[12]>>4 != 2 {
+		return nil, nil, 0, errProxyInvalid
+	}
+	total := 16 + int(binary.BigEndian.Uint16(buf[14:16]))
+	if len(buf) < total {
+		return nil, nil, 0, errProxyNeedMore
+	}
+	if buf[12] == kProxyV2Local {
+		return nil, nil, total, nil
+	}
+	addrs := buf[16:total]
+	switch buf[13] >> 4 {
+	case kProxyV2Inet >> 4:
+		if len(addrs) < 12 {
+			return nil, nil, 0, errProxyInvalid
+		}
+		srcPort, dstPort := int(addrs[8])<<8|int(addrs[9]), int(addrs[10])<<8|int(addrs[11])
+		return SockAddrParse(net.IP(addrs[0:4]).String(), srcPort), SockAddrParse(net.IP(addrs[4:8]).String(), dstPort), total, nil
+	case kProxyV2Inet6 >> 4:
+		if len(addrs) < 36 {
+			return nil, nil, 0, errProxyInvalid
+		}
+		srcPort, dstPort := int(addrs[32])<<8|int(addrs[33]), int(addrs[34])<<8|int(addrs[35])
+		return SockAddrParse(net.IP(addrs[0:16]).String(), srcPort), SockAddrParse(net.IP(addrs[16:32]).String(), dstPort), total, nil
+	}
+	return nil, nil, total, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,69 @@
+package fdd
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseProxyHeader(t *testing.T) {
+	src4, dst4 := SockAddrParse("10.0.0.1", 1234), SockAddrParse("10.0.0.2", 80)
+	src6, dst6 := SockAddrParse("2001:db8::1", 1234), SockAddrParse("2001:db8::2", 443)
+	v2 := BuildProxyHeaderV2(src4, dst4, false)
+	v2tlv := append([]byte(nil), v2...)
+	//追加一个8字节的TLV(PP2_TYPE_AUTHORITY "a.b.c"), 长度字段同步增加
+	v2tlv[15] += 8
+	v2tlv = append(v2tlv, 0x02, 0x00, 0x05, 'a', '.', 'b', '.', 'c')
+	//长度字段大于255, 检查高字节参与计算: 12字节地址 + 3字节TLV头 + 300字节值
+	v2big := append([]byte(nil), v2...)
+	binary.BigEndian.PutUint16(v2big[14:], 12+303)
+	v2big = append(v2big, 0x04, 0x01, 0x2C)
+	v2big = append(v2big, make([]byte, 300)...)
+	local := append(append([]byte(nil), kProxyV2Sig...), kProxyV2Local, 0, 0, 0)
+	badVer := append([]byte(nil), v2...)
+	badVer[12] = 0x11
+	tests := []struct {
+		name     string
+		in       []byte
+		src, dst unix.Sockaddr
+		consumed int
+		err      error
+	}{
+		{"not proxy", []byte("GET / HTTP/1.1\r\n"), nil, nil, 0, nil},
+		{"v1 tcp4", []byte("PROXY TCP4 10.0.0.1 10.0.0.2 1234 80\r\nGET"), src4, dst4, 38, nil},
+		{"v1 tcp6", BuildProxyHeaderV1(src6, dst6), src6, dst6, len(BuildProxyHeaderV1(src6, dst6)), nil},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), nil, nil, 15, nil},
+		{"v1 partial", []byte("PROXY TCP4 10.0.0.1"), nil, nil, 0, errProxyNeedMore},
+		{"v1 prefix", []byte("PRO"), nil, nil, 0, errProxyNeedMore},
+		{"v1 bad port", []byte("PROXY TCP4 10.0.0.1 10.0.0.2 x 80\r\n"), nil, nil, 0, errProxyInvalid},
+		{"v1 too long", append([]byte("PROXY "), make([]byte, kProxyV1MaxLen)...), nil, nil, 0, errProxyInvalid},
+		{"v2 inet", append(v2, 'x'), src4, dst4, len(v2), nil},
+		{"v2 inet6", BuildProxyHeaderV2(src6, dst6, true), src6, dst6, len(BuildProxyHeaderV2(src6, dst6, true)), nil},
+		{"v2 tlv", v2tlv, src4, dst4, len(v2tlv), nil},
+		{"v2 long tlv", append(v2big, 'x'), src4, dst4, len(v2big), nil},
+		{"v2 local", local, nil, nil, 16, nil},
+		{"v2 sig only", kProxyV2Sig[:8], nil, nil, 0, errProxyNeedMore},
+		{"v2 truncated header", v2[:14], nil, nil, 0, errProxyNeedMore},
+		{"v2 truncated addrs", v2[:20], nil, nil, 0, errProxyNeedMore},
+		{"v2 truncated tlv", v2tlv[:len(v2tlv)-1], nil, nil, 0, errProxyNeedMore},
+		{"v2 bad version", badVer, nil, nil, 0, errProxyInvalid},
+	}
+	for _, tt := range tests {
+		src, dst, consumed, err := ParseProxyHeader(tt.in)
+		if err != tt.err || consumed != tt.consumed {
+			t.Errorf("%s: consumed %d err %v, want %d %v", tt.name, consumed, err, tt.consumed, tt.err)
+			continue
+		}
+		if Addr2Str(src) != Addr2Str(tt.src) || Addr2Str(dst) != Addr2Str(tt.dst) {
+			t.Errorf("%s: got %s -> %s, want %s -> %s", tt.name, Addr2Str(src), Addr2Str(dst), Addr2Str(tt.src), Addr2Str(tt.dst))
+		}
+	}
+}
+
+func TestParseProxyV2Short(t *testing.T) {
+	//直接调用时也不能越界
+	if _, _, _, err := parseProxyV2(kProxyV2Sig[:10]); err != errProxyNeedMore {
+		t.Fatalf("err = %v", err)
+	}
+}
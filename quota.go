@@ -0,0 +1,259 @@
+package fdd
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	QuotaActionBlock    = "block"
+	QuotaActionThrottle = "throttle"
+	QuotaActionLog      = "log"
+
+	QuotaPeriodDaily   = "daily"
+	QuotaPeriodWeekly  = "weekly"
+	QuotaPeriodMonthly = "monthly"
+
+	kQuotaSaveInterval = 30 * time.Second
+)
+
+type QuotaUsage struct {
+	Up   uint64 `json:"up"`
+	Down uint64 `json:"down"`
+}
+
+func (u *QuotaUsage) add(dir int, n int) {
+	if dir == kStreamUp {
+		u.Up += uint64(n)
+	} else {
+		u.Down += uint64(n)
+	}
+}
+
+func (u *QuotaUsage) Total() uint64 {
+	return u.Up + u.Down
+}
+
+type quotaState struct {
+	PeriodStart time.Time              `json:"period_start"`
+	Rule        QuotaUsage             `json:"rule"`
+	Clients     map[string]*QuotaUsage `json:"clients,omitempty"`
+}
+
+//Quota 按周期累计规则(可选按来源ip)的上下行流量并持久化到文件, 超出配额后按配置阻止新连接并关闭已有连接、限速或仅记录日志,
+//仅在eventLoop线程中使用, 定时保存在eventLoop中序列化后交给唯一的写入协程, 写入协程只保留最新的一份
+type Quota struct {
+	cfg      *Config
+	state    quotaState
+	dirty    bool
+	lastSave time.Time
+	exceeded map[string]bool
+	saves    chan []byte
+	saveDone chan struct{}
+	stopOnce sync.Once
+	saveErr  int32
+}
+
+//ValidQuotaConfig 检查配额动作和周期
+func ValidQuotaConfig(cfg *Config) error {
+	switch cfg.QuotaAction {
+	case QuotaActionBlock, QuotaActionThrottle, QuotaActionLog:
+	default:
+		return errors.New("invalid quota action: " + cfg.QuotaAction)
+	}
+	switch cfg.QuotaPeriod {
+	case QuotaPeriodDaily, QuotaPeriodWeekly, QuotaPeriodMonthly:
+	default:
+		return errors.New("invalid quota period: " + cfg.QuotaPeriod)
+	}
+	if cfg.QuotaPeriod == QuotaPeriodMonthly && (cfg.QuotaResetDay < 1 || cfg.QuotaResetDay > 28) {
+		return errors.New("invalid quota reset day: " + strconv.Itoa(cfg.QuotaResetDay) + ", want 1-28")
+	}
+	return nil
+}
+
+func NewQuota(cfg *Config) (*Quota, error) {
+	q := &Quota{
+		cfg:      cfg,
+		exceeded: make(map[string]bool),
+		state:    quotaState{Clients: make(map[string]*QuotaUsage)},
+	}
+	if cfg.QuotaFile != "" {
+		if data, err := os.ReadFile(cfg.QuotaFile); err == nil {
+			if err := json.Unmarshal(data, &q.state); err != nil {
+				return nil, err
+			}
+			if q.state.Clients == nil {
+				q.state.Clients = make(map[string]*QuotaUsage)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	if start := q.periodStart(now); !start.Equal(q.state.PeriodStart) {
+		q.reset(start)
+	}
+	q.exceeded[""] = q.cfg.QuotaBytes > 0 && q.state.Rule.Total() >= uint64(q.cfg.QuotaBytes)
+	for key, u := range q.state.Clients {
+		q.exceeded[key] = q.cfg.QuotaIPBytes > 0 && u.Total() >= uint64(q.cfg.QuotaIPBytes)
+	}
+	q.lastSave = now
+	if cfg.QuotaFile != "" {
+		q.saves, q.saveDone = make(chan []byte, 1), make(chan struct{})
+		go q.writer()
+	}
+	log.Info("[quota] period from ", q.state.PeriodStart.Format(time.RFC3339), ", used ", q.state.Rule.Total(), " bytes")
+	return q, nil
+}
+
+//Add 累计流量
+func (q *Quota) Add(ip net.IP, dir int, n int) {
+	if n <= 0 {
+		return
+	}
+	q.dirty = true
+	q.state.Rule.add(dir, n)
+	if q.cfg.QuotaBytes > 0 && !q.exceeded[""] && q.state.Rule.Total() >= uint64(q.cfg.QuotaBytes) {
+		q.exceeded[""] = true
+		log.Warn("[quota] rule quota exceeded: ", q.state.Rule.Total(), " bytes, action: ", q.cfg.QuotaAction)
+	}
+	if !q.cfg.QuotaPerIP && q.cfg.QuotaIPBytes <= 0 {
+		return
+	}
+	key := ip.String()
+	u, ok := q.state.Clients[key]
+	if !ok {
+		u = &QuotaUsage{}
+		q.state.Clients[key] = u
+	}
+	u.add(dir, n)
+	if q.cfg.QuotaIPBytes > 0 && !q.exceeded[key] && u.Total() >= uint64(q.cfg.QuotaIPBytes) {
+		q.exceeded[key] = true
+		log.Warn("[quota] client quota exceeded: ", key, " ", u.Total(), " bytes, action: ", q.cfg.QuotaAction)
+	}
+}
+
+//Exceeded 返回规则或来源ip是否已超出配额
+func (q *Quota) Exceeded(ip net.IP) bool {
+	return q.exceeded[""] || (len(q.exceeded) != 0 && q.exceeded[ip.String()])
+}
+
+func (q *Quota) RuleExceeded() bool {
+	return q.exceeded[""]
+}
+
+//Allow 判断是否允许新连接和继续转发已有连接的数据, 仅在动作为block且已超额时拒绝
+func (q *Quota) Allow(ip net.IP) bool {
+	return q.cfg.QuotaAction != QuotaActionBlock || !q.Exceeded(ip)
+}
+
+//Throttled 判断是否需要对来源ip限速
+func (q *Quota) Throttled(ip net.IP) bool {
+	return q.cfg.QuotaAction == QuotaActionThrottle && q.Exceeded(ip)
+}
+
+//HandleTick 检查周期重置, 定时保存: 在eventLoop中序列化当前用量, 文件写入交给写入协程, 写入失败时下次重试
+func (q *Quota) HandleTick(now time.Time) {
+	if start := q.periodStart(now); !start.Equal(q.state.PeriodStart) {
+		log.Info("[quota] new period, last period used ", q.state.Rule.Total(), " bytes")
+		q.reset(start)
+	}
+	if atomic.SwapInt32(&q.saveErr, 0) != 0 {
+		q.dirty = true
+	}
+	if q.cfg.QuotaFile == "" || !q.dirty || now.Sub(q.lastSave) < kQuotaSaveInterval {
+		return
+	}
+	q.lastSave = now
+	data, err := json.Marshal(&q.state)
+	if !CheckError("[quota] save quota err: ", err) {
+		return
+	}
+	q.dirty = false
+	//写入协程尚未取走的旧快照直接替换
+	select {
+	case <-q.saves:
+	default:
+	}
+	q.saves <- data
+}
+
+//writer 按顺序写入快照, saves 关闭后退出
+func (q *Quota) writer() {
+	defer close(q.saveDone)
+	for data := range q.saves {
+		if err := q.write(data); err != nil {
+			log.Warn("[quota] save quota err: ", err)
+			atomic.StoreInt32(&q.saveErr, 1)
+		}
+	}
+}
+
+//Stop 等待写入协程写完已提交的快照后退出, 在eventLoop退出后、Save 之前调用
+func (q *Quota) Stop() {
+	if q.saves == nil {
+		return
+	}
+	q.stopOnce.Do(func() {
+		close(q.saves)
+		<-q.saveDone
+	})
+}
+
+func (q *Quota) reset(start time.Time) {
+	q.state = quotaState{PeriodStart: start, Clients: make(map[string]*QuotaUsage)}
+	q.exceeded = make(map[string]bool)
+	q.dirty = true
+}
+
+//Save 同步保存当前用量, 用于eventLoop退出后, 先停止写入协程, 避免旧快照覆盖
+func (q *Quota) Save() error {
+	if q.cfg.QuotaFile == "" {
+		return nil
+	}
+	q.Stop()
+	data, err := json.Marshal(&q.state)
+	if err != nil {
+		return err
+	}
+	if err := q.write(data); err != nil {
+		return err
+	}
+	q.dirty = false
+	return nil
+}
+
+//write 写入临时文件后重命名, 避免写入中断损坏记录
+func (q *Quota) write(data []byte) error {
+	tmp := q.cfg.QuotaFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.cfg.QuotaFile)
+}
+
+//periodStart 计算now所在周期的起始时间
+func (q *Quota) periodStart(now time.Time) time.Time {
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	switch q.cfg.QuotaPeriod {
+	case QuotaPeriodDaily:
+		return today
+	case QuotaPeriodWeekly:
+		return today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	case QuotaPeriodMonthly:
+		start := time.Date(y, m, q.cfg.QuotaResetDay, 0, 0, 0, 0, now.Location())
+		if now.Before(start) {
+			start = start.AddDate(0, -1, 0)
+		}
+		return start
+	}
+	return time.Time{}
+}
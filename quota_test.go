@@ -0,0 +1,68 @@
+package fdd
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidQuotaConfig(t *testing.T) {
+	tests := []struct {
+		period string
+		day    int
+		ok     bool
+	}{
+		{QuotaPeriodMonthly, 1, true},
+		{QuotaPeriodMonthly, 28, true},
+		{QuotaPeriodMonthly, 0, false},
+		{QuotaPeriodMonthly, 29, false},
+		{QuotaPeriodDaily, 0, true},
+		{"yearly", 1, false},
+	}
+	for _, tt := range tests {
+		cfg := Config{QuotaAction: QuotaActionLog, QuotaPeriod: tt.period, QuotaResetDay: tt.day}
+		if err := ValidQuotaConfig(&cfg); (err == nil) != tt.ok {
+			t.Errorf("%s day %d: err = %v", tt.period, tt.day, err)
+		}
+	}
+}
+
+//TestQuotaSaveOrder 定时保存的快照由同一协程按顺序写入, 退出时的同步保存不会被旧快照覆盖
+func TestQuotaSaveOrder(t *testing.T) {
+	cfg := Config{
+		QuotaAction:   QuotaActionLog,
+		QuotaPeriod:   QuotaPeriodMonthly,
+		QuotaResetDay: 1,
+		QuotaFile:     filepath.Join(t.TempDir(), "quota.json"),
+	}
+	q, err := NewQuota(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 1; i <= 50; i++ {
+		q.Add(net.IPv4(10, 0, 0, 1), kStreamUp, 1)
+		q.HandleTick(now.Add(time.Duration(i) * kQuotaSaveInterval))
+	}
+	q.Add(net.IPv4(10, 0, 0, 1), kStreamDown, 7)
+	if err := q.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(cfg.QuotaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state quotaState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Rule.Up != 50 || state.Rule.Down != 7 {
+		t.Fatalf("saved usage %+v, want up 50 down 7", state.Rule)
+	}
+	if _, err := os.Stat(cfg.QuotaFile + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temp file left: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package fdd
+
+import (
+	"errors"
+	"time"
+
+	"github.com/shuLhan/share/lib/dns"
+)
+
+const (
+	kDnsServer          = "223.5.5.5:853"
+	kResolveInterval    = 5 * time.Minute
+	kMinResolveInterval = 5 * time.Second
+)
+
+//Resolver 按TTL定时解析目标域名或SRV记录, 将结果写入 Config.Backends
+type Resolver struct {
+	cfg  *Config
+	stop chan struct{}
+}
+
+func NewResolver(cfg *Config) *Resolver {
+	if cfg.Backends == nil {
+		cfg.Backends = NewBackendSet()
+	}
+	return &Resolver{
+		cfg:  cfg,
+		stop: make(chan struct{}),
+	}
+}
+
+//Resolve 解析一次并更新后端集合, 返回下次刷新的间隔
+func (r *Resolver) Resolve() (time.Duration, error) {
+	dot, err := dns.NewDoTClient(kDnsServer, true)
+	if err != nil {
+		return 0, err
+	}
+	defer dot.Close()
+	var backends []Backend
+	var ttl uint32
+	target := r.cfg.TargetDomain
+	if r.cfg.TargetSrv != "" {
+		target = r.cfg.TargetSrv
+		backends, ttl, err = r.resolveSrv(dot)
+	} else {
+		backends, ttl, err = r.resolveHost(dot, r.cfg.TargetDomain, r.cfg.RemotePort)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(backends) == 0 {
+		return 0, errors.New("no address found for " + target)
+	}
+	r.cfg.Backends.Store(backends)
+	log.Info("[resolver] resolver successful: ", target, " => ", backends)
+	return ttlInterval(ttl), nil
+}
+
+func (r *Resolver) resolveHost(dot *dns.DoTClient, host string, port int) ([]Backend, uint32, error) {
+	ips, ttl, err := lookupHost(dot, host, r.cfg.AddrFamily)
+	if err != nil {
+		return nil, 0, err
+	}
+	backends := make([]Backend, 0, len(ips))
+	for _, ip := range ips {
+		backends = append(backends, Backend{Addr: ip, Port: port, Host: host})
+	}
+	return backends, ttl, nil
+}
+
+//resolveSrv 查询SRV记录并解析每个目标主机的地址
+func (r *Resolver) resolveSrv(dot *dns.DoTClient) ([]Backend, uint32, error) {
+	res, err := dot.Lookup(dns.MessageQuestion{
+		Name: r.cfg.TargetSrv,
+		Type: dns.RecordTypeSRV,
+	}, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	backends, ttl := make([]Backend, 0, len(res.Answer)), uint32(0)
+	for _, v := range res.Answer {
+		srv, ok := v.Value.(*dns.RDataSRV)
+		if v.Type != dns.RecordTypeSRV || !ok || srv.Target == "" || srv.Target == "." {
+			continue
+		}
+		ttl = minTTL(ttl, v.TTL)
+		list, hostTTL, err := r.resolveHost(dot, srv.Target, int(srv.Port))
+		if err != nil {
+			log.Warn("[resolver] resolver srv target err: ", srv.Target, " ", err)
+			continue
+		}
+		ttl = minTTL(ttl, hostTTL)
+		for _, b := range list {
+			b.Priority, b.Weight = srv.Priority, srv.Weight
+			backends = append(backends, b)
+		}
+	}
+	return backends, ttl, nil
+}
+
+//Start 启动解析循环, 记录过期后重新解析, 失败时保留上一次的结果
+func (r *Resolver) Start(interval time.Duration) {
+	go func() {
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				next, err := r.Resolve()
+				if err != nil {
+					log.Error("[resolver] resolver err: ", err)
+					next = kMinResolveInterval
+				}
+				timer.Reset(next)
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (r *Resolver) Stop() {
+	close(r.stop)
+}
+
+func ttlInterval(ttl uint32) time.Duration {
+	if ttl == 0 {
+		return kResolveInterval
+	}
+	if d := time.Duration(ttl) * time.Second; d > kMinResolveInterval {
+		return d
+	}
+	return kMinResolveInterval
+}
@@ -0,0 +1,169 @@
+package fdd
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const kMaxPeekSize = 32 * 1024
+
+var (
+	errRouteNeedMore = errors.New("route: need more data")
+	errRouteNoMatch  = errors.New("route: no matching target")
+)
+
+//IRouter 根据连接的首部数据选择后端, 在连接后端之前调用
+type IRouter interface {
+	//Route 返回选中的后端和需转发给后端的数据, backends 为空表示使用默认目标;
+	//数据不足时返回 errRouteNeedMore, final 为true表示不会再有更多数据(超时或超过 kMaxPeekSize)
+	Route(data []byte, src unix.Sockaddr, final bool) (backends []Backend, out []byte, err error)
+}
+
+//RouteTable 主机名(和路径前缀)到后端的映射, 主机名支持精确匹配、*.example.com 通配(匹配任意层子域名)和 * 默认项,
+//同一主机名下按最长路径前缀匹配
+type RouteTable struct {
+	exact    map[string][]routePath
+	wildcard []routeSuffix
+	def      []routePath
+}
+
+type routePath struct {
+	prefix  string
+	backend Backend
+}
+
+type routeSuffix struct {
+	suffix string
+	paths  []routePath
+}
+
+//ParseRouteTable 解析 host[/path]=target 列表, target 为 ip[:port] 或 unix:/path, 未指定端口时使用 defPort
+func ParseRouteTable(list []string, defPort int) (*RouteTable, error) {
+	rt := &RouteTable{exact: make(map[string][]routePath, len(list))}
+	suffixes := make(map[string]int)
+	for _, v := range list {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.New("invalid route: " + v)
+		}
+		b, err := parseRouteTarget(kv[1], defPort)
+		if err != nil {
+			return nil, err
+		}
+		host, prefix := kv[0], ""
+		if i := strings.IndexByte(host, '/'); i >= 0 {
+			host, prefix = host[:i], host[i:]
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		rp := routePath{prefix: prefix, backend: b}
+		if host == "*" {
+			rt.def = append(rt.def, rp)
+		} else if strings.HasPrefix(host, "*.") {
+			if i, ok := suffixes[host]; ok {
+				rt.wildcard[i].paths = append(rt.wildcard[i].paths, rp)
+			} else {
+				suffixes[host] = len(rt.wildcard)
+				rt.wildcard = append(rt.wildcard, routeSuffix{suffix: host[1:], paths: []routePath{rp}})
+			}
+		} else {
+			rt.exact[host] = append(rt.exact[host], rp)
+		}
+	}
+	//最长后缀、最长路径前缀优先
+	sort.SliceStable(rt.wildcard, func(i, j int) bool {
+		return len(rt.wildcard[i].suffix) > len(rt.wildcard[j].suffix)
+	})
+	sortPaths(rt.def)
+	for _, paths := range rt.exact {
+		sortPaths(paths)
+	}
+	for _, w := range rt.wildcard {
+		sortPaths(w.paths)
+	}
+	return rt, nil
+}
+
+func sortPaths(paths []routePath) {
+	sort.SliceStable(paths, func(i, j int) bool {
+		return len(paths[i].prefix) > len(paths[j].prefix)
+	})
+}
+
+//NewRouter 根据配置创建路由, 未配置路由规则时返回nil, 目标未指定端口时使用 RemotePort, 未设置时为监听端口
+func NewRouter(cfg *Config) (IRouter, error) {
+	defPort := cfg.RemotePort
+	if defPort == 0 {
+		defPort = cfg.ListenPort
+	}
+	var sni, http IRouter
+	if len(cfg.SNIRoutes) != 0 {
+		table, err := ParseRouteTable(cfg.SNIRoutes, defPort)
+		if err != nil {
+			return nil, err
+		}
+		sni = NewSNIRouter(table)
+	}
+	if len(cfg.HTTPRoutes) != 0 {
+		table, err := ParseRouteTable(cfg.HTTPRoutes, defPort)
+		if err != nil {
+			return nil, err
+		}
+		http = NewHTTPRouter(table, cfg.XForwardedFor)
+	}
+	//同时配置sni和http路由时按协议识别分发
+	if len(cfg.SniffRoutes) != 0 || (sni != nil && http != nil) {
+		return NewSniffRouter(cfg.SniffRoutes, defPort, sni, http)
+	} else if sni != nil {
+		return sni, nil
+	}
+	return http, nil
+}
+
+func parseRouteTarget(s string, defPort int) (Backend, error) {
+	if _, _, ok := UnixPath(s); ok {
+		return Backend{Addr: s}, nil
+	}
+	host, port, err := splitHostPort(s)
+	if err != nil {
+		return Backend{}, err
+	}
+	if port == 0 {
+		if port = defPort; port == 0 {
+			return Backend{}, errors.New("route target needs a port: " + s)
+		}
+	}
+	return Backend{Addr: host, Port: port, Host: host}, nil
+}
+
+//Lookup 按主机名和路径查找后端, 依次匹配精确项、通配项和默认项, 主机名命中但路径均不匹配时继续匹配下一级
+func (rt *RouteTable) Lookup(host, path string) (Backend, bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host != "" {
+		if b, ok := matchPath(rt.exact[host], path); ok {
+			return b, true
+		}
+		for _, w := range rt.wildcard {
+			if strings.HasSuffix(host, w.suffix) {
+				if b, ok := matchPath(w.paths, path); ok {
+					return b, true
+				}
+			}
+		}
+	}
+	return matchPath(rt.def, path)
+}
+
+func matchPath(paths []routePath, path string) (Backend, bool) {
+	for _, p := range paths {
+		if strings.HasPrefix(path, p.prefix) {
+			return p.backend, true
+		}
+	}
+	return Backend{}, false
+}
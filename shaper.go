@@ -0,0 +1,149 @@
+package fdd
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	kShapeExpire   = time.Minute
+	kUdpShapeQueue = 256
+)
+
+//rateLimit 上下行两个方向的令牌桶, 以 kStreamUp/kStreamDown 为下标, nil表示该方向不限速
+type rateLimit [2]*tokenBucket
+
+func newRateLimit(up, down, burst int64, now time.Time) rateLimit {
+	var rl rateLimit
+	for dir, rate := range [2]int64{up, down} {
+		if rate <= 0 {
+			continue
+		}
+		b := burst
+		if b <= 0 {
+			b = rate
+		}
+		tb := newTokenBucket(float64(rate), float64(b), now)
+		rl[dir] = &tb
+	}
+	return rl
+}
+
+//available 取多个令牌桶中可用令牌的最小值, max为上限
+func (rl rateLimit) available(dir int, max int, now time.Time) int {
+	if b := rl[dir]; b != nil {
+		b.refill(now)
+		if int(b.tokens) < max {
+			max = int(b.tokens)
+		}
+	}
+	return max
+}
+
+//consume 扣除令牌, 允许扣成负数, 超出的部分由之后补充的令牌偿还
+func (rl rateLimit) consume(dir int, n int) {
+	if b := rl[dir]; b != nil {
+		b.tokens -= float64(n)
+	}
+}
+
+func (rl rateLimit) full(now time.Time) bool {
+	for _, b := range rl {
+		if b != nil && !b.full(now) {
+			return false
+		}
+	}
+	return true
+}
+
+type shapeSource struct {
+	limit    rateLimit
+	throttle rateLimit
+	lastSeen time.Time
+}
+
+//Shaper 按规则和来源ip两级限制上下行带宽, 单条tcp流的令牌桶保存在 TCPRelayHandler 中, 仅在eventLoop线程中使用
+type Shaper struct {
+	cfg       *Config
+	rule      rateLimit
+	throttle  rateLimit
+	quota     *Quota
+	sources   map[string]*shapeSource
+	lastSweep time.Time
+}
+
+//NewShaper 未配置任何限速时返回nil
+func NewShaper(cfg *Config) *Shaper {
+	if !cfg.HasShaping() {
+		return nil
+	}
+	return &Shaper{
+		cfg:      cfg,
+		rule:     newRateLimit(cfg.RuleUpRate, cfg.RuleDownRate, cfg.RateBurst, time.Now()),
+		throttle: newRateLimit(cfg.QuotaThrottle, cfg.QuotaThrottle, cfg.RateBurst, time.Now()),
+		sources:  make(map[string]*shapeSource, cfg.HandlerCap),
+	}
+}
+
+//NewFlowLimit 创建单条tcp流的令牌桶
+func (sp *Shaper) NewFlowLimit() rateLimit {
+	return newRateLimit(sp.cfg.UpRate, sp.cfg.DownRate, sp.cfg.RateBurst, time.Now())
+}
+
+func (sp *Shaper) source(ip net.IP, now time.Time) *shapeSource {
+	key := string(ip.To16())
+	s, ok := sp.sources[key]
+	if !ok {
+		s = &shapeSource{
+			limit:    newRateLimit(sp.cfg.IPUpRate, sp.cfg.IPDownRate, sp.cfg.RateBurst, now),
+			throttle: newRateLimit(sp.cfg.QuotaThrottle, sp.cfg.QuotaThrottle, sp.cfg.RateBurst, now),
+		}
+		sp.sources[key] = s
+	}
+	s.lastSeen = now
+	return s
+}
+
+//Available 返回流、来源ip、规则三级限速下当前最多可传输的字节数, 超出配额限速时再叠加 QuotaThrottle
+func (sp *Shaper) Available(flow rateLimit, ip net.IP, dir int, max int) int {
+	now := time.Now()
+	src := sp.source(ip, now)
+	max = flow.available(dir, max, now)
+	max = src.limit.available(dir, max, now)
+	max = sp.rule.available(dir, max, now)
+	if sp.quota != nil && sp.quota.Throttled(ip) {
+		if sp.quota.RuleExceeded() {
+			return sp.throttle.available(dir, max, now)
+		}
+		return src.throttle.available(dir, max, now)
+	}
+	return max
+}
+
+//Consume 三级令牌桶同时扣除n字节
+func (sp *Shaper) Consume(flow rateLimit, ip net.IP, dir int, n int) {
+	src := sp.source(ip, time.Now())
+	flow.consume(dir, n)
+	src.limit.consume(dir, n)
+	sp.rule.consume(dir, n)
+	if sp.quota != nil && sp.quota.Throttled(ip) {
+		if sp.quota.RuleExceeded() {
+			sp.throttle.consume(dir, n)
+		} else {
+			src.throttle.consume(dir, n)
+		}
+	}
+}
+
+//HandleTick 清理空闲且令牌已满的来源状态
+func (sp *Shaper) HandleTick(now time.Time) {
+	if now.Sub(sp.lastSweep) < kShapeExpire/6 {
+		return
+	}
+	sp.lastSweep = now
+	for k, s := range sp.sources {
+		if now.Sub(s.lastSeen) > kShapeExpire && s.limit.full(now) {
+			delete(sp.sources, k)
+		}
+	}
+}
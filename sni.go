@@ -0,0 +1,145 @@
+package fdd
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	kTLSRecordHandshake  = 0x16
+	kTLSClientHello      = 0x01
+	kTLSExtServerName    = 0x0000
+	kTLSServerNameDNS    = 0x00
+	kTLSRecordHeaderSize = 5
+)
+
+var (
+	errTLSNeedMore = errors.New("tls: need more data")
+	errTLSNotHello = errors.New("tls: not a client hello")
+)
+
+//ParseClientHelloSNI 从连接首部数据中解析TLS ClientHello的SNI, 支持跨多个record的ClientHello,
+//数据不足时返回 errTLSNeedMore, 不是ClientHello时返回 errTLSNotHello, 未携带SNI时返回空字符串
+func ParseClientHelloSNI(data []byte) (string, error) {
+	var msg []byte
+	for {
+		if len(data) < kTLSRecordHeaderSize {
+			return "", errTLSNeedMore
+		}
+		if data[0] != kTLSRecordHandshake || data[1] != 3 {
+			return "", errTLSNotHello
+		}
+		n := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < kTLSRecordHeaderSize+n {
+			return "", errTLSNeedMore
+		}
+		msg = append(msg, data[kTLSRecordHeaderSize:kTLSRecordHeaderSize+n]...)
+		data = data[kTLSRecordHeaderSize+n:]
+		if len(msg) >= 4 {
+			if msg[0] != kTLSClientHello {
+				return "", errTLSNotHello
+			}
+			if size := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]); len(msg) >= 4+size {
+				return parseClientHello(msg[4 : 4+size])
+			}
+		}
+	}
+}
+
+func parseClientHello(b []byte) (string, error) {
+	//legacy_version(2) + random(32)
+	if len(b) < 34 {
+		return "", errTLSNotHello
+	}
+	b = b[34:]
+	var ok bool
+	//session_id, cipher_suites, compression_methods
+	if b, ok = skipVector(b, 1); !ok {
+		return "", errTLSNotHello
+	}
+	if b, ok = skipVector(b, 2); !ok {
+		return "", errTLSNotHello
+	}
+	if b, ok = skipVector(b, 1); !ok {
+		return "", errTLSNotHello
+	}
+	if len(b) < 2 {
+		return "", nil
+	}
+	exts := b[2:]
+	if n := int(binary.BigEndian.Uint16(b)); n <= len(exts) {
+		exts = exts[:n]
+	} else {
+		return "", errTLSNotHello
+	}
+	for len(exts) >= 4 {
+		typ, n := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+n {
+			return "", errTLSNotHello
+		}
+		if typ == kTLSExtServerName {
+			return parseServerName(exts[4 : 4+n])
+		}
+		exts = exts[4+n:]
+	}
+	return "", nil
+}
+
+func parseServerName(b []byte) (string, error) {
+	if len(b) < 2 {
+		return "", errTLSNotHello
+	}
+	list := b[2:]
+	for len(list) >= 3 {
+		typ, n := list[0], int(binary.BigEndian.Uint16(list[1:]))
+		if len(list) < 3+n {
+			return "", errTLSNotHello
+		}
+		if typ == kTLSServerNameDNS {
+			return strings.ToLower(string(list[3 : 3+n])), nil
+		}
+		list = list[3+n:]
+	}
+	return "", nil
+}
+
+//skipVector 跳过长度前缀为 size 字节的变长字段
+func skipVector(b []byte, size int) ([]byte, bool) {
+	if len(b) < size {
+		return nil, false
+	}
+	n := 0
+	for _, c := range b[:size] {
+		n = n<<8 | int(c)
+	}
+	if len(b) < size+n {
+		return nil, false
+	}
+	return b[size+n:], true
+}
+
+//SNIRouter 按TLS ClientHello中的SNI选择后端, 不终止TLS, 读取的数据原样转发
+type SNIRouter struct {
+	table *RouteTable
+}
+
+func NewSNIRouter(table *RouteTable) *SNIRouter {
+	return &SNIRouter{table: table}
+}
+
+//Route 非TLS连接或未携带SNI时使用默认项
+func (r *SNIRouter) Route(data []byte, src unix.Sockaddr, final bool) ([]Backend, []byte, error) {
+	sni, err := ParseClientHelloSNI(data)
+	if err == errTLSNeedMore && !final {
+		return nil, nil, errRouteNeedMore
+	}
+	b, ok := r.table.Lookup(sni, "")
+	if !ok {
+		return nil, data, nil
+	}
+	log.Debug("[sni_router] ", Addr2Str(src), " sni: ", sni, " => ", b.Addr, ":", b.Port)
+	return []Backend{b}, data, nil
+}
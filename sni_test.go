@@ -0,0 +1,101 @@
+package fdd
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+//clientHello 返回 crypto/tls 客户端发送的第一个record, serverName 为ip时不携带SNI
+func clientHello(t *testing.T, serverName string) []byte {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go tls.Client(c1, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16384)
+	n, err := c2.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.Close()
+	return buf[:n]
+}
+
+//splitRecord 把单个record中的握手消息拆成两个record
+func splitRecord(rec []byte, at int) []byte {
+	msg := rec[kTLSRecordHeaderSize:]
+	var out []byte
+	for _, part := range [][]byte{msg[:at], msg[at:]} {
+		out = append(out, rec[0], rec[1], rec[2], byte(len(part)>>8), byte(len(part)))
+		out = append(out, part...)
+	}
+	return out
+}
+
+func TestParseClientHelloSNI(t *testing.T) {
+	hello := clientHello(t, "Example.COM")
+	//握手消息长度改为最大值, 数据永远不足
+	huge := append([]byte(nil), hello...)
+	huge[6], huge[7], huge[8] = 0xff, 0xff, 0xff
+	//扩展总长度超出消息
+	badExt := append([]byte(nil), hello...)
+	msgLen := int(hello[6])<<16 | int(hello[7])<<8 | int(hello[8])
+	extLenAt := 9 + msgLen - int(extensionsLen(hello)) - 2
+	binary.BigEndian.PutUint16(badExt[extLenAt:], 0xffff)
+	serverHello := append([]byte(nil), hello...)
+	serverHello[5] = 0x02
+
+	tests := []struct {
+		name string
+		data []byte
+		sni  string
+		err  error
+	}{
+		{"sni", hello, "example.com", nil},
+		{"split records", splitRecord(hello, 10), "example.com", nil},
+		{"split header", splitRecord(hello, 2), "example.com", nil},
+		{"no sni", clientHello(t, "127.0.0.1"), "", nil},
+		{"empty", nil, "", errTLSNeedMore},
+		{"short record", hello[:len(hello)-1], "", errTLSNeedMore},
+		{"oversized hello", huge, "", errTLSNeedMore},
+		{"http", []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"), "", errTLSNotHello},
+		{"not ssl3+", []byte{kTLSRecordHandshake, 2, 0, 0, 4, 1, 0, 0, 0}, "", errTLSNotHello},
+		{"server hello", serverHello, "", errTLSNotHello},
+		{"bad extensions", badExt, "", errTLSNotHello},
+		{"short body", []byte{kTLSRecordHandshake, 3, 1, 0, 6, kTLSClientHello, 0, 0, 2, 3, 3}, "", errTLSNotHello},
+	}
+	for _, tt := range tests {
+		sni, err := ParseClientHelloSNI(tt.data)
+		if sni != tt.sni || err != tt.err {
+			t.Errorf("%s: got %q %v, want %q %v", tt.name, sni, err, tt.sni, tt.err)
+		}
+	}
+}
+
+//TestParseClientHelloSNITruncated 任意位置截断都只能返回 errTLSNeedMore, 逐字节篡改不能panic
+func TestParseClientHelloSNITruncated(t *testing.T) {
+	hello := clientHello(t, "example.com")
+	for i := 0; i < len(hello); i++ {
+		if _, err := ParseClientHelloSNI(hello[:i]); err != errTLSNeedMore {
+			t.Fatalf("truncated at %d: %v", i, err)
+		}
+	}
+	for i := 0; i < len(hello); i++ {
+		for _, v := range []byte{0x00, 0x7f, 0xff} {
+			data := append([]byte(nil), hello...)
+			data[i] = v
+			ParseClientHelloSNI(data)
+		}
+	}
+}
+
+//extensionsLen 返回单record ClientHello的扩展总长度
+func extensionsLen(rec []byte) uint16 {
+	b := rec[kTLSRecordHeaderSize+4+34:]
+	b, _ = skipVector(b, 1)
+	b, _ = skipVector(b, 2)
+	b, _ = skipVector(b, 1)
+	return binary.BigEndian.Uint16(b)
+}
@@ -0,0 +1,204 @@
+package fdd
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	SniffTLS     = "tls"
+	SniffHTTP    = "http"
+	SniffSSH     = "ssh"
+	SniffTimeout = "timeout"
+	SniffDefault = "*"
+
+	kSniffPrefix = "prefix:"
+	kSniffRegex  = "regex:"
+)
+
+var kHTTPMethods = []string{"GET", "POST", "PUT", "HEAD", "DELETE", "OPTIONS", "PATCH", "CONNECT", "TRACE", "PRI"}
+
+//sniffRule 一条协议识别规则, router 非空时命中后交给其继续路由
+type sniffRule struct {
+	name    string
+	match   func(data []byte) (matched bool, more bool)
+	backend *Backend
+	router  IRouter
+}
+
+//SniffRouter 按连接首部数据识别协议(TLS、HTTP、SSH、自定义前缀或正则)选择后端,
+//规则按配置顺序匹配, 客户端在超时前未发送数据时使用 timeout 项, 其余使用 * 项或默认目标
+type SniffRouter struct {
+	rules    []*sniffRule
+	silent   *Backend
+	fallback *Backend
+}
+
+//NewSniffRouter 解析 proto=target 列表, proto 为 tls, http, ssh, prefix:<bytes>, regex:<expr>, timeout 或 *,
+//prefix 支持 \x00 形式的转义; sni/http 非空时tls/http连接交给对应路由, 未命中再使用规则中的目标
+func NewSniffRouter(list []string, defPort int, sni, http IRouter) (*SniffRouter, error) {
+	r := &SniffRouter{}
+	for _, v := range list {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		i := strings.LastIndexByte(v, '=')
+		if i <= 0 {
+			return nil, errors.New("invalid sniff route: " + v)
+		}
+		b, err := parseRouteTarget(v[i+1:], defPort)
+		if err != nil {
+			return nil, err
+		}
+		name := v[:i]
+		switch {
+		case name == SniffTimeout:
+			r.silent = &b
+			continue
+		case name == SniffDefault:
+			r.fallback = &b
+			continue
+		}
+		rule := &sniffRule{name: name, backend: &b}
+		switch {
+		case name == SniffTLS:
+			rule.match, rule.router = matchTLS, sni
+		case name == SniffHTTP:
+			rule.match, rule.router = matchHTTP, http
+		case name == SniffSSH:
+			rule.match = matchPrefix([]byte("SSH-"))
+		case strings.HasPrefix(name, kSniffPrefix):
+			prefix := strings.TrimPrefix(name, kSniffPrefix)
+			if s, err := strconv.Unquote(`"` + prefix + `"`); err == nil {
+				prefix = s
+			}
+			if prefix == "" {
+				return nil, errors.New("empty sniff prefix: " + v)
+			}
+			rule.match = matchPrefix([]byte(prefix))
+		case strings.HasPrefix(name, kSniffRegex):
+			re, err := regexp.Compile(strings.TrimPrefix(name, kSniffRegex))
+			if err != nil {
+				return nil, err
+			}
+			rule.match = matchRegex(re)
+		default:
+			return nil, errors.New("unknown sniff protocol: " + name)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	if sni != nil && r.find(SniffTLS) == nil {
+		r.rules = append(r.rules, &sniffRule{name: SniffTLS, match: matchTLS, router: sni})
+	}
+	if http != nil && r.find(SniffHTTP) == nil {
+		r.rules = append(r.rules, &sniffRule{name: SniffHTTP, match: matchHTTP, router: http})
+	}
+	return r, nil
+}
+
+func (r *SniffRouter) find(name string) *sniffRule {
+	for _, rule := range r.rules {
+		if rule.name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+//Route 排在命中规则之前的规则仍可能匹配时等待更多数据
+func (r *SniffRouter) Route(data []byte, src unix.Sockaddr, final bool) ([]Backend, []byte, error) {
+	if len(data) == 0 {
+		if !final {
+			return nil, nil, errRouteNeedMore
+		} else if r.silent != nil {
+			log.Debug("[sniff_router] ", Addr2Str(src), " silent => ", r.silent.Addr, ":", r.silent.Port)
+			return []Backend{*r.silent}, data, nil
+		}
+		return r.defaultRoute(data)
+	}
+	waiting := false
+	for _, rule := range r.rules {
+		matched, more := rule.match(data)
+		if !matched {
+			waiting = waiting || more
+			continue
+		} else if waiting && !final {
+			//前面的规则优先
+			return nil, nil, errRouteNeedMore
+		}
+		if rule.router != nil {
+			backends, out, err := rule.router.Route(data, src, final)
+			if err != nil || len(backends) != 0 {
+				return backends, out, err
+			} else if rule.backend == nil {
+				return r.defaultRoute(out)
+			}
+			data = out
+		}
+		log.Debug("[sniff_router] ", Addr2Str(src), " ", rule.name, " => ", rule.backend.Addr, ":", rule.backend.Port)
+		return []Backend{*rule.backend}, data, nil
+	}
+	if waiting && !final {
+		return nil, nil, errRouteNeedMore
+	}
+	return r.defaultRoute(data)
+}
+
+func (r *SniffRouter) defaultRoute(data []byte) ([]Backend, []byte, error) {
+	if r.fallback != nil {
+		return []Backend{*r.fallback}, data, nil
+	}
+	return nil, data, nil
+}
+
+func matchTLS(data []byte) (bool, bool) {
+	if data[0] != kTLSRecordHandshake {
+		return false, false
+	} else if len(data) < 2 {
+		return false, true
+	}
+	return data[1] == 3, false
+}
+
+func matchHTTP(data []byte) (bool, bool) {
+	more := false
+	for _, m := range kHTTPMethods {
+		matched, wait := matchPrefix([]byte(m + " "))(data)
+		if matched {
+			return true, false
+		}
+		more = more || wait
+	}
+	return false, more
+}
+
+//matchPrefix 数据不足前缀长度但与前缀一致时需要等待更多数据
+func matchPrefix(prefix []byte) func(data []byte) (bool, bool) {
+	return func(data []byte) (bool, bool) {
+		if len(data) >= len(prefix) {
+			return bytes.HasPrefix(data, prefix), false
+		}
+		return false, bytes.HasPrefix(prefix, data)
+	}
+}
+
+//matchRegex 匹配已读取的数据, 以^开头的表达式在数据不长于其字面前缀且与之一致时等待更多数据
+func matchRegex(re *regexp.Regexp) func(data []byte) (bool, bool) {
+	prefix := ""
+	if expr := re.String(); strings.HasPrefix(expr, "^") {
+		if lit, err := regexp.Compile(expr[1:]); err == nil {
+			prefix, _ = lit.LiteralPrefix()
+		}
+	}
+	return func(data []byte) (bool, bool) {
+		if re.Match(data) {
+			return true, false
+		}
+		return false, len(data) <= len(prefix) && strings.HasPrefix(prefix, string(data))
+	}
+}
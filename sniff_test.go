@@ -0,0 +1,81 @@
+package fdd
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNewSniffRouterInvalid(t *testing.T) {
+	tests := []string{
+		"tls",
+		"=127.0.0.1:1",
+		"prefix:=127.0.0.1:1",
+		"regex:(=127.0.0.1:1",
+		"quic=127.0.0.1:1",
+		"tls=example.com:1",
+		"tls=127.0.0.1",
+	}
+	for _, v := range tests {
+		if _, err := NewSniffRouter([]string{v}, 0, nil, nil); err == nil {
+			t.Errorf("%q: want error", v)
+		}
+	}
+}
+
+func TestSniffRouterRoute(t *testing.T) {
+	sniTable, _ := ParseRouteTable([]string{"example.com=127.0.0.1:91"}, 0)
+	httpTable, _ := ParseRouteTable([]string{"a.com=127.0.0.1:92"}, 0)
+	r, err := NewSniffRouter([]string{
+		"prefix:GET /admin=127.0.0.1:93",
+		"ssh=127.0.0.1:22",
+		`prefix:\x00\x01=127.0.0.1:94`,
+		"regex:^FOO[0-9]+=127.0.0.1:95",
+		"tls=127.0.0.1:96",
+		"timeout=127.0.0.1:97",
+		"*=127.0.0.1:80",
+	}, 0, NewSNIRouter(sniTable), NewHTTPRouter(httpTable, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &unix.SockaddrInet4{Addr: [4]byte{10, 0, 0, 1}, Port: 1234}
+	tests := []struct {
+		name  string
+		data  []byte
+		final bool
+		port  int //0 表示等待更多数据
+	}{
+		{"empty", nil, false, 0},
+		{"silent", nil, true, 97},
+		{"ssh partial", []byte("SS"), false, 0},
+		{"ssh", []byte("SSH-2.0-x\r\n"), false, 22},
+		{"binary prefix", []byte{0, 1, 2}, false, 94},
+		{"binary partial", []byte{0}, false, 0},
+		{"regex", []byte("FOO12"), false, 95},
+		{"regex partial", []byte("FO"), false, 0},
+		{"tls sni", clientHello(t, "example.com"), false, 91},
+		{"tls other sni", clientHello(t, "other.com"), false, 96},
+		{"tls record header only", []byte{kTLSRecordHandshake}, false, 0},
+		{"tls truncated", []byte{kTLSRecordHandshake, 3, 1, 0xff, 0xff}, false, 0},
+		{"tls truncated final", []byte{kTLSRecordHandshake, 3, 1, 0xff, 0xff}, true, 96},
+		{"not tls", []byte{kTLSRecordHandshake, 2, 0}, false, 80},
+		{"http", []byte("GET /x HTTP/1.1\r\nHost: a.com\r\n\r\n"), false, 92},
+		{"http unknown host", []byte("GET /x HTTP/1.1\r\nHost: b.com\r\n\r\n"), false, 80},
+		{"earlier prefix pending", []byte("GET /"), false, 0},
+		{"earlier prefix", []byte("GET /admin HTTP/1.1\r\n\r\n"), false, 93},
+		{"unknown", []byte("random"), false, 80},
+		{"unknown final", []byte{0xff}, true, 80},
+	}
+	for _, tt := range tests {
+		backends, out, err := r.Route(tt.data, src, tt.final)
+		if tt.port == 0 {
+			if err != errRouteNeedMore {
+				t.Errorf("%s: got %v %v, want need more", tt.name, backends, err)
+			}
+			continue
+		}
+		if err != nil || len(backends) != 1 || backends[0].Port != tt.port || string(out) != string(tt.data) {
+			t.Errorf("%s: got %v %q %v, want port %d", tt.name, backends, out, err, tt.port)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package fdd
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const (
+	kDefaultBacklog   = 128
+	kFastOpenQueueLen = 256
+)
+
+//SocketTuning 监听和出站socket的可调参数, 零值表示保持系统默认
+type SocketTuning struct {
+	NoDelay     bool
+	RcvBuf      int
+	SndBuf      int
+	Mark        int
+	TOS         int
+	Congestion  string
+	FastOpen    bool
+	DeferAccept int //秒
+	UserTimeout int //毫秒
+	Backlog     int
+}
+
+//applyCommon 设置监听和出站socket通用的选项, stream为true时额外设置tcp选项
+func (st *SocketTuning) applyCommon(fd int, family int, stream bool) error {
+	if st == nil {
+		return nil
+	}
+	if st.RcvBuf > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, st.RcvBuf); err != nil {
+			return err
+		}
+	}
+	if st.SndBuf > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, st.SndBuf); err != nil {
+			return err
+		}
+	}
+	if st.Mark != 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, st.Mark); err != nil {
+			return err
+		}
+	}
+	if st.TOS != 0 {
+		if family == unix.AF_INET6 {
+			if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, st.TOS); err != nil {
+				return err
+			}
+		} else if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, st.TOS); err != nil {
+			return err
+		}
+	}
+	if !stream {
+		return nil
+	}
+	if st.Congestion != "" {
+		if err := unix.SetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION, st.Congestion); err != nil {
+			return err
+		}
+	}
+	return st.applyConn(fd)
+}
+
+//applyConn 设置单条tcp连接的选项, 监听socket上设置的这些选项不保证被accept的连接继承
+func (st *SocketTuning) applyConn(fd int) error {
+	if st == nil {
+		return nil
+	}
+	if st.NoDelay {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1); err != nil {
+			return err
+		}
+	}
+	if st.UserTimeout > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, st.UserTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//applyListen 设置tcp监听socket的选项
+func (st *SocketTuning) applyListen(fd int, family int) error {
+	if st == nil {
+		return nil
+	}
+	if err := st.applyCommon(fd, family, true); err != nil {
+		return err
+	}
+	if st.DeferAccept > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT, st.DeferAccept); err != nil {
+			return err
+		}
+	}
+	if st.FastOpen {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, kFastOpenQueueLen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//applyDial 设置出站socket的选项, tcp开启 FastOpen 时首包数据随SYN发送
+func (st *SocketTuning) applyDial(fd int, family int, stream bool) error {
+	if st == nil {
+		return nil
+	}
+	if err := st.applyCommon(fd, family, stream); err != nil {
+		return err
+	}
+	if stream && st.FastOpen {
+		return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+	}
+	return nil
+}
+
+func (st *SocketTuning) backlog() int {
+	if st == nil || st.Backlog <= 0 {
+		return kDefaultBacklog
+	}
+	return st.Backlog
+}
@@ -0,0 +1,610 @@
+package fdd
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rocinan/fdd/poller"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	kSocksRepSuccess     = 0x00
+	kSocksRepFailure     = 0x01
+	kSocksRepNotAllowed  = 0x02
+	kSocksRepHostUnreach = 0x04
+	kSocksRepRefused     = 0x05
+	kSocksRepCmdNotSupp  = 0x07
+)
+
+const (
+	//kSocksResolveTTL udp中继解析结果的缓存时间
+	kSocksResolveTTL = 60 * time.Second
+	//kSocksResolveSize 每个udp中继缓存的域名数和同时解析的域名数上限
+	kSocksResolveSize = 64
+	//kLookupWorkers 执行域名解析的协程数, kLookupQueue 等待解析的请求数上限
+	kLookupWorkers = 8
+	kLookupQueue   = 256
+)
+
+//lookupPool 固定数量的协程执行阻塞的域名解析, 结果通过 ep.Post 回到eventLoop线程, 队列满时拒绝新的请求
+type lookupPool struct {
+	jobs chan func()
+}
+
+func newLookupPool(workers, queue int) *lookupPool {
+	p := &lookupPool{jobs: make(chan func(), queue)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+//Lookup 按 family 解析 host, 完成后在eventLoop线程中调用 done, 队列已满时返回false
+func (p *lookupPool) Lookup(ep *poller.EventLoop, host, family string, done func(ips []string, err error)) bool {
+	job := func() {
+		ips, err := GetDomainIps(host, family)
+		ep.Post(func() {
+			done(ips, err)
+		})
+	}
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *lookupPool) Close() {
+	close(p.jobs)
+}
+
+//SocksServerHandshake 服务端SOCKS5握手状态机, 支持无认证和用户名/密码认证, 只处理字节
+type SocksServerHandshake struct {
+	users map[string]string
+	state int
+	in    []byte
+}
+
+//SocksRequest 客户端的 CONNECT/UDP ASSOCIATE 请求
+type SocksRequest struct {
+	Cmd  byte
+	Host string
+	Port int
+}
+
+//ParseSocksUsers 解析 user:pass 列表
+func ParseSocksUsers(list []string) (map[string]string, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	users := make(map[string]string, len(list))
+	for _, v := range list {
+		i := strings.IndexByte(v, ':')
+		if i <= 0 || i > 255 || len(v)-i-1 > 255 {
+			return nil, errors.New("invalid socks user, expect user:pass: " + v)
+		}
+		users[v[:i]] = v[i+1:]
+	}
+	return users, nil
+}
+
+func NewSocksServerHandshake(users map[string]string) *SocksServerHandshake {
+	return &SocksServerHandshake{users: users, state: kHsSocksMethod}
+}
+
+//Feed 输入客户端数据, 返回需要回复的数据; req 非空时握手完成, rest 为请求之后已读到的数据
+func (h *SocksServerHandshake) Feed(data []byte) (out []byte, req *SocksRequest, rest []byte, err error) {
+	h.in = append(h.in, data...)
+	for {
+		var reply []byte
+		switch h.state {
+		case kHsSocksMethod:
+			reply, err = h.onMethod()
+		case kHsSocksAuth:
+			reply, err = h.onAuth()
+		case kHsSocksRequest:
+			req, err = h.onRequest()
+		}
+		if err == errHandshakeNeedMore {
+			return out, nil, nil, nil
+		}
+		out = append(out, reply...)
+		if err != nil || req != nil {
+			return out, req, h.in, err
+		}
+	}
+}
+
+func (h *SocksServerHandshake) onMethod() ([]byte, error) {
+	if len(h.in) < 2 || len(h.in) < 2+int(h.in[1]) {
+		return nil, errHandshakeNeedMore
+	}
+	if h.in[0] != kSocksVersion {
+		return nil, errors.New("socks5: invalid version")
+	}
+	methods := h.in[2 : 2+int(h.in[1])]
+	h.in = h.in[2+len(methods):]
+	want := byte(kSocksAuthNone)
+	if h.users != nil {
+		want = kSocksAuthPass
+	}
+	for _, m := range methods {
+		if m == want {
+			if h.state = kHsSocksRequest; want == kSocksAuthPass {
+				h.state = kHsSocksAuth
+			}
+			return []byte{kSocksVersion, want}, nil
+		}
+	}
+	return []byte{kSocksVersion, kSocksAuthNoMatch}, errors.New("socks5: no acceptable auth method")
+}
+
+func (h *SocksServerHandshake) onAuth() ([]byte, error) {
+	if len(h.in) < 2 {
+		return nil, errHandshakeNeedMore
+	}
+	ulen := int(h.in[1])
+	if len(h.in) < 3+ulen || len(h.in) < 3+ulen+int(h.in[2+ulen]) {
+		return nil, errHandshakeNeedMore
+	}
+	plen := int(h.in[2+ulen])
+	user, pass := string(h.in[2:2+ulen]), string(h.in[3+ulen:3+ulen+plen])
+	h.in = h.in[3+ulen+plen:]
+	if p, ok := h.users[user]; !ok || p != pass {
+		return []byte{0x01, 0x01}, errors.New("socks5: authentication failed for user " + user)
+	}
+	h.state = kHsSocksRequest
+	return []byte{0x01, 0x00}, nil
+}
+
+func (h *SocksServerHandshake) onRequest() (*SocksRequest, error) {
+	if len(h.in) < 4 {
+		return nil, errHandshakeNeedMore
+	}
+	if h.in[0] != kSocksVersion {
+		return nil, errors.New("socks5: invalid version")
+	}
+	host, port, n, err := ParseSocksAddr(h.in[3:])
+	if err != nil {
+		return nil, err
+	}
+	req := &SocksRequest{Cmd: h.in[1], Host: host, Port: port}
+	h.in = h.in[3+n:]
+	return req, nil
+}
+
+//SocksReply 生成应答, bound 为空时地址填 0.0.0.0:0
+func SocksReply(code byte, bound unix.Sockaddr) []byte {
+	return appendSocksIP([]byte{kSocksVersion, code, 0}, SockAddrIP(bound), SockAddrPort(bound))
+}
+
+//socksDialReply 按连接错误选择应答码
+func socksDialReply(err error) byte {
+	if err == unix.ECONNREFUSED {
+		return kSocksRepRefused
+	} else if err == unix.ETIMEDOUT || err == unix.EHOSTUNREACH || err == unix.ENETUNREACH {
+		return kSocksRepHostUnreach
+	}
+	return kSocksRepFailure
+}
+
+type destRule struct {
+	ipnet  *net.IPNet
+	domain string
+	port   int
+}
+
+//DestFilter SOCKS5目的地址白名单, 每项为 ip, cidr, 域名或 *.domain, 可带 :port 限制端口
+type DestFilter struct {
+	rules []destRule
+	nets  bool
+}
+
+//ParseDestFilter 解析白名单, 列表为空时返回nil表示不限制
+func ParseDestFilter(list []string) (*DestFilter, error) {
+	f := &DestFilter{}
+	for _, v := range list {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		rule, host := destRule{}, v
+		if h, p, err := net.SplitHostPort(v); err == nil {
+			if rule.port, err = strconv.Atoi(p); err != nil || rule.port <= 0 || rule.port > 65535 {
+				return nil, errors.New("invalid socks allow port: " + v)
+			}
+			host = h
+		}
+		if strings.Contains(host, "/") || net.ParseIP(host) != nil {
+			nets, err := ParseCIDRs([]string{host})
+			if err != nil {
+				return nil, err
+			}
+			rule.ipnet, f.nets = nets[0], true
+		} else {
+			rule.domain = strings.ToLower(strings.TrimSuffix(host, "."))
+		}
+		f.rules = append(f.rules, rule)
+	}
+	if len(f.rules) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+//AllowDomain 域名是否命中白名单, *.domain 只匹配子域名
+func (f *DestFilter) AllowDomain(host string, port int) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, r := range f.rules {
+		if r.domain == "" || (r.port != 0 && r.port != port) {
+			continue
+		}
+		if r.domain == host || (strings.HasPrefix(r.domain, "*.") && strings.HasSuffix(host, r.domain[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+//AllowIP ip是否命中白名单
+func (f *DestFilter) AllowIP(ip net.IP, port int) bool {
+	for _, r := range f.rules {
+		if r.ipnet != nil && (r.port == 0 || r.port == port) && r.ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//HasNets 白名单中是否有ip规则, 有时未命中域名规则的域名需要解析后按ip检查
+func (f *DestFilter) HasNets() bool {
+	return f.nets
+}
+
+//onSocks SOCKS5握手阶段: 认证后处理 CONNECT 或 UDP ASSOCIATE 请求
+func (th *TCPRelayHandler) onSocks() {
+	if th.socksReq != nil {
+		//等待解析目标, 之后的数据作为首包转发
+		return
+	}
+	out, req, rest, err := th.socks.Feed(th.pending)
+	th.pending = nil
+	th.writeToSock(th.localSocket, &out)
+	if err != nil {
+		log.Info("[tcp_handler] socks5 handshake from ", Addr2Str(th.srcAddr), " err: ", err)
+		th.Destroy()
+		return
+	} else if req == nil || th.localSocket == INVALID_SOCKET {
+		return
+	}
+	th.socksReq, th.pending = req, rest
+	log.Debug("[tcp_handler] socks5 request from ", Addr2Str(th.srcAddr), " cmd: ", req.Cmd, " ", req.Host, ":", req.Port)
+	switch req.Cmd {
+	case kSocksCmdConnect:
+		th.socksConnect()
+	case kSocksCmdUDP:
+		th.socksAssociate()
+	default:
+		th.socksFail(kSocksRepCmdNotSupp)
+	}
+}
+
+//socksConnect 检查目的地址白名单, 域名在需要时异步解析, 之后交给 TCPRelay.admit 连接
+func (th *TCPRelayHandler) socksConnect() {
+	req, filter := th.socksReq, th.server.socksAllow
+	ip := net.ParseIP(req.Host)
+	if ip != nil {
+		if filter != nil && !filter.AllowIP(ip, req.Port) {
+			th.socksDeny()
+			return
+		}
+		th.socksHandOver([]Backend{{Addr: ip.String(), Port: req.Port}})
+		return
+	}
+	matched := filter == nil || filter.AllowDomain(req.Host, req.Port)
+	if !matched && !filter.HasNets() {
+		th.socksDeny()
+		return
+	} else if matched && th.server.upstream != nil {
+		//经代理链转发时域名由代理解析
+		th.socksHandOver([]Backend{{Addr: req.Host, Port: req.Port, Host: req.Host}})
+		return
+	}
+	th.deadline = time.Now().Add(kConnTimeout + time.Duration(th.server.cfg.PeekTimeout)*time.Second)
+	ok := th.server.lookups.Lookup(th.eventLoop, req.Host, th.server.cfg.AddrFamily, func(ips []string, err error) {
+		th.socksResolved(ips, err, matched)
+	})
+	if !ok {
+		log.Warn("[tcp_handler] socks5 resolve queue full, drop request for ", req.Host)
+		th.socksFail(kSocksRepFailure)
+	}
+}
+
+//socksResolved 域名解析完成, 未命中域名规则时只保留白名单内的地址
+func (th *TCPRelayHandler) socksResolved(ips []string, err error, matched bool) {
+	if th.localSocket == INVALID_SOCKET {
+		return
+	}
+	req := th.socksReq
+	if err != nil || len(ips) == 0 {
+		log.Info("[tcp_handler] socks5 resolve ", req.Host, " err: ", err)
+		th.socksFail(kSocksRepHostUnreach)
+		return
+	}
+	backends := make([]Backend, 0, len(ips))
+	for _, ip := range ips {
+		if matched || th.server.socksAllow.AllowIP(net.ParseIP(ip), req.Port) {
+			backends = append(backends, Backend{Addr: ip, Port: req.Port, Host: req.Host})
+		}
+	}
+	if len(backends) == 0 {
+		th.socksDeny()
+		return
+	}
+	th.socksHandOver(backends)
+}
+
+func (th *TCPRelayHandler) socksHandOver(backends []Backend) {
+	th.socksReply = true
+	th.handOver(backends, th.pending)
+}
+
+func (th *TCPRelayHandler) socksDeny() {
+	log.Info("[tcp_handler] socks5 destination ", th.socksReq.Host, ":", th.socksReq.Port, " not allowed for ", Addr2Str(th.srcAddr))
+	th.socksFail(kSocksRepNotAllowed)
+}
+
+//socksFail 回复失败应答后关闭连接
+func (th *TCPRelayHandler) socksFail(code byte) {
+	reply := SocksReply(code, nil)
+	th.writeToSock(th.localSocket, &reply)
+	th.Destroy()
+}
+
+//socksAssociate 为客户端创建udp中继socket, 控制连接关闭时一并关闭
+func (th *TCPRelayHandler) socksAssociate() {
+	t := th.server
+	if t.acl != nil && th.srcIP != nil && !t.acl.Allowed(th.srcIP) {
+		log.Info("[tcp_relay] reject udp associate from: ", Addr2Str(th.srcAddr))
+		th.socksFail(kSocksRepNotAllowed)
+		return
+	} else if th.srcIP == nil || !t.limiter.AcquireUdp(th.srcIP) {
+		log.Debug("[tcp_relay] limit udp associate from: ", Addr2Str(th.srcAddr))
+		th.socksFail(kSocksRepNotAllowed)
+		return
+	}
+	assoc, err := newSocksUDP(th)
+	if err != nil {
+		t.limiter.ReleaseUdp(th.srcIP)
+		log.Warn("[tcp_handler] create socks5 udp relay err: ", err)
+		th.socksFail(kSocksRepFailure)
+		return
+	}
+	th.assoc, th.stage = assoc, kStageSocksUDP
+	delete(t.preludeHandler, th)
+	bound, _ := unix.Getsockname(assoc.sock)
+	reply := SocksReply(kSocksRepSuccess, bound)
+	th.writeToSock(th.localSocket, &reply)
+}
+
+//socksUDP 一个 UDP ASSOCIATE 会话: 只接收控制连接客户端ip发来的报文, 按报文头中的目的地址转发,
+//应答加上来源地址头后返回给客户端
+type socksUDP struct {
+	th       *TCPRelayHandler
+	sock     int
+	remote   map[int]int
+	client   unix.Sockaddr
+	resolved map[string]socksResolved
+	waiting  map[string][][]byte
+}
+
+//socksResolved 域名解析结果及过期时间
+type socksResolved struct {
+	ip     net.IP
+	expire time.Time
+}
+
+func newSocksUDP(th *TCPRelayHandler) (*socksUDP, error) {
+	local, err := unix.Getsockname(th.localSocket)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(SockAddrFamily(local), unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, SockAddrParse(SockAddrIP(local).String(), 0)); err != nil {
+		CloseSocket(fd)
+		return nil, err
+	}
+	SetNoBlock(fd)
+	s := &socksUDP{
+		th:       th,
+		sock:     fd,
+		remote:   make(map[int]int),
+		resolved: make(map[string]socksResolved),
+		waiting:  make(map[string][][]byte),
+	}
+	if err := th.eventLoop.Register(fd, kPollIn|kPollErr, s); err != nil {
+		CloseSocket(fd)
+		return nil, err
+	}
+	th.server.stats.add(&th.server.stats.UdpSessions)
+	th.server.stats.gauge(&th.server.stats.UdpActive, 1)
+	return s, nil
+}
+
+func (s *socksUDP) HandleEvent(fd, ev int) {
+	if Judge(ev & kPollErr) {
+		log.Warn("[tcp_handler] socks5 udp socket event err: ", fd, ev)
+		return
+	}
+	buf := make([]byte, kBuffSize)
+	n, sa, err := PacketRecv(fd, &buf)
+	if err != nil {
+		return
+	}
+	if fd == s.sock {
+		s.fromClient(buf[:n], sa)
+	} else {
+		s.fromRemote(buf[:n], sa)
+	}
+}
+
+//fromClient 处理客户端发来的报文, 不支持分片
+func (s *socksUDP) fromClient(pkt []byte, sa unix.Sockaddr) {
+	t := s.th.server
+	if !SockAddrIP(sa).Equal(s.th.srcIP) || len(pkt) < 4 || pkt[2] != 0 {
+		t.stats.add(&t.stats.UdpDropped)
+		return
+	}
+	host, port, n, err := ParseSocksAddr(pkt[3:])
+	if err != nil {
+		t.stats.add(&t.stats.UdpDropped)
+		return
+	}
+	if s.quotaExceeded() {
+		return
+	}
+	s.client, pkt = sa, pkt[3+n:]
+	if t.quota != nil {
+		t.quota.Add(s.th.srcIP, kStreamUp, len(pkt))
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		s.sendTo(ip, port, pkt, false)
+	} else if r, ok := s.resolved[host]; ok && time.Now().Before(r.expire) {
+		s.sendTo(r.ip, port, pkt, s.allowDomain(host, port))
+	} else if !s.allowDomain(host, port) && !t.socksAllow.HasNets() {
+		t.stats.add(&t.stats.UdpDropped)
+	} else if q, ok := s.waiting[host+":"+strconv.Itoa(port)]; ok {
+		if len(q) < kUdpAssocQueue {
+			s.waiting[host+":"+strconv.Itoa(port)] = append(q, pkt)
+		}
+	} else if len(s.waiting) >= kSocksResolveSize {
+		t.stats.add(&t.stats.UdpDropped)
+	} else {
+		s.resolve(host, port, pkt)
+	}
+}
+
+//remember 缓存解析结果, 已满时先清理过期项, 仍然已满时随机淘汰一个
+func (s *socksUDP) remember(host string, ip net.IP) {
+	now := time.Now()
+	if _, ok := s.resolved[host]; !ok && len(s.resolved) >= kSocksResolveSize {
+		for k, v := range s.resolved {
+			if now.After(v.expire) {
+				delete(s.resolved, k)
+			}
+		}
+		for k := range s.resolved {
+			if len(s.resolved) < kSocksResolveSize {
+				break
+			}
+			delete(s.resolved, k)
+		}
+	}
+	s.resolved[host] = socksResolved{ip: ip, expire: now.Add(kSocksResolveTTL)}
+}
+
+//resolve 异步解析域名, 解析期间的报文暂存
+func (s *socksUDP) resolve(host string, port int, pkt []byte) {
+	t, key := s.th.server, host+":"+strconv.Itoa(port)
+	ok := t.lookups.Lookup(s.th.eventLoop, host, t.cfg.AddrFamily, func(ips []string, err error) {
+		if s.sock == INVALID_SOCKET {
+			return
+		}
+		queued := s.waiting[key]
+		delete(s.waiting, key)
+		if err != nil || len(ips) == 0 {
+			log.Debug("[tcp_handler] socks5 udp resolve ", host, " err: ", err)
+			return
+		}
+		ip := net.ParseIP(ips[0])
+		s.remember(host, ip)
+		for _, pkt := range queued {
+			s.sendTo(ip, port, pkt, s.allowDomain(host, port))
+		}
+	})
+	if !ok {
+		log.Debug("[tcp_handler] socks5 resolve queue full, drop udp packet for ", host)
+		t.stats.add(&t.stats.UdpDropped)
+		return
+	}
+	s.waiting[key] = [][]byte{pkt}
+}
+
+//quotaExceeded 超出配额且动作为block时关闭控制连接, 中继随之关闭
+func (s *socksUDP) quotaExceeded() bool {
+	if q := s.th.server.quota; q == nil || q.Allow(s.th.srcIP) {
+		return false
+	}
+	log.Info("[tcp_handler] quota exceeded, close udp associate from: ", Addr2Str(s.th.srcAddr))
+	s.th.Destroy()
+	return true
+}
+
+func (s *socksUDP) allowDomain(host string, port int) bool {
+	allow := s.th.server.socksAllow
+	return allow == nil || allow.AllowDomain(host, port)
+}
+
+//sendTo 发往目标, allowed 为false时按ip检查白名单
+func (s *socksUDP) sendTo(ip net.IP, port int, pkt []byte, allowed bool) {
+	t := s.th.server
+	if !allowed && t.socksAllow != nil && !t.socksAllow.AllowIP(ip, port) {
+		t.stats.add(&t.stats.UdpDropped)
+		return
+	}
+	dst := SockAddrParse(ip.String(), port)
+	family := SockAddrFamily(dst)
+	fd, ok := s.remote[family]
+	if !ok {
+		var err error
+		if fd, err = CreateUdpRemoteSocket(family, t.cfg.RemoteSocketOpts(s.th.srcAddr)); err != nil {
+			log.Warn("[tcp_handler] create socks5 udp remote socket err: ", err)
+			return
+		}
+		s.remote[family] = fd
+		s.th.eventLoop.Register(fd, kPollIn|kPollErr, s)
+	}
+	if err := PacketSend(fd, &pkt, dst); err != nil {
+		log.Debug("[tcp_handler] socks5 udp send to ", Addr2Str(dst), " err: ", err)
+	}
+}
+
+//fromRemote 目标的应答加上来源地址头后返回客户端
+func (s *socksUDP) fromRemote(pkt []byte, sa unix.Sockaddr) {
+	if s.client == nil || s.quotaExceeded() {
+		return
+	}
+	if t := s.th.server; t.quota != nil {
+		t.quota.Add(s.th.srcIP, kStreamDown, len(pkt))
+	}
+	out := append(appendSocksIP([]byte{0, 0, 0}, SockAddrIP(sa), SockAddrPort(sa)), pkt...)
+	if err := PacketSend(s.sock, &out, s.client); err != nil {
+		log.Debug("[tcp_handler] socks5 udp send to client err: ", err)
+	}
+}
+
+func (s *socksUDP) Close() {
+	if s.sock == INVALID_SOCKET {
+		return
+	}
+	for _, fd := range s.remote {
+		s.th.eventLoop.UnRegister(fd)
+		CloseSocket(fd)
+	}
+	s.th.eventLoop.UnRegister(s.sock)
+	CloseSocket(s.sock)
+	s.sock = INVALID_SOCKET
+	s.th.server.limiter.ReleaseUdp(s.th.srcIP)
+	s.th.server.stats.gauge(&s.th.server.stats.UdpActive, -1)
+}
@@ -0,0 +1,39 @@
+package fdd
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSocksUDPResolvedBound(t *testing.T) {
+	s := &socksUDP{resolved: make(map[string]socksResolved)}
+	s.resolved["old.example"] = socksResolved{ip: net.IPv4(10, 0, 0, 1), expire: time.Now().Add(-time.Second)}
+	for i := 0; i < kSocksResolveSize*2; i++ {
+		s.remember("h"+strconv.Itoa(i)+".example", net.IPv4(10, 0, 0, byte(i)))
+	}
+	if len(s.resolved) != kSocksResolveSize {
+		t.Fatalf("resolved cache size %d, want %d", len(s.resolved), kSocksResolveSize)
+	}
+	if _, ok := s.resolved["old.example"]; ok {
+		t.Fatal("expired entry not pruned")
+	}
+	last := "h" + strconv.Itoa(kSocksResolveSize*2-1) + ".example"
+	if r, ok := s.resolved[last]; !ok || time.Until(r.expire) <= kSocksResolveTTL-time.Second {
+		t.Fatalf("latest entry missing or expiring early: %+v", r)
+	}
+}
+
+//TestLookupPoolBound 解析队列满时拒绝新的请求而不是创建更多协程
+func TestLookupPoolBound(t *testing.T) {
+	p := newLookupPool(0, 2)
+	for i := 0; i < 2; i++ {
+		if !p.Lookup(nil, "example.com", FamilyPreferV4, nil) {
+			t.Fatalf("lookup %d rejected", i)
+		}
+	}
+	if p.Lookup(nil, "example.com", FamilyPreferV4, nil) {
+		t.Fatal("lookup accepted beyond queue size")
+	}
+}
@@ -0,0 +1,200 @@
+package fdd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const kSpoofNetnsEnv = "FDD_SPOOF_NETNS"
+
+//TestSpoofSourceNetns 按README中的拓扑建立cl/fw/be三个network namespace, fw中运行 -spoof 转发,
+//检查be看到的tcp/udp对端地址为cl的地址, 需要root
+func TestSpoofSourceNetns(t *testing.T) {
+	if os.Getenv(kSpoofNetnsEnv) != "" {
+		runSpoofForwarder(t)
+		return
+	}
+	if testing.Short() {
+		t.Skip("skip netns test in short mode")
+	} else if os.Geteuid() != 0 {
+		t.Skip("netns test needs root")
+	} else if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip command not found")
+	}
+	suffix := fmt.Sprintf("%d", os.Getpid())
+	cl, fw, be := "fddcl"+suffix, "fddfw"+suffix, "fddbe"+suffix
+	if err := exec.Command("ip", "netns", "add", cl).Run(); err != nil {
+		t.Skip("netns unavailable: ", err)
+	}
+	defer func() {
+		for _, n := range []string{cl, fw, be} {
+			exec.Command("ip", "netns", "del", n).Run()
+		}
+	}()
+	for _, args := range [][]string{
+		{"netns", "add", fw},
+		{"netns", "add", be},
+		{"-n", cl, "link", "set", "lo", "up"},
+		{"-n", fw, "link", "set", "lo", "up"},
+		{"-n", be, "link", "set", "lo", "up"},
+		{"link", "add", "c0", "netns", cl, "type", "veth", "peer", "name", "c1", "netns", fw},
+		{"link", "add", "b0", "netns", be, "type", "veth", "peer", "name", "b1", "netns", fw},
+		{"-n", cl, "addr", "add", "10.1.0.2/24", "dev", "c0"},
+		{"-n", cl, "link", "set", "c0", "up"},
+		{"-n", cl, "route", "add", "default", "via", "10.1.0.1"},
+		{"-n", fw, "addr", "add", "10.1.0.1/24", "dev", "c1"},
+		{"-n", fw, "link", "set", "c1", "up"},
+		{"-n", fw, "addr", "add", "10.2.0.1/24", "dev", "b1"},
+		{"-n", fw, "link", "set", "b1", "up"},
+		{"-n", be, "addr", "add", "10.2.0.2/24", "dev", "b0"},
+		{"-n", be, "link", "set", "b0", "up"},
+		{"-n", be, "route", "add", "default", "via", "10.2.0.1"},
+		//后端发往客户端ip的回包交给fw本机
+		{"-n", fw, "rule", "add", "from", "10.2.0.2", "iif", "b1", "lookup", "100"},
+		{"-n", fw, "route", "add", "local", "0.0.0.0/0", "dev", "lo", "table", "100"},
+	} {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Skipf("ip %s: %v %s", strings.Join(args, " "), err, out)
+		}
+	}
+
+	//后端回复看到的对端ip
+	var ln net.Listener
+	var pc net.PacketConn
+	if err := inNetns(be, func() (err error) {
+		if ln, err = net.Listen("tcp4", "10.2.0.2:9100"); err != nil {
+			return err
+		}
+		pc, err = net.ListenPacket("udp4", "10.2.0.2:9100")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	defer pc.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(conn.RemoteAddr().(*net.TCPAddr).IP.String()))
+			conn.Close()
+		}
+	}()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			_, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo([]byte(addr.(*net.UDPAddr).IP.String()), addr)
+		}
+	}()
+
+	//转发进程整体运行在fw中, 事件循环中创建的socket都属于该namespace
+	var out bytes.Buffer
+	cmd := exec.Command("ip", "netns", "exec", fw, os.Args[0], "-test.run=^TestSpoofSourceNetns$")
+	cmd.Env, cmd.Stdout, cmd.Stderr = append(os.Environ(), kSpoofNetnsEnv+"=1"), &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Log(out.String())
+		}
+	}()
+
+	var tcpPeer, udpPeer string
+	err := inNetns(cl, func() error {
+		var err error
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			if tcpPeer, err = spoofProbe("tcp4"); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 5; i++ {
+			if udpPeer, err = spoofProbe("udp4"); err == nil {
+				break
+			}
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcpPeer != "10.1.0.2" || udpPeer != "10.1.0.2" {
+		t.Fatalf("backend saw tcp peer %q udp peer %q, want 10.1.0.2", tcpPeer, udpPeer)
+	}
+}
+
+//runSpoofForwarder 在fw中运行转发, 直到被父进程结束
+func runSpoofForwarder(t *testing.T) {
+	cfg := NewConfig("10.1.0.1", "10.2.0.2", 9001, 9100, 1024, 60)
+	cfg.SpoofSource = true
+	f := new(Fdd)
+	if err := f.Start(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	select {}
+}
+
+//spoofProbe 经fw连接后端, 返回后端看到的对端ip
+func spoofProbe(network string) (string, error) {
+	conn, err := net.DialTimeout(network, "10.1.0.1:9001", time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if network == "udp4" {
+		if _, err = conn.Write([]byte("ping")); err != nil {
+			return "", err
+		}
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		return string(buf[:n]), err
+	}
+	peer, err := ioutil.ReadAll(conn)
+	if err == nil && len(peer) == 0 {
+		err = fmt.Errorf("empty reply")
+	}
+	return string(peer), err
+}
+
+//inNetns 在切换到指定network namespace的线程上执行fn, fn中创建的socket属于该namespace;
+//线程不再解锁, goroutine退出后由运行时丢弃
+func inNetns(name string, fn func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		fd, err := unix.Open("/var/run/netns/"+name, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer unix.Close(fd)
+		if err = unix.Setns(fd, unix.CLONE_NEWNET); err != nil {
+			errc <- err
+			return
+		}
+		errc <- fn()
+	}()
+	return <-errc
+}
@@ -0,0 +1,114 @@
+package fdd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+)
+
+//Stats 运行统计, eventLoop线程写入, 其他协程可并发读取
+type Stats struct {
+	TcpAccepted   uint64
+	TcpRejected   uint64
+	TcpActive     int64
+	UdpSessions   uint64
+	UdpActive     int64
+	UdpDropped    uint64
+	ConnRateHits  uint64
+	TcpLimitHits  uint64
+	UdpLimitHits  uint64
+	GlobalTcpHits uint64
+	GlobalUdpHits uint64
+	MuxSessions   int64
+	MuxStreams    int64
+}
+
+func (s *Stats) add(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+func (s *Stats) gauge(v *int64, delta int64) {
+	atomic.AddInt64(v, delta)
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("tcp accepted=%d rejected=%d active=%d, udp sessions=%d active=%d dropped=%d, "+
+		"limit hits conn_rate=%d tcp_per_ip=%d udp_per_ip=%d tcp_global=%d udp_global=%d, mux sessions=%d streams=%d",
+		atomic.LoadUint64(&s.TcpAccepted), atomic.LoadUint64(&s.TcpRejected), atomic.LoadInt64(&s.TcpActive),
+		atomic.LoadUint64(&s.UdpSessions), atomic.LoadInt64(&s.UdpActive), atomic.LoadUint64(&s.UdpDropped),
+		atomic.LoadUint64(&s.ConnRateHits), atomic.LoadUint64(&s.TcpLimitHits), atomic.LoadUint64(&s.UdpLimitHits),
+		atomic.LoadUint64(&s.GlobalTcpHits), atomic.LoadUint64(&s.GlobalUdpHits),
+		atomic.LoadInt64(&s.MuxSessions), atomic.LoadInt64(&s.MuxStreams))
+}
+
+//StatsSnapshot 某一时刻的运行统计
+type StatsSnapshot struct {
+	TcpAccepted   uint64 `json:"tcp_accepted"`
+	TcpRejected   uint64 `json:"tcp_rejected"`
+	TcpActive     int64  `json:"tcp_active"`
+	UdpSessions   uint64 `json:"udp_sessions"`
+	UdpActive     int64  `json:"udp_active"`
+	UdpDropped    uint64 `json:"udp_dropped"`
+	ConnRateHits  uint64 `json:"conn_rate_hits"`
+	TcpLimitHits  uint64 `json:"tcp_limit_hits"`
+	UdpLimitHits  uint64 `json:"udp_limit_hits"`
+	GlobalTcpHits uint64 `json:"global_tcp_hits"`
+	GlobalUdpHits uint64 `json:"global_udp_hits"`
+	MuxSessions   int64  `json:"mux_sessions"`
+	MuxStreams    int64  `json:"mux_streams"`
+}
+
+//Snapshot 返回各计数器当前值的副本, 可在任意协程调用
+func (s *Stats) Snapshot() StatsSnapshot {
+	return StatsSnapshot{
+		TcpAccepted:   atomic.LoadUint64(&s.TcpAccepted),
+		TcpRejected:   atomic.LoadUint64(&s.TcpRejected),
+		TcpActive:     atomic.LoadInt64(&s.TcpActive),
+		UdpSessions:   atomic.LoadUint64(&s.UdpSessions),
+		UdpActive:     atomic.LoadInt64(&s.UdpActive),
+		UdpDropped:    atomic.LoadUint64(&s.UdpDropped),
+		ConnRateHits:  atomic.LoadUint64(&s.ConnRateHits),
+		TcpLimitHits:  atomic.LoadUint64(&s.TcpLimitHits),
+		UdpLimitHits:  atomic.LoadUint64(&s.UdpLimitHits),
+		GlobalTcpHits: atomic.LoadUint64(&s.GlobalTcpHits),
+		GlobalUdpHits: atomic.LoadUint64(&s.GlobalUdpHits),
+		MuxSessions:   atomic.LoadInt64(&s.MuxSessions),
+		MuxStreams:    atomic.LoadInt64(&s.MuxStreams),
+	}
+}
+
+//ServeStats 在addr上提供统计接口: /stats 返回json, /metrics 为 Prometheus 文本格式, 指标名为 fdd_ 加json字段名
+func ServeStats(addr string, stats *Stats) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats.Snapshot())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		snap := stats.Snapshot()
+		v, t := reflect.ValueOf(snap), reflect.TypeOf(snap)
+		for i := 0; i < t.NumField(); i++ {
+			name, kind := "fdd_"+t.Field(i).Tag.Get("json"), "gauge"
+			if t.Field(i).Type.Kind() == reflect.Uint64 {
+				name, kind = name+"_total", "counter"
+			}
+			fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, kind, name, v.Field(i).Interface())
+		}
+	})
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Warn("[stats] serve stats err: ", err)
+		}
+	}()
+	log.Info("[stats] serve stats on: ", ln.Addr())
+	return srv, nil
+}
@@ -0,0 +1,85 @@
+package fdd
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+//StreamCodec 对连接一侧的字节流编解码(如TLS), 由 TCPRelayHandler 在eventLoop线程中以非阻塞方式调用
+type StreamCodec interface {
+	//Decode 输入从socket读到的数据, 返回已解出的明文, 对端正常关闭时返回 io.EOF
+	Decode(in []byte) ([]byte, error)
+	//Encode 编码明文, 结果通过 Output 取出
+	Encode(plain []byte) error
+	//Output 取出需要写入socket的数据
+	Output() []byte
+	//SetNotify 设置异步事件(如握手超时)的回调, 回调在eventLoop线程中执行
+	SetNotify(fn func(err error))
+	Close()
+}
+
+//wouldBlockError 内存连接暂无数据, 实现 net.Error 且为临时错误, crypto/tls 不会将其记为连接错误
+type wouldBlockError struct{}
+
+func (wouldBlockError) Error() string   { return "codec: would block" }
+func (wouldBlockError) Timeout() bool   { return true }
+func (wouldBlockError) Temporary() bool { return true }
+
+var errWouldBlock net.Error = wouldBlockError{}
+
+//memConn 以内存缓冲实现 net.Conn, 供 crypto/tls 等基于net.Conn的实现与eventLoop中的非阻塞socket对接,
+//无数据时返回 errWouldBlock
+type memConn struct {
+	in     []byte
+	out    []byte
+	closed bool
+}
+
+func (c *memConn) Read(p []byte) (int, error) {
+	if len(c.in) == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		return 0, errWouldBlock
+	}
+	n := copy(p, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+func (c *memConn) Write(p []byte) (int, error) {
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	c.out = append(c.out, p...)
+	return len(p), nil
+}
+
+//feed 追加从socket读到的数据
+func (c *memConn) feed(p []byte) {
+	c.in = append(c.in, p...)
+}
+
+//take 取出待写入socket的数据
+func (c *memConn) take() []byte {
+	out := c.out
+	c.out = nil
+	return out
+}
+
+func (c *memConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr                { return memAddr{} }
+func (c *memConn) RemoteAddr() net.Addr               { return memAddr{} }
+func (c *memConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type memAddr struct{}
+
+func (memAddr) Network() string { return "mem" }
+func (memAddr) String() string  { return "mem" }
@@ -1,33 +1,176 @@
 package fdd
 
 import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
 	"github.com/rocinan/fdd/poller"
 	"golang.org/x/sys/unix"
 )
 
 type TCPRelay struct {
-	localSocket int
+	localSockets map[string]int
 
-	cfg           *Config
-	eventLoop     *poller.EventLoop
-	socketHandler map[int]*TCPRelayHandler
+	cfg              *Config
+	acl              *ACL
+	stats            *Stats
+	limiter          *Limiter
+	shaper           *Shaper
+	quota            *Quota
+	dnsCache         *DNSCache
+	hostAddrs        *HostAddrs
+	proxyTrusted     []*net.IPNet
+	tls              *TLSServer
+	tlsClient        *TLSClient
+	upstream         *Upstream
+	tunnel           *Tunnel
+	mux              *Mux
+	socksUsers       map[string]string
+	socksAllow       *DestFilter
+	lookups          *lookupPool
+	router           IRouter
+	eventLoop        *poller.EventLoop
+	socketHandler    map[int]*TCPRelayHandler
+	pausedHandler    map[*TCPRelayHandler]struct{}
+	preludeHandler   map[*TCPRelayHandler]struct{}
+	handshakeHandler map[*TCPRelayHandler]time.Time
 }
 
-func NewTCPRelay(cfg *Config) (*TCPRelay, error) {
-	if fd, err := CreateTcpListenSocket(cfg.ListenAddr, cfg.ListenPort); err != nil {
+func NewTCPRelay(cfg *Config, stats *Stats, limiter *Limiter) (*TCPRelay, error) {
+	trusted, err := ParseCIDRs(cfg.ProxyTrusted)
+	if err != nil {
 		return nil, err
-	} else {
-		return &TCPRelay{
-			cfg:           cfg,
-			localSocket:   fd,
-			socketHandler: make(map[int]*TCPRelayHandler, cfg.HandlerCap),
-		}, nil
+	}
+	t := &TCPRelay{
+		cfg:              cfg,
+		stats:            stats,
+		limiter:          limiter,
+		localSockets:     make(map[string]int),
+		proxyTrusted:     trusted,
+		socketHandler:    make(map[int]*TCPRelayHandler, cfg.HandlerCap),
+		pausedHandler:    make(map[*TCPRelayHandler]struct{}),
+		preludeHandler:   make(map[*TCPRelayHandler]struct{}),
+		handshakeHandler: make(map[*TCPRelayHandler]time.Time),
+	}
+	if t.router, err = NewRouter(cfg); err != nil {
+		return nil, err
+	}
+	if t.socksUsers, err = ParseSocksUsers(cfg.SocksUsers); err != nil {
+		return nil, err
+	} else if t.socksAllow, err = ParseDestFilter(cfg.SocksAllow); err != nil {
+		return nil, err
+	}
+	if err := t.SyncListeners(); err != nil {
+		t.closeListeners()
+		return nil, err
+	}
+	if cfg.SocksServer {
+		t.lookups = newLookupPool(kLookupWorkers, kLookupQueue)
+	}
+	return t, nil
+}
+
+//listen 在addr上创建监听socket, tproxy模式下设置 IP_TRANSPARENT
+func (t *TCPRelay) listen(addr string) (int, error) {
+	if path, _, ok := UnixPath(addr); ok {
+		return CreateUnixListenSocket(path, unix.SOCK_STREAM, t.cfg.UnixMode, t.cfg.UnixOwner, t.cfg.Tuning)
+	}
+	fd, err := CreateTcpListenSocket(addr, t.cfg.ListenPort, t.cfg.Tuning)
+	if err != nil {
+		return 0, err
+	}
+	if t.cfg.Transparent == TransparentTProxy {
+		if sa, err := unix.Getsockname(fd); err != nil || SetTransparent(fd, SockAddrFamily(sa)) != nil {
+			CloseSocket(fd)
+			return 0, errors.New("set transparent on " + addr + " failed")
+		}
+	}
+	return fd, nil
+}
+
+//SyncListeners 按 ListenAddr 当前解析出的地址新增或关闭监听socket, 已建立的连接不受影响
+func (t *TCPRelay) SyncListeners() error {
+	addrs, err := ResolveListenAddrs(t.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	add, remove := diffListenAddrs(t.localSockets, addrs)
+	for _, addr := range remove {
+		log.Info("[tcp_relay] stop listen on: ", addr)
+		t.closeListener(addr)
+	}
+	//单个地址失败不影响其他地址, 返回最后一个错误
+	err = nil
+	for _, addr := range add {
+		fd, lerr := t.listen(addr)
+		if lerr != nil {
+			err = errors.New("listen on " + addr + " err: " + lerr.Error())
+			continue
+		}
+		t.localSockets[addr] = fd
+		if t.eventLoop != nil {
+			t.eventLoop.Register(fd, kPollIn|kPollErr, t)
+		}
+		log.Info("[tcp_relay] listen on: ", addr)
+	}
+	if len(t.localSockets) == 0 {
+		log.Warn("[tcp_relay] no address to listen on: ", t.cfg.ListenAddr)
+	}
+	return err
+}
+
+func (t *TCPRelay) closeListener(addr string) {
+	fd := t.localSockets[addr]
+	if t.eventLoop != nil {
+		t.eventLoop.UnRegister(fd)
+	}
+	CloseSocket(fd)
+	RemoveUnixSocket(addr)
+	delete(t.localSockets, addr)
+}
+
+func (t *TCPRelay) closeListeners() {
+	for addr := range t.localSockets {
+		t.closeListener(addr)
 	}
 }
 
 func (t *TCPRelay) AddToLoop(ep *poller.EventLoop) error {
 	t.eventLoop = ep
-	return t.eventLoop.Register(t.localSocket, kPollIn|kPollErr, t)
+	t.eventLoop.AddTicker(t)
+	for _, fd := range t.localSockets {
+		if err := t.eventLoop.Register(fd, kPollIn|kPollErr, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//HandleTick 令牌补充后恢复因限速暂停读取的连接, 检查预处理阶段和TLS握手超时
+func (t *TCPRelay) HandleTick(now time.Time) {
+	for th := range t.pausedHandler {
+		if th.resume() {
+			delete(t.pausedHandler, th)
+		}
+	}
+	for th := range t.preludeHandler {
+		if th.stage == kStageDial {
+			th.dialer.Tick(now)
+		} else if now.After(th.deadline) {
+			th.onPreludeTimeout()
+		}
+	}
+	for th, deadline := range t.handshakeHandler {
+		if !th.handshaking() {
+			delete(t.handshakeHandler, th)
+		} else if now.After(deadline) {
+			log.Info("[tcp_handler] tls handshake timeout, close conn from: ", Addr2Str(th.srcAddr))
+			th.Destroy()
+		}
+	}
 }
 
 func (t *TCPRelay) HandleEvent(fd, ev int) {
@@ -35,28 +178,224 @@ func (t *TCPRelay) HandleEvent(fd, ev int) {
 		log.Warn("[tcp_relay] invalid tcp listen socket")
 	} else if ev == kPollErr {
 		log.Warn("[tcp_relay] handle event poll err: ", fd, ev)
-		defer t.Close()
+		for addr, lfd := range t.localSockets {
+			if lfd == fd {
+				t.closeListener(addr)
+			}
+		}
 		return
 	}
-	if cfd, err := AcceptTcpConn(fd); err != nil {
+	if cfd, sa, err := AcceptTcpConn(fd); err != nil {
 		log.Error("[tcp_relay] accept new tcp conn error: ", err)
 		return
 	} else {
-		defer SetNoBlock(cfd)
-		if rfd, err := CreateRemoteSocket(t.cfg.RemoteAddr, t.cfg.RemotePort); err != nil {
-			log.Warn("[tcp_relay] create new tcp conn error: ", err)
-		} else {
-			tcpRelayHandler := NewTCPRelayHandler(cfd, rfd, t, t.eventLoop)
-			if err := t.eventLoop.Register(cfd, kPollIn|kPollErr, tcpRelayHandler); err != nil {
-				log.Warn("[tcp_relay] reg new local conn err: ", err)
-				return
+		if SockAddrFamily(sa) != unix.AF_UNIX {
+			if err := t.cfg.Tuning.applyConn(cfd); err != nil {
+				log.Warn("[tcp_relay] set conn socket option err: ", err)
 			}
-			if err := t.eventLoop.Register(rfd, kPollIn|kPollErr, tcpRelayHandler); err != nil {
-				log.Warn("[tcp_relay] reg new remote conn err: ", err)
+		}
+		if t.mux != nil && t.mux.server {
+			t.acceptMux(cfd, sa)
+			return
+		}
+		stage := kStageRelay
+		if t.cfg.ProxyProtocolIn != "" && t.trusted(SockAddrIP(sa)) {
+			stage = kStageProxyHeader
+		} else if t.cfg.ProxyProtocolIn == ProxyInRequire {
+			log.Info("[tcp_relay] untrusted proxy source, reject conn from: ", Addr2Str(sa))
+			t.reject(cfd, t.cfg.AclReset)
+			return
+		} else if t.cfg.SocksServer {
+			stage = kStageSocks
+		} else if t.router != nil {
+			stage = kStageRoute
+		}
+		if stage == kStageRelay {
+			t.admit(cfd, sa, nil, nil, false, false)
+			return
+		}
+		//除PROXY头外客户端地址已确定, 在读取SOCKS5握手或路由数据之前执行访问控制和限流
+		acquired := stage != kStageProxyHeader
+		if acquired {
+			if ok, reset := t.acquire(sa); !ok {
+				t.reject(cfd, reset)
 				return
 			}
-			t.socketHandler[cfd] = tcpRelayHandler
 		}
+		SetNoBlock(cfd)
+		th := NewTCPRelayHandler(cfd, INVALID_SOCKET, sa, t, t.eventLoop)
+		th.admitted = acquired
+		th.enterStage(stage)
+		if err := t.eventLoop.Register(cfd, kPollIn|kPollErr, th); err != nil {
+			log.Warn("[tcp_relay] reg new local conn err: ", err)
+			th.Destroy()
+			return
+		}
+		t.socketHandler[cfd] = th
+		t.preludeHandler[th] = struct{}{}
+	}
+}
+
+//acceptMux 多路复用服务端的连接经访问控制后交给 Mux, 其上的每个流再经 admit 连接目标
+func (t *TCPRelay) acceptMux(cfd int, sa unix.Sockaddr) {
+	if ip := SockAddrIP(sa); t.acl != nil && ip != nil && !t.acl.Allowed(ip) {
+		log.Info("[tcp_relay] reject mux conn from: ", Addr2Str(sa))
+		t.reject(cfd, t.cfg.AclReset)
+		return
+	}
+	SetNoBlock(cfd)
+	t.mux.Accept(cfd, sa)
+}
+
+//trusted 判断来源是否允许携带PROXY头, 未配置信任列表时信任所有来源
+func (t *TCPRelay) trusted(ip net.IP) bool {
+	return TrustedIP(t.proxyTrusted, ip)
+}
+
+//acquire 以客户端地址 sa 执行访问控制、配额检查并申请连接数, 失败时返回false, reset 表示应以RST拒绝
+func (t *TCPRelay) acquire(sa unix.Sockaddr) (ok bool, reset bool) {
+	ip := SockAddrIP(sa)
+	//unix socket客户端没有ip, 由socket文件权限控制访问
+	if t.acl != nil && ip != nil && !t.acl.Allowed(ip) {
+		log.Info("[tcp_relay] reject conn from: ", Addr2Str(sa))
+		return false, t.cfg.AclReset
+	}
+	if t.quota != nil && !t.quota.Allow(ip) {
+		log.Debug("[tcp_relay] quota exceeded, reject conn from: ", Addr2Str(sa))
+		return false, false
+	}
+	if !t.limiter.AcquireTcp(ip) {
+		log.Debug("[tcp_relay] limit conn from: ", Addr2Str(sa))
+		return false, false
+	}
+	t.stats.gauge(&t.stats.TcpActive, 1)
+	return true, false
+}
+
+//release 释放 acquire 申请的连接数
+func (t *TCPRelay) release(ip net.IP) {
+	t.limiter.ReleaseTcp(ip)
+	t.stats.gauge(&t.stats.TcpActive, -1)
+}
+
+//admit 以客户端地址 sa 执行访问控制、限流并连接后端, acquired 为true时预处理阶段已通过检查并持有连接数,
+//dst 为PROXY头中的原始目的地址, backends 为路由选中的后端, 为空时使用默认目标,
+//socks 为true时向客户端回复SOCKS5连接结果, pending 为已读取的首包数据, 成功后转发给后端
+func (t *TCPRelay) admit(cfd int, sa, dst unix.Sockaddr, backends []Backend, socks, acquired bool, pending ...[]byte) {
+	if !acquired {
+		if ok, reset := t.acquire(sa); !ok {
+			t.reject(cfd, reset)
+			return
+		}
+	}
+	if len(backends) == 0 && t.cfg.Transparent != "" {
+		target, err := t.transparentTarget(cfd)
+		if err != nil {
+			log.Info("[tcp_relay] get original dst from ", Addr2Str(sa), " err: ", err)
+			t.release(SockAddrIP(sa))
+			t.reject(cfd, false)
+			return
+		}
+		backends = []Backend{target}
+	} else if len(backends) == 0 {
+		backends = t.cfg.RemoteBackends()
+	}
+	SetNoBlock(cfd)
+	th := NewTCPRelayHandler(cfd, INVALID_SOCKET, sa, t, t.eventLoop)
+	th.admitted, th.dstAddr, th.socksReply = true, dst, socks
+	t.socketHandler[cfd] = th
+	th.dial(OrderBackends(backends), pending...)
+}
+
+//dial 连接后端: 多路复用客户端在已有连接上打开一个流并携带客户端地址, 配置了代理链时连接第一跳代理, 否则直接连接后端,
+//连接过程由 Dialer 在eventLoop中完成, 期间处于 kStageDial 阶段且不读取本地连接
+func (th *TCPRelayHandler) dial(backends []Backend, pending ...[]byte) {
+	t := th.server
+	th.target, th.pending = backends[0], nil
+	for _, data := range pending {
+		th.pending = append(th.pending, data...)
+	}
+	if t.mux != nil && !t.mux.server {
+		dst := th.dstAddr
+		if dst == nil {
+			dst, _ = unix.Getsockname(th.localSocket)
+		}
+		fd, err := t.mux.Open(kMuxStreamTCP, th.srcAddr, dst)
+		th.dialed(fd, backends[0], err)
+		return
+	}
+	dial := backends
+	if t.upstream != nil {
+		dial = []Backend{t.upstream.First()}
+	}
+	th.stage = kStageDial
+	t.preludeHandler[th] = struct{}{}
+	th.dialer = NewDialer(th.eventLoop, dial, t.cfg.RemoteSocketOpts(th.srcAddr), th.dialed)
+	th.dialer.Start()
+}
+
+//dialed 后端连接完成, 成功时开始与代理链握手或进入转发阶段
+func (th *TCPRelayHandler) dialed(rfd int, backend Backend, err error) {
+	t := th.server
+	th.dialer = nil
+	delete(t.preludeHandler, th)
+	if err != nil {
+		log.Warn("[tcp_relay] create new tcp conn error: ", err)
+		if th.socksReply {
+			reply := SocksReply(socksDialReply(err), nil)
+			th.writeToSock(th.localSocket, &reply)
+		}
+		th.Destroy()
+		return
+	}
+	t.stats.add(&t.stats.TcpAccepted)
+	th.remoteSocket, th.flow.remoteSocket = rfd, rfd
+	if err := th.eventLoop.Register(rfd, kPollIn|kPollErr, th); err != nil {
+		log.Warn("[tcp_relay] reg new remote conn err: ", err)
+		th.Destroy()
+		return
+	}
+	pending := th.pending
+	th.stage, th.pending = kStageRelay, nil
+	if t.upstream != nil {
+		//经代理链连接目标, 握手完成前不读取本地连接
+		th.startUpstream(th.target, pending)
+		return
+	}
+	th.startRelay(backend, pending)
+}
+
+//transparentTarget 透明代理模式下根据原始目的地址确定转发目标, 未经重定向直接访问监听端口的连接视为环路
+func (t *TCPRelay) transparentTarget(cfd int) (Backend, error) {
+	dst, err := OriginalDst(cfd, t.cfg.Transparent)
+	if err != nil {
+		return Backend{}, err
+	}
+	target, mapped := t.cfg.TransparentTarget(dst)
+	if !mapped && target.Port == t.cfg.ListenPort && t.hostAddrs.IsLocal(SockAddrIP(dst)) {
+		return Backend{}, errors.New("not redirected, loop to " + Addr2Str(dst))
+	}
+	log.Debug("[tcp_relay] original dst: ", Addr2Str(dst), " => ", net.JoinHostPort(target.Addr, strconv.Itoa(target.Port)))
+	return target, nil
+}
+
+func (t *TCPRelay) reject(fd int, reset bool) {
+	t.stats.add(&t.stats.TcpRejected)
+	if reset {
+		ResetSocket(fd)
+	} else {
+		CloseSocket(fd)
+	}
+}
+
+//onHandlerDestroy 连接关闭后释放配额
+func (t *TCPRelay) onHandlerDestroy(th *TCPRelayHandler) {
+	delete(t.socketHandler, th.localSocket)
+	delete(t.pausedHandler, th)
+	delete(t.preludeHandler, th)
+	delete(t.handshakeHandler, th)
+	if th.admitted {
+		t.release(th.srcIP)
 	}
 }
 
@@ -65,28 +404,358 @@ func (t *TCPRelay) Close() {
 		v.Destroy()
 		delete(t.socketHandler, k)
 	}
-	t.eventLoop.UnRegister(t.localSocket)
-	if t.localSocket != INVALID_SOCKET {
-		CloseSocket(t.localSocket)
+	t.closeListeners()
+	if t.lookups != nil {
+		t.lookups.Close()
 	}
 	log.Info("[tcp_relay] tcp relay service exit.")
 }
 
+const (
+	kStageRelay = iota
+	kStageProxyHeader
+	kStageRoute
+	kStageUpstream
+	kStageSocks
+	kStageSocksUDP
+	kStageDial
+)
+
 type TCPRelayHandler struct {
 	localSocket  int
 	remoteSocket int
+	srcAddr      unix.Sockaddr
+	srcIP        net.IP
+	dstAddr      unix.Sockaddr
+	flowLimit    rateLimit
+	paused       [2]bool
+	admitted     bool
+	localCodec   StreamCodec
+	remoteCodec  StreamCodec
+
+	stage     int
+	pending   []byte
+	deadline  time.Time
+	handshake *ProxyHandshake
+	target    Backend
+	dialer    *Dialer
+
+	socks      *SocksServerHandshake
+	socksReq   *SocksRequest
+	socksReply bool
+	assoc      *socksUDP
 
 	flow      *Flow
+	server    *TCPRelay
 	eventLoop *poller.EventLoop
 }
 
-func NewTCPRelayHandler(ls, rs int, ser *TCPRelay, ep *poller.EventLoop) *TCPRelayHandler {
-	return &TCPRelayHandler{
+func NewTCPRelayHandler(ls, rs int, src unix.Sockaddr, ser *TCPRelay, ep *poller.EventLoop) *TCPRelayHandler {
+	th := &TCPRelayHandler{
 		localSocket:  ls,
 		remoteSocket: rs,
+		srcAddr:      src,
+		srcIP:        SockAddrIP(src),
 		flow:         NewFlow(ls, rs, ep),
+		server:       ser,
 		eventLoop:    ep,
 	}
+	if ser.shaper != nil {
+		th.flowLimit = ser.shaper.NewFlowLimit()
+	}
+	return th
+}
+
+//startRelay 后端连接可用后创建编解码器、开始读取本地连接并进入转发阶段, backend 为最终目标
+func (th *TCPRelayHandler) startRelay(backend Backend, pending ...[]byte) {
+	t := th.server
+	if t.tls != nil {
+		th.localCodec = t.tls.NewCodec(th.eventLoop)
+		th.localCodec.SetNotify(th.onLocalCodecEvent)
+	}
+	if t.tlsClient != nil {
+		th.remoteCodec = t.tlsClient.NewCodec(th.eventLoop, backend)
+		th.remoteCodec.SetNotify(th.onRemoteCodecEvent)
+	}
+	if th.handshaking() {
+		t.handshakeHandler[th] = time.Now().Add(kTLSHandshakeTimeout)
+	}
+	if t.tunnel != nil && t.tunnel.server {
+		th.localCodec = t.tunnel.NewCodec(th.eventLoop)
+		th.localCodec.SetNotify(th.onLocalCodecEvent)
+	} else if t.tunnel != nil {
+		th.remoteCodec = t.tunnel.NewCodec(th.eventLoop)
+		th.remoteCodec.SetNotify(th.onRemoteCodecEvent)
+	}
+	if th.localCodec == nil && t.dnsCache != nil {
+		th.localCodec = t.dnsCache.NewStreamCodec()
+	}
+	if err := th.eventLoop.Register(th.localSocket, kPollIn|kPollErr, th); err != nil {
+		log.Warn("[tcp_handler] reg new local conn err: ", err)
+		th.Destroy()
+		return
+	}
+	if th.socksReply {
+		bound, _ := unix.Getsockname(th.remoteSocket)
+		reply := SocksReply(kSocksRepSuccess, bound)
+		th.writeToSock(th.localSocket, &reply)
+	}
+	th.connected(th.dstAddr, pending...)
+}
+
+//connected 后端连接建立后按需发送PROXY头和首包数据, dst为空时使用本地监听地址
+func (th *TCPRelayHandler) connected(dst unix.Sockaddr, pending ...[]byte) {
+	if th.server.cfg.ProxyProtocol != 0 {
+		if dst == nil {
+			dst, _ = unix.Getsockname(th.localSocket)
+		}
+		header := BuildProxyHeader(th.server.cfg.ProxyProtocol, th.srcAddr, dst, false)
+		if _, ok := th.remoteCodec.(*tunnelCodec); ok {
+			//隧道服务端把解密后的字节流原样转发给目标, PROXY头作为第一段明文加密发送
+			th.toRemote(header)
+		} else {
+			//TLS连接的PROXY头按惯例在握手之前以明文发送
+			th.writeToSock(th.remoteSocket, &header)
+		}
+	}
+	if th.remoteCodec != nil {
+		//编解码器可能需要先发送数据(如隧道的 salt 和 hello)
+		th.flushCodec(th.remoteSocket, th.remoteCodec)
+	}
+	for _, data := range pending {
+		if len(data) != 0 {
+			th.consumed(kStreamUp, len(data))
+			th.fromLocal(data)
+		}
+	}
+}
+
+//startUpstream 与代理链握手, 完成后以 target 为最终目标进入转发阶段
+func (th *TCPRelayHandler) startUpstream(target Backend, pending ...[]byte) {
+	th.stage, th.target, th.pending = kStageUpstream, target, nil
+	for _, data := range pending {
+		th.pending = append(th.pending, data...)
+	}
+	th.deadline = time.Now().Add(kConnTimeout)
+	th.server.preludeHandler[th] = struct{}{}
+	th.handshake = th.server.upstream.NewHandshake(target, false)
+	out := th.handshake.Start()
+	th.writeToSock(th.remoteSocket, &out)
+}
+
+//onUpstream 读取代理的握手应答, 握手之后已读到的数据交给 fromRemote
+func (th *TCPRelayHandler) onUpstream() {
+	buf := make([]byte, kDownStreamBufSize)
+	n, err := BufferRecv(th.remoteSocket, &buf)
+	if err == unix.EAGAIN {
+		return
+	} else if err != nil || n <= 0 {
+		log.Warn("[tcp_handler] upstream closed during handshake, err: ", err)
+		th.upstreamFail()
+		return
+	}
+	out, done, rest, err := th.handshake.Feed(buf[:n])
+	if err != nil {
+		log.Warn("[tcp_handler] upstream handshake to ", th.target.Addr, ":", th.target.Port, " err: ", err)
+		th.upstreamFail()
+		return
+	}
+	th.writeToSock(th.remoteSocket, &out)
+	if !done || th.remoteSocket == INVALID_SOCKET {
+		return
+	}
+	log.Debug("[tcp_handler] upstream connected to ", th.target.Addr, ":", th.target.Port)
+	pending := th.pending
+	th.stage, th.handshake, th.pending = kStageRelay, nil, nil
+	delete(th.server.preludeHandler, th)
+	th.startRelay(th.target, pending)
+	if len(rest) != 0 && th.remoteSocket != INVALID_SOCKET {
+		th.consumed(kStreamDown, len(rest))
+		th.fromRemote(rest)
+	}
+}
+
+//enterStage 进入预处理阶段并设置超时
+func (th *TCPRelayHandler) enterStage(stage int) {
+	th.stage = stage
+	if stage == kStageSocks {
+		th.socks = NewSocksServerHandshake(th.server.socksUsers)
+	}
+	timeout := th.server.cfg.PeekTimeout
+	if stage == kStageProxyHeader {
+		timeout = th.server.cfg.ProxyHeaderTimeout
+	}
+	th.deadline = time.Now().Add(time.Duration(timeout) * time.Second)
+}
+
+//upstreamFail 代理链握手失败, SOCKS5客户端先收到失败应答
+func (th *TCPRelayHandler) upstreamFail() {
+	if th.socksReply {
+		th.socksFail(kSocksRepFailure)
+		return
+	}
+	th.Destroy()
+}
+
+//onPrelude 连接后端前非阻塞读取首部数据, 依次解析PROXY头、SOCKS5握手和执行路由
+func (th *TCPRelayHandler) onPrelude() {
+	buf := make([]byte, kUpStreamBufSize)
+	n, err := BufferRecv(th.localSocket, &buf)
+	if err == unix.EAGAIN {
+		return
+	} else if err != nil || n <= 0 {
+		if err != nil {
+			log.Warn("[tcp_handler]: on prelude read err: ", err)
+		}
+		th.Destroy()
+		return
+	}
+	if th.stage == kStageSocksUDP {
+		//UDP ASSOCIATE 的控制连接不再有数据, 只等待关闭
+		return
+	}
+	th.pending = append(th.pending, buf[:n]...)
+	if th.stage == kStageRoute {
+		th.route(false)
+		return
+	} else if th.stage == kStageSocks {
+		th.onSocks()
+		return
+	}
+	src, dst, consumed, err := ParseProxyHeader(th.pending)
+	if err == errProxyNeedMore {
+		return
+	} else if err != nil || (consumed == 0 && th.server.cfg.ProxyProtocolIn == ProxyInRequire) {
+		log.Info("[tcp_handler] invalid proxy header from: ", Addr2Str(th.srcAddr))
+		th.Destroy()
+		return
+	}
+	if src != nil {
+		log.Debug("[tcp_handler] proxy header from ", Addr2Str(th.srcAddr), ", client: ", Addr2Str(src))
+		th.srcAddr, th.srcIP = src, SockAddrIP(src)
+	}
+	th.dstAddr, th.pending = dst, th.pending[consumed:]
+	th.proxyHeaderDone()
+}
+
+//proxyHeaderDone PROXY头处理完成, SOCKS5模式下开始握手, 配置了路由时进入路由阶段
+func (th *TCPRelayHandler) proxyHeaderDone() {
+	if th.server.cfg.SocksServer || th.server.router != nil {
+		//客户端地址已确定, 进入SOCKS5握手或路由阶段前执行访问控制和限流
+		if ok, reset := th.server.acquire(th.srcAddr); !ok {
+			th.refuse(reset)
+			return
+		}
+		th.admitted = true
+	}
+	if th.server.cfg.SocksServer {
+		th.enterStage(kStageSocks)
+		th.onSocks()
+		return
+	} else if th.server.router == nil {
+		th.handOver(nil, th.pending)
+		return
+	}
+	th.enterStage(kStageRoute)
+	th.route(false)
+}
+
+//route 根据已读取的数据选择后端, final 为true时不再等待更多数据
+func (th *TCPRelayHandler) route(final bool) {
+	backends, out, err := th.server.router.Route(th.pending, th.srcAddr, final || len(th.pending) >= kMaxPeekSize)
+	if err == errRouteNeedMore {
+		return
+	} else if err == nil && len(backends) == 0 && !th.server.cfg.HasDefaultTarget() {
+		err = errRouteNoMatch
+	}
+	if err != nil {
+		log.Info("[tcp_handler] route conn from ", Addr2Str(th.srcAddr), " err: ", err)
+		th.Destroy()
+		return
+	}
+	th.handOver(backends, out)
+}
+
+//onPreludeTimeout 预处理超时: 等待PROXY头超时时accept模式下按无头连接处理, 路由阶段按已读取的数据路由, 代理握手超时关闭连接
+func (th *TCPRelayHandler) onPreludeTimeout() {
+	if th.stage == kStageUpstream {
+		log.Warn("[tcp_handler] upstream handshake to ", th.target.Addr, ":", th.target.Port, " timeout")
+		th.upstreamFail()
+		return
+	} else if th.stage == kStageSocks {
+		log.Info("[tcp_handler] socks5 handshake timeout from: ", Addr2Str(th.srcAddr))
+		th.Destroy()
+		return
+	} else if th.stage == kStageRoute {
+		th.route(true)
+		return
+	}
+	if th.server.cfg.ProxyProtocolIn == ProxyInRequire || len(th.pending) != 0 {
+		log.Info("[tcp_handler] proxy header timeout from: ", Addr2Str(th.srcAddr))
+		th.Destroy()
+		return
+	}
+	th.proxyHeaderDone()
+}
+
+//refuse 预处理阶段拒绝连接
+func (th *TCPRelayHandler) refuse(reset bool) {
+	cfd := th.localSocket
+	th.server.onHandlerDestroy(th)
+	th.eventLoop.UnRegister(cfd)
+	th.localSocket = INVALID_SOCKET
+	th.server.reject(cfd, reset)
+}
+
+//handOver 结束预处理阶段, 将本地连接交给 TCPRelay.admit
+func (th *TCPRelayHandler) handOver(backends []Backend, pending []byte) {
+	cfd := th.localSocket
+	th.eventLoop.UnRegister(cfd)
+	delete(th.server.socketHandler, cfd)
+	delete(th.server.preludeHandler, th)
+	th.localSocket = INVALID_SOCKET
+	acquired := th.admitted
+	th.admitted = false
+	th.server.admit(cfd, th.srcAddr, th.dstAddr, backends, th.socksReply, acquired, pending)
+}
+
+//readLimit 返回本次可读取的字节数, 令牌不足时暂停该方向的读取, 超出配额且动作为block时关闭连接
+func (th *TCPRelayHandler) readLimit(dir int, size int) int {
+	if q := th.server.quota; q != nil && !q.Allow(th.srcIP) {
+		log.Info("[tcp_handler] quota exceeded, close conn from: ", Addr2Str(th.srcAddr))
+		th.Destroy()
+		return 0
+	}
+	if th.server.shaper == nil {
+		return size
+	}
+	if size = th.server.shaper.Available(th.flowLimit, th.srcIP, dir, size); size <= 0 {
+		th.paused[dir] = true
+		th.flow.Update(dir, kWaitStatusInit)
+		th.server.pausedHandler[th] = struct{}{}
+	}
+	return size
+}
+
+//consumed 扣除限速令牌并累计流量
+func (th *TCPRelayHandler) consumed(dir int, n int) {
+	if th.server.shaper != nil {
+		th.server.shaper.Consume(th.flowLimit, th.srcIP, dir, n)
+	}
+	if th.server.quota != nil {
+		th.server.quota.Add(th.srcIP, dir, n)
+	}
+}
+
+//resume 令牌可用时恢复读取, 返回是否已全部恢复
+func (th *TCPRelayHandler) resume() bool {
+	for dir := range th.paused {
+		if th.paused[dir] && th.server.shaper.Available(th.flowLimit, th.srcIP, dir, 1) > 0 {
+			th.paused[dir] = false
+			th.flow.Update(dir, kWaitStatusReading)
+		}
+	}
+	return !th.paused[kStreamUp] && !th.paused[kStreamDown]
 }
 
 func (th *TCPRelayHandler) HandleEvent(s, ev int) {
@@ -95,7 +764,9 @@ func (th *TCPRelayHandler) HandleEvent(s, ev int) {
 			log.Warn("[tcp_handler]: handle remote event poll err: ", s, ev)
 			th.Destroy()
 		}
-		if Judge(ev & (kPollIn | kPollHup)) {
+		if Judge(ev&(kPollIn|kPollHup)) && th.stage == kStageUpstream {
+			th.onUpstream()
+		} else if Judge(ev & (kPollIn | kPollHup)) {
 			th.onRemoteRead()
 		}
 		if Judge(ev & kPollOut) {
@@ -106,6 +777,10 @@ func (th *TCPRelayHandler) HandleEvent(s, ev int) {
 			log.Warn("[tcp_handler]: handle local event poll err: ", s, ev)
 			th.Destroy()
 		}
+		if th.stage != kStageRelay {
+			th.onPrelude()
+			return
+		}
 		if Judge(ev & (kPollIn | kPollHup)) {
 			th.onLocalRead()
 		}
@@ -152,7 +827,11 @@ func (th *TCPRelayHandler) writeToSock(s int, data *[]byte) {
 }
 
 func (th *TCPRelayHandler) onLocalRead() {
-	buf := make([]byte, kUpStreamBufSize)
+	size := th.readLimit(kStreamUp, kUpStreamBufSize)
+	if size <= 0 {
+		return
+	}
+	buf := make([]byte, size)
 	if n, err := BufferRecv(th.localSocket, &buf); err != nil || n <= 0 {
 		if err == unix.EAGAIN {
 			return
@@ -161,13 +840,17 @@ func (th *TCPRelayHandler) onLocalRead() {
 		}
 		th.Destroy()
 	} else {
-		buf = buf[:n]
-		th.writeToSock(th.remoteSocket, &buf)
+		th.consumed(kStreamUp, n)
+		th.fromLocal(buf[:n])
 	}
 }
 
 func (th *TCPRelayHandler) onRemoteRead() {
-	buf := make([]byte, kDownStreamBufSize)
+	size := th.readLimit(kStreamDown, kDownStreamBufSize)
+	if size <= 0 {
+		return
+	}
+	buf := make([]byte, size)
 	if n, err := BufferRecv(th.remoteSocket, &buf); err != nil || n <= 0 {
 		if err == unix.EAGAIN {
 			return
@@ -176,11 +859,127 @@ func (th *TCPRelayHandler) onRemoteRead() {
 		}
 		th.Destroy()
 	} else {
-		buf = buf[:n]
-		th.writeToSock(th.localSocket, &buf)
+		th.consumed(kStreamDown, n)
+		th.fromRemote(buf[:n])
+	}
+}
+
+//fromLocal 处理本地连接读到的数据, 配置了 localCodec 时先解码
+func (th *TCPRelayHandler) fromLocal(data []byte) {
+	if th.localCodec == nil {
+		th.toRemote(data)
+		return
+	}
+	plain, err := th.localCodec.Decode(data)
+	th.flushCodec(th.localSocket, th.localCodec)
+	th.toRemote(plain)
+	if err != nil {
+		if err != io.EOF {
+			log.Info("[tcp_handler] decode local stream from ", Addr2Str(th.srcAddr), " err: ", err)
+		}
+		th.Destroy()
+	}
+}
+
+//fromRemote 处理后端读到的数据, 配置了 remoteCodec 时先解码
+func (th *TCPRelayHandler) fromRemote(data []byte) {
+	if th.remoteCodec == nil {
+		th.toLocal(data)
+		return
+	}
+	plain, err := th.remoteCodec.Decode(data)
+	th.flushCodec(th.remoteSocket, th.remoteCodec)
+	th.toLocal(plain)
+	if err != nil {
+		if err != io.EOF {
+			log.Info("[tcp_handler] decode remote stream err: ", err)
+		}
+		th.Destroy()
+	}
+}
+
+//toLocal 将明文发往本地连接, 配置了 localCodec 时先编码
+func (th *TCPRelayHandler) toLocal(data []byte) {
+	th.encodeTo(th.localSocket, th.localCodec, data)
+}
+
+//toRemote 将明文发往后端, 配置了 remoteCodec 时先编码
+func (th *TCPRelayHandler) toRemote(data []byte) {
+	th.encodeTo(th.remoteSocket, th.remoteCodec, data)
+}
+
+func (th *TCPRelayHandler) encodeTo(s int, codec StreamCodec, data []byte) {
+	if codec == nil {
+		th.sendOrQueue(s, data)
+		return
+	} else if len(data) == 0 {
+		return
+	}
+	if err := codec.Encode(data); err != nil {
+		log.Warn("[tcp_handler] encode stream err: ", err)
+		th.Destroy()
+		return
+	}
+	th.flushCodec(s, codec)
+}
+
+//flushCodec 发送编解码器产生的数据(握手消息和密文)
+func (th *TCPRelayHandler) flushCodec(s int, codec StreamCodec) {
+	th.sendOrQueue(s, codec.Output())
+}
+
+//sendOrQueue 已有未发完的数据时追加到缓冲区以保证顺序, 否则直接发送
+func (th *TCPRelayHandler) sendOrQueue(s int, data []byte) {
+	if len(data) == 0 || s == INVALID_SOCKET {
+		return
+	}
+	if s == th.localSocket && len(th.flow.DataWriteToLocal) != 0 {
+		th.flow.DataWriteToLocal = append(th.flow.DataWriteToLocal, data...)
+	} else if s == th.remoteSocket && len(th.flow.DataWriteToRemote) != 0 {
+		th.flow.DataWriteToRemote = append(th.flow.DataWriteToRemote, data...)
+	} else {
+		th.writeToSock(s, &data)
 	}
 }
 
+//handshaking 本地或后端的TLS握手是否仍在进行
+func (th *TCPRelayHandler) handshaking() bool {
+	for _, codec := range []StreamCodec{th.localCodec, th.remoteCodec} {
+		if c, ok := codec.(*tlsCodec); ok && c.handshaking() {
+			return true
+		}
+	}
+	return false
+}
+
+//onLocalCodecEvent localCodec 的异步通知: 握手期间发送握手消息, 握手完成后处理已到达的数据, 失败时关闭连接
+func (th *TCPRelayHandler) onLocalCodecEvent(err error) {
+	if th.localSocket == INVALID_SOCKET {
+		return
+	}
+	if err != nil {
+		th.flushCodec(th.localSocket, th.localCodec)
+		log.Info("[tcp_handler] handshake with ", Addr2Str(th.srcAddr), " err: ", err)
+		th.Destroy()
+		return
+	}
+	th.fromLocal(nil)
+}
+
+//onRemoteCodecEvent remoteCodec 的异步通知, 同 onLocalCodecEvent
+func (th *TCPRelayHandler) onRemoteCodecEvent(err error) {
+	if th.remoteSocket == INVALID_SOCKET {
+		return
+	}
+	if err != nil {
+		th.flushCodec(th.remoteSocket, th.remoteCodec)
+		log.Warn("[tcp_handler] handshake with remote err: ", err)
+		th.Destroy()
+		return
+	}
+	th.fromRemote(nil)
+}
+
 func (th *TCPRelayHandler) onLocalWrite() {
 	if len(th.flow.DataWriteToLocal) != 0 {
 		data := th.flow.DataWriteToLocal
@@ -202,6 +1001,23 @@ func (th *TCPRelayHandler) onRemoteWrite() {
 }
 
 func (th *TCPRelayHandler) Destroy() {
+	if th.localSocket == INVALID_SOCKET && th.remoteSocket == INVALID_SOCKET {
+		return
+	}
+	th.server.onHandlerDestroy(th)
+	if th.localCodec != nil {
+		th.localCodec.Close()
+	}
+	if th.remoteCodec != nil {
+		th.remoteCodec.Close()
+	}
+	if th.assoc != nil {
+		th.assoc.Close()
+	}
+	if th.dialer != nil {
+		th.dialer.Close()
+		th.dialer = nil
+	}
 	if th.remoteSocket != INVALID_SOCKET {
 		th.eventLoop.UnRegister(th.remoteSocket)
 		CloseSocket(th.remoteSocket)
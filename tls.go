@@ -0,0 +1,403 @@
+package fdd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rocinan/fdd/poller"
+)
+
+const (
+	kTLSHandshakeTimeout = 10 * time.Second
+	kTLSReloadInterval   = 5 * time.Second
+)
+
+//TLSServer 监听侧TLS终止的证书配置, 支持按SNI选择多张证书和客户端证书校验,
+//证书文件变化后由 Start 启动的协程自动重新加载
+type TLSServer struct {
+	mu     sync.Mutex
+	pairs  []string
+	caFile string
+	mtimes map[string]time.Time
+	config *tls.Config
+	stop   chan struct{}
+}
+
+//NewTLSServer pairs 每项格式为 cert.pem:key.pem, caFile 非空时要求客户端提供由其签发的证书
+func NewTLSServer(pairs []string, caFile string) (*TLSServer, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no tls certificate")
+	}
+	s := &TLSServer{pairs: pairs, caFile: caFile, stop: make(chan struct{})}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//Reload 重新读取证书和CA文件, 失败时保留原有配置
+func (s *TLSServer) Reload() error {
+	mtimes := make(map[string]time.Time)
+	certs := make([]tls.Certificate, 0, len(s.pairs))
+	for _, pair := range s.pairs {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return errors.New("invalid tls cert pair " + pair + ", want cert.pem:key.pem")
+		}
+		cert, err := tls.LoadX509KeyPair(parts[0], parts[1])
+		if err != nil {
+			return err
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+		mtimes[parts[0]], mtimes[parts[1]] = fileMtime(parts[0]), fileMtime(parts[1])
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			for i := range certs {
+				if hello.SupportsCertificate(&certs[i]) == nil {
+					return &certs[i], nil
+				}
+			}
+			return &certs[0], nil
+		},
+	}
+	if s.caFile != "" {
+		pem, err := ioutil.ReadFile(s.caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificate found in " + s.caFile)
+		}
+		config.ClientCAs, config.ClientAuth = pool, tls.RequireAndVerifyClientCert
+		mtimes[s.caFile] = fileMtime(s.caFile)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config, s.mtimes = config, mtimes
+	log.Info("[tls] load certificates: ", len(certs))
+	return nil
+}
+
+//Start 启动证书检查协程, 每 kTLSReloadInterval 检查一次文件修改时间, 有变化时重新加载, 文件读取不在eventLoop线程中进行
+func (s *TLSServer) Start() {
+	go func() {
+		ticker := time.NewTicker(kTLSReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if s.changed() {
+					CheckError("[tls] reload certificates err: ", s.Reload())
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *TLSServer) Stop() {
+	close(s.stop)
+}
+
+//changed 证书或CA文件的修改时间是否与加载时不同
+func (s *TLSServer) changed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for file, mtime := range s.mtimes {
+		if !fileMtime(file).Equal(mtime) {
+			return true
+		}
+	}
+	return false
+}
+
+//current 返回当前配置
+func (s *TLSServer) current() *tls.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+//NewCodec 创建一条连接的TLS服务端编解码器, 握手事件通过 ep 回到eventLoop线程
+func (s *TLSServer) NewCodec(ep *poller.EventLoop) StreamCodec {
+	config := s.current()
+	return newTLSCodec(ep, false, func(conn net.Conn) *tls.Conn {
+		return tls.Server(conn, config)
+	})
+}
+
+//TLSClient 连接后端时使用的TLS配置
+type TLSClient struct {
+	serverName   string
+	roots        *x509.CertPool
+	fingerprints [][]byte
+	config       *tls.Config
+}
+
+//NewTLSClient serverName 为空时使用后端的域名或ip; caFile 为空时使用系统根证书校验;
+//certPair 格式为 cert.pem:key.pem; pins 为证书DER的sha256指纹, 配置后只校验指纹, 同时配置 caFile 时两者都需通过
+func NewTLSClient(serverName, caFile, certPair string, pins []string) (*TLSClient, error) {
+	c := &TLSClient{serverName: serverName}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		c.roots = x509.NewCertPool()
+		if !c.roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + caFile)
+		}
+	}
+	for _, pin := range pins {
+		fp, err := hex.DecodeString(strings.Replace(pin, ":", "", -1))
+		if err != nil || len(fp) != sha256.Size {
+			return nil, errors.New("invalid sha256 fingerprint " + pin)
+		}
+		c.fingerprints = append(c.fingerprints, fp)
+	}
+	//证书由 verify 自行校验
+	c.config = &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if certPair != "" {
+		parts := strings.SplitN(certPair, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid tls cert pair " + certPair + ", want cert.pem:key.pem")
+		}
+		cert, err := tls.LoadX509KeyPair(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		c.config.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+//NewCodec 创建连接后端 b 的TLS客户端编解码器, 握手事件通过 ep 回到eventLoop线程
+func (c *TLSClient) NewCodec(ep *poller.EventLoop, b Backend) StreamCodec {
+	config := c.config.Clone()
+	if config.ServerName = c.serverName; config.ServerName == "" {
+		if config.ServerName = strings.TrimSuffix(b.Host, "."); config.ServerName == "" && net.ParseIP(b.Addr) != nil {
+			config.ServerName = b.Addr
+		}
+	}
+	name := config.ServerName
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		return c.verify(name, cs.PeerCertificates)
+	}
+	return newTLSCodec(ep, true, func(conn net.Conn) *tls.Conn {
+		return tls.Client(conn, config)
+	})
+}
+
+//verify 未配置指纹或配置了CA时校验证书链和名称, 配置了指纹时校验叶子证书指纹
+func (c *TLSClient) verify(name string, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("no peer certificate")
+	}
+	leaf := certs[0]
+	if c.roots != nil || len(c.fingerprints) == 0 {
+		if name == "" {
+			return errors.New("no server name to verify certificate, set sni or fingerprint")
+		}
+		opts := x509.VerifyOptions{Roots: c.roots, DNSName: name, Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := leaf.Verify(opts); err != nil {
+			return err
+		}
+	}
+	if len(c.fingerprints) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(leaf.Raw)
+	for _, fp := range c.fingerprints {
+		if bytes.Equal(fp, sum[:]) {
+			return nil
+		}
+	}
+	return errors.New("certificate fingerprint mismatch: " + hex.EncodeToString(sum[:]))
+}
+
+func fileMtime(file string) time.Time {
+	if fi, err := os.Stat(file); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+//tlsCodec 非阻塞TLS状态机. crypto/tls 的握手出错后不可重试, 无法在读到 errWouldBlock 时返回, 因此握手在独立协程中运行,
+//证书签名、密钥交换等计算不占用eventLoop线程: Decode 只把数据交给握手协程, 握手协程读空数据或握手结束时
+//通过 notify 在eventLoop线程中通知发送握手消息或处理结果. 握手结束后读写直接在eventLoop线程中进行
+type tlsCodec struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	conn    *memConn
+	tls     *tls.Conn
+	ep      *poller.EventLoop
+	notify  func(err error)
+	started bool
+	done    bool
+	err     error
+	//以下字段只在eventLoop线程中访问
+	ready  bool
+	closed bool
+	queued []byte
+}
+
+//tlsConn 握手协程与eventLoop线程共享的内存连接, 读写加锁; 握手期间无数据时等待, 握手结束后返回 errWouldBlock
+type tlsConn struct {
+	*memConn
+	c *tlsCodec
+}
+
+func (t tlsConn) Read(p []byte) (int, error) {
+	c := t.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(t.in) == 0 && !t.closed && !c.done {
+		if len(t.out) != 0 {
+			c.post(nil)
+		}
+		c.cond.Wait()
+	}
+	return t.memConn.Read(p)
+}
+
+func (t tlsConn) Write(p []byte) (int, error) {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	return t.memConn.Write(p)
+}
+
+//newTLSCodec start 为true时立即开始握手(客户端发送ClientHello), 否则在收到第一个数据时开始
+func newTLSCodec(ep *poller.EventLoop, start bool, wrap func(conn net.Conn) *tls.Conn) *tlsCodec {
+	c := &tlsCodec{conn: &memConn{}, ep: ep}
+	c.cond = sync.NewCond(&c.mu)
+	c.tls = wrap(tlsConn{memConn: c.conn, c: c})
+	if start {
+		c.started = true
+		go c.handshake()
+	}
+	return c
+}
+
+func (c *tlsCodec) handshake() {
+	err := c.tls.Handshake()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done {
+		c.done, c.err = true, err
+	}
+	c.post(c.err)
+}
+
+//post 在eventLoop线程中通知握手进展, 调用时持有 mu
+func (c *tlsCodec) post(err error) {
+	c.ep.Post(func() {
+		if !c.closed && c.notify != nil {
+			c.notify(err)
+		}
+	})
+}
+
+//handshaking 握手是否仍在进行
+func (c *tlsCodec) handshaking() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.done
+}
+
+//SetNotify 握手协程需要发送握手消息或握手结束时回调, 握手失败时 err 非空
+func (c *tlsCodec) SetNotify(fn func(err error)) {
+	c.notify = fn
+}
+
+func (c *tlsCodec) Decode(in []byte) ([]byte, error) {
+	c.mu.Lock()
+	c.conn.feed(in)
+	done, err := c.done, c.err
+	if !done && len(in) != 0 && !c.started {
+		c.started = true
+		go c.handshake()
+	}
+	c.cond.Signal()
+	c.mu.Unlock()
+	if !done {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if !c.ready {
+		//握手完成时发送握手期间缓存的明文
+		c.ready = true
+		queued := c.queued
+		c.queued = nil
+		if err := c.Encode(queued); err != nil {
+			return nil, err
+		}
+	}
+	var plain []byte
+	buf := make([]byte, kUpStreamBufSize)
+	for {
+		n, err := c.tls.Read(buf)
+		plain = append(plain, buf[:n]...)
+		if err == errWouldBlock {
+			return plain, nil
+		} else if err != nil {
+			return plain, err
+		}
+	}
+}
+
+func (c *tlsCodec) Encode(plain []byte) error {
+	if !c.ready {
+		c.queued = append(c.queued, plain...)
+		return nil
+	} else if len(plain) == 0 {
+		return nil
+	}
+	_, err := c.tls.Write(plain)
+	return err
+}
+
+func (c *tlsCodec) Output() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.take()
+}
+
+//Close 握手未结束时唤醒握手协程, 读到 io.EOF 后握手失败退出
+func (c *tlsCodec) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.conn.Close()
+	if !c.done {
+		c.done, c.err = true, io.ErrClosedPipe
+	}
+	c.cond.Signal()
+}
@@ -0,0 +1,288 @@
+package fdd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rocinan/fdd/poller"
+)
+
+//testPKI 测试用CA及其签发的服务端和客户端证书, 均写入临时目录
+type testPKI struct {
+	ca, server, client string
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	dir := t.TempDir()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fdd test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDer)
+	write := func(name, typ string, der []byte) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	issue := func(name string, serial int64, usage x509.ExtKeyUsage) string {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDer, _ := x509.MarshalECPrivateKey(key)
+		return write(name+".pem", "CERTIFICATE", der) + ":" + write(name+".key", "EC PRIVATE KEY", keyDer)
+	}
+	return &testPKI{
+		ca:     write("ca.pem", "CERTIFICATE", caDer),
+		server: issue("localhost", 2, x509.ExtKeyUsageServerAuth),
+		client: issue("client", 3, x509.ExtKeyUsageClientAuth),
+	}
+}
+
+//newTestLoop 创建并运行测试用的eventLoop
+func newTestLoop(t *testing.T) *poller.EventLoop {
+	ep, err := poller.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ep.Run()
+	return ep
+}
+
+//pumpCodecs 在eventLoop线程中交换两端的输出, 握手在协程中进行时等待其通知, 直到握手结束且没有新数据,
+//返回双方解出的明文和第一个错误
+func pumpCodecs(ep *poller.EventLoop, client, server StreamCodec) (toServer, toClient []byte, err error) {
+	events := make(chan error, 64)
+	notify := func(err error) {
+		select {
+		case events <- err:
+		default:
+		}
+	}
+	onLoop(ep, func() {
+		client.SetNotify(notify)
+		server.SetNotify(notify)
+	})
+	idle := 0
+	for i := 0; i < 500 && idle < 2; i++ {
+		moved, handshaking := false, false
+		onLoop(ep, func() {
+			up, down := client.Output(), server.Output()
+			moved = len(up) != 0 || len(down) != 0
+			plain, derr := server.Decode(up)
+			toServer = append(toServer, plain...)
+			if derr == nil {
+				plain, derr = client.Decode(down)
+				toClient = append(toClient, plain...)
+			}
+			err = derr
+			handshaking = client.(*tlsCodec).handshaking() || server.(*tlsCodec).handshaking()
+		})
+		if err != nil {
+			return toServer, toClient, err
+		} else if moved {
+			idle = 0
+		} else if !handshaking {
+			idle++
+		} else {
+			select {
+			case e := <-events:
+				if e != nil {
+					return toServer, toClient, e
+				}
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}
+	if idle < 2 {
+		return toServer, toClient, errors.New("handshake not finished")
+	}
+	return toServer, toClient, nil
+}
+
+func TestTLSCodecHandshake(t *testing.T) {
+	pki := newTestPKI(t)
+	srv, err := NewTLSServer([]string{pki.server}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewTLSClient("localhost", pki.ca, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := newTestLoop(t)
+	client, server := cli.NewCodec(ep, Backend{Addr: "127.0.0.1"}), srv.NewCodec(ep)
+	//握手完成前的明文先缓存
+	onLoop(ep, func() {
+		client.Encode([]byte("hello"))
+		server.Encode([]byte("world"))
+	})
+	up, down, err := pumpCodecs(ep, client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(up) != "hello" || string(down) != "world" {
+		t.Fatalf("got %q / %q", up, down)
+	}
+	if client.(*tlsCodec).handshaking() || server.(*tlsCodec).handshaking() {
+		t.Fatal("handshake not finished")
+	}
+	onLoop(ep, func() { client.Encode([]byte("again")) })
+	if up, _, err = pumpCodecs(ep, client, server); err != nil || string(up) != "again" {
+		t.Fatalf("got %q err %v after handshake", up, err)
+	}
+}
+
+func TestTLSCodecMutual(t *testing.T) {
+	pki := newTestPKI(t)
+	srv, err := NewTLSServer([]string{pki.server}, pki.ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withCert, err := NewTLSClient("localhost", pki.ca, pki.client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := newTestLoop(t)
+	client, server := withCert.NewCodec(ep, Backend{}), srv.NewCodec(ep)
+	onLoop(ep, func() { client.Encode([]byte("hello")) })
+	if up, _, err := pumpCodecs(ep, client, server); err != nil || string(up) != "hello" {
+		t.Fatalf("mtls with client cert: %q %v", up, err)
+	}
+
+	noCert, _ := NewTLSClient("localhost", pki.ca, "", nil)
+	client, server = noCert.NewCodec(ep, Backend{}), srv.NewCodec(ep)
+	onLoop(ep, func() { client.Encode([]byte("hello")) })
+	if up, _, err := pumpCodecs(ep, client, server); err == nil || len(up) != 0 {
+		t.Fatalf("mtls without client cert: %q %v", up, err)
+	}
+}
+
+func TestTLSCodecVerify(t *testing.T) {
+	pki := newTestPKI(t)
+	srv, _ := NewTLSServer([]string{pki.server}, "")
+	ep := newTestLoop(t)
+	tests := []struct {
+		name string
+		sni  string
+		ca   string
+		pins []string
+		ok   bool
+	}{
+		{"unknown ca", "localhost", "", nil, false},
+		{"wrong name", "example.com", pki.ca, nil, false},
+		{"pin mismatch", "", "", []string{strings.Repeat("00", 32)}, false},
+	}
+	for _, tt := range tests {
+		cli, err := NewTLSClient(tt.sni, tt.ca, "", tt.pins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := cli.NewCodec(ep, Backend{Host: "localhost"})
+		if _, _, err := pumpCodecs(ep, client, srv.NewCodec(ep)); (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestTLSCodecClose(t *testing.T) {
+	pki := newTestPKI(t)
+	srv, _ := NewTLSServer([]string{pki.server}, "")
+	cli, _ := NewTLSClient("localhost", pki.ca, "", nil)
+	ep := newTestLoop(t)
+	client, server := cli.NewCodec(ep, Backend{}), srv.NewCodec(ep)
+	var hello []byte
+	for i := 0; i < 100 && len(hello) == 0; i++ {
+		onLoop(ep, func() { hello = client.Output() })
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(hello) == 0 {
+		t.Fatal("no client hello")
+	}
+	//只收到部分ClientHello时关闭, 握手协程应退出
+	onLoop(ep, func() {
+		if plain, err := server.Decode(hello[:len(hello)/2]); err != nil || len(plain) != 0 {
+			t.Errorf("partial hello: %q %v", plain, err)
+		}
+		server.Close()
+		client.Close()
+		if server.(*tlsCodec).handshaking() || client.(*tlsCodec).handshaking() {
+			t.Error("handshake still running after close")
+		}
+		if plain, err := server.Decode(hello[len(hello)/2:]); err == nil || len(plain) != 0 {
+			t.Errorf("decode after close: %q %v", plain, err)
+		}
+	})
+}
+
+//TestTLSCodecAsync 握手在协程中进行, Decode 不等待握手计算, 握手消息通过 notify 通知后取出
+func TestTLSCodecAsync(t *testing.T) {
+	pki := newTestPKI(t)
+	srv, _ := NewTLSServer([]string{pki.server}, "")
+	cli, _ := NewTLSClient("localhost", pki.ca, "", nil)
+	ep := newTestLoop(t)
+	events := make(chan error, 16)
+	var client, server StreamCodec
+	onLoop(ep, func() {
+		client, server = cli.NewCodec(ep, Backend{}), srv.NewCodec(ep)
+		client.SetNotify(func(err error) { events <- err })
+		server.SetNotify(func(err error) { events <- err })
+	})
+	if err := <-events; err != nil {
+		t.Fatal(err)
+	}
+	onLoop(ep, func() {
+		if plain, err := server.Decode(client.Output()); err != nil || len(plain) != 0 {
+			t.Errorf("decode client hello: %q %v", plain, err)
+		}
+	})
+	//服务端的握手消息在 Decode 返回之后由握手协程产生
+	select {
+	case err := <-events:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notify from server handshake")
+	}
+	onLoop(ep, func() {
+		if len(server.Output()) == 0 {
+			t.Error("no server handshake output after notify")
+		}
+	})
+}
@@ -0,0 +1,239 @@
+package fdd
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	TransparentRedirect = "redirect"
+	TransparentTProxy   = "tproxy"
+
+	kSoOriginalDst = 80
+)
+
+//OriginalDst 返回透明代理模式下tcp连接的原始目的地址, redirect模式读取 SO_ORIGINAL_DST,
+//tproxy模式下本地地址即为原始目的地址
+func OriginalDst(fd int, mode string) (unix.Sockaddr, error) {
+	if mode == TransparentTProxy {
+		return unix.Getsockname(fd)
+	}
+	local, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, err
+	}
+	//双栈监听时ipv4客户端的本地地址为v4-mapped, REDIRECT的原始目的地址只能从 SOL_IP 读取
+	if sa6, ok := local.(*unix.SockaddrInet6); ok && net.IP(sa6.Addr[:]).To4() == nil {
+		var raw unix.RawSockaddrInet6
+		if err := getsockoptRaw(fd, unix.SOL_IPV6, kSoOriginalDst, unsafe.Pointer(&raw), unsafe.Sizeof(raw)); err != nil {
+			return nil, err
+		}
+		p := (*[2]byte)(unsafe.Pointer(&raw.Port))
+		return &unix.SockaddrInet6{Port: int(p[0])<<8 | int(p[1]), Addr: raw.Addr}, nil
+	}
+	var raw unix.RawSockaddrInet4
+	if err := getsockoptRaw(fd, unix.SOL_IP, kSoOriginalDst, unsafe.Pointer(&raw), unsafe.Sizeof(raw)); err != nil {
+		return nil, err
+	}
+	p := (*[2]byte)(unsafe.Pointer(&raw.Port))
+	return &unix.SockaddrInet4{Port: int(p[0])<<8 | int(p[1]), Addr: raw.Addr}, nil
+}
+
+//HostAddrs 缓存本机网卡地址, 用于识别未经重定向直接访问监听端口造成的环路, 由 AddrWatcher 在地址变化时刷新
+type HostAddrs struct {
+	addrs map[string]struct{}
+}
+
+func NewHostAddrs() *HostAddrs {
+	h := &HostAddrs{}
+	CheckError("[transparent] load interface addrs err: ", h.SyncListeners())
+	return h
+}
+
+//SyncListeners 重新读取网卡地址, 读取失败时保留原有缓存
+func (h *HostAddrs) SyncListeners() error {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	m := make(map[string]struct{}, len(addrs))
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			m[n.IP.String()] = struct{}{}
+		}
+	}
+	h.addrs = m
+	return nil
+}
+
+//IsLocal 判断是否为本机地址
+func (h *HostAddrs) IsLocal(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	_, ok := h.addrs[ip.String()]
+	return ok
+}
+
+func getsockoptRaw(fd, level, opt int, val unsafe.Pointer, size uintptr) error {
+	l := uint32(size)
+	if _, _, e := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt), uintptr(val), uintptr(unsafe.Pointer(&l)), 0); e != 0 {
+		return e
+	}
+	return nil
+}
+
+//SetTransparent 设置 IP_TRANSPARENT, 允许监听或绑定非本机地址, 需要 CAP_NET_ADMIN
+func SetTransparent(fd int, family int) error {
+	if family == unix.AF_INET6 {
+		return unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+}
+
+//SetRecvOrigDst 开启 IP_RECVORIGDSTADDR, 通过 PacketRecvOrigDst 获取udp报文的原始目的地址
+func SetRecvOrigDst(fd int, family int) error {
+	if family == unix.AF_INET6 {
+		return unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+}
+
+//SetRecvPktInfo 开启 IP_PKTINFO/IPV6_RECVPKTINFO, 监听通配地址时通过 PacketRecvOrigDst 获取报文的目的ip
+func SetRecvPktInfo(fd int, family int) error {
+	if family == unix.AF_INET6 {
+		return unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_RECVPKTINFO, 1)
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_PKTINFO, 1)
+}
+
+//PacketRecvOrigDst 接收udp报文并返回来源地址和原始目的地址, 无控制信息时dst为nil;
+//由 pktinfo 得到的目的地址只有ip, 端口为0
+func PacketRecvOrigDst(fd int, p *[]byte) (int, unix.Sockaddr, unix.Sockaddr, error) {
+	oob := make([]byte, 64)
+	n, oobn, _, src, err := unix.Recvmsg(fd, *p, oob, 0)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, src, nil, nil
+	}
+	for _, m := range msgs {
+		if m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR && len(m.Data) >= unix.SizeofSockaddrInet4 {
+			raw := (*unix.RawSockaddrInet4)(unsafe.Pointer(&m.Data[0]))
+			p := (*[2]byte)(unsafe.Pointer(&raw.Port))
+			return n, src, &unix.SockaddrInet4{Port: int(p[0])<<8 | int(p[1]), Addr: raw.Addr}, nil
+		}
+		if m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR && len(m.Data) >= unix.SizeofSockaddrInet6 {
+			raw := (*unix.RawSockaddrInet6)(unsafe.Pointer(&m.Data[0]))
+			p := (*[2]byte)(unsafe.Pointer(&raw.Port))
+			return n, src, &unix.SockaddrInet6{Port: int(p[0])<<8 | int(p[1]), Addr: raw.Addr}, nil
+		}
+		if m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_PKTINFO && len(m.Data) >= unix.SizeofInet4Pktinfo {
+			info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			return n, src, &unix.SockaddrInet4{Addr: info.Addr}, nil
+		}
+		if m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_PKTINFO && len(m.Data) >= unix.SizeofInet6Pktinfo {
+			info := (*unix.Inet6Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			return n, src, &unix.SockaddrInet6{Addr: info.Addr}, nil
+		}
+	}
+	return n, src, nil, nil
+}
+
+//CreateUdpReplySocket 创建绑定在原始目的地址上的udp socket, tproxy模式下以原始目的地址回复客户端
+func CreateUdpReplySocket(local unix.Sockaddr) (int, error) {
+	family := SockAddrFamily(local)
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return 0, err
+	}
+	unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+	if err := SetTransparent(fd, family); err != nil {
+		CloseSocket(fd)
+		return 0, err
+	}
+	if err := unix.Bind(fd, local); err != nil {
+		CloseSocket(fd)
+		return 0, err
+	}
+	SetNoBlock(fd)
+	return fd, nil
+}
+
+//ParseTransparentMap 解析原始目的地址到转发目标的映射, 格式为 orig=target,
+//orig 为 ip:port 或 ip, target 为 ip:port 或 ip(沿用原始端口)
+func ParseTransparentMap(list []string) (map[string]Backend, error) {
+	m := make(map[string]Backend, len(list))
+	for _, v := range list {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid transparent map: " + v)
+		}
+		key, err := normalizeHostPort(kv[0])
+		if err != nil {
+			return nil, err
+		}
+		host, port, err := splitHostPort(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		m[key] = Backend{Addr: host, Port: port, Host: host}
+	}
+	return m, nil
+}
+
+//TransparentTarget 按映射表查找原始目的地址对应的转发目标, 先匹配 ip:port 再匹配 ip, 未命中时转发到原始目的地址
+func (c *Config) TransparentTarget(dst unix.Sockaddr) (Backend, bool) {
+	ip, port := SockAddrIP(dst).String(), SockAddrPort(dst)
+	if b, ok := c.TransparentMap[Addr2Str(dst)]; ok {
+		if b.Port == 0 {
+			b.Port = port
+		}
+		return b, true
+	}
+	if b, ok := c.TransparentMap[ip]; ok {
+		if b.Port == 0 {
+			b.Port = port
+		}
+		return b, true
+	}
+	return Backend{Addr: ip, Port: port, Host: ip}, false
+}
+
+func splitHostPort(s string) (string, int, error) {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil {
+		return ip.String(), 0, nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, err
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil || p <= 0 || p > 65535 {
+		return "", 0, errors.New("invalid address: " + s)
+	}
+	return ip.String(), p, nil
+}
+
+func normalizeHostPort(s string) (string, error) {
+	host, port, err := splitHostPort(s)
+	if err != nil {
+		return "", err
+	}
+	if port == 0 {
+		return host, nil
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
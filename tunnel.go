@@ -0,0 +1,436 @@
+package fdd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/rocinan/fdd/poller"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	TunnelClient = "client"
+	TunnelServer = "server"
+)
+
+const (
+	kTunnelSaltSize  = 32
+	kTunnelMaxFrame  = 0x3fff
+	kTunnelHelloSize = 8
+	kTunnelMaxSkew   = 60 * time.Second
+	kTunnelNonceSize = 12
+	kTunnelSeqSize   = 8
+	kTunnelMinKey    = 16
+	//kTunnelUDPSaltSize udp会话的salt随每个上行报文发送
+	kTunnelUDPSaltSize = 16
+	//kTunnelUDPIdle server 端udp会话密钥和重放窗口的保留时间, 超过后旧报文的时间戳已过期
+	kTunnelUDPIdle = 2 * kTunnelMaxSkew
+)
+
+var (
+	errTunnelAuth    = errors.New("tunnel: authentication failed")
+	errTunnelHello   = errors.New("tunnel: invalid hello")
+	errTunnelReplay  = errors.New("tunnel: replayed or expired hello")
+	errTunnelTimeout = errors.New("tunnel: hello timeout")
+	errTunnelSession = errors.New("tunnel: unknown udp session")
+)
+
+//Tunnel 两个fdd之间的加密隧道: 以预共享密钥派生会话密钥, 使用 AES-256-GCM 分帧加密,
+//client 端加密发往后端的数据, server 端解密来自客户端的数据
+type Tunnel struct {
+	key       []byte
+	server    bool
+	seen      map[string]time.Time
+	lastPrune time.Time
+	//udpSalts server 端按salt索引的udp会话, udpPeers 为各客户端地址最近使用的会话
+	udpSalts map[string]*TunnelUDP
+	udpPeers map[string]*TunnelUDP
+	udpPrune time.Time
+}
+
+//NewTunnel mode 为 client 或 server, psk 为双方相同的预共享密钥.
+//psk 经sha256直接作为主密钥, 没有慢哈希, 口令类的短密钥可被离线穷举, 应使用随机密钥(如 openssl rand -hex 32)
+func NewTunnel(mode, psk string) (*Tunnel, error) {
+	if mode != TunnelClient && mode != TunnelServer {
+		return nil, errors.New("invalid tunnel mode: " + mode)
+	} else if psk == "" {
+		return nil, errors.New("tunnel needs a pre-shared key")
+	} else if len(psk) < kTunnelMinKey {
+		log.Warn("[tunnel] pre-shared key is shorter than ", kTunnelMinKey, " bytes, use a random key such as: openssl rand -hex 32")
+	}
+	sum := sha256.Sum256([]byte(psk))
+	return &Tunnel{
+		key:      sum[:],
+		server:   mode == TunnelServer,
+		seen:     make(map[string]time.Time),
+		udpSalts: make(map[string]*TunnelUDP),
+		udpPeers: make(map[string]*TunnelUDP),
+	}, nil
+}
+
+//aead 以 HKDF-SHA256 (RFC5869, 单块输出) 从密钥、salt 和 info 派生 AES-256-GCM
+func (t *Tunnel) aead(salt []byte, info string) (cipher.AEAD, error) {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(t.key)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	block, err := aes.NewCipher(expand.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//accept 检查客户端hello的时间戳和salt, 同一salt在有效期内只能使用一次
+func (t *Tunnel) accept(salt []byte, ts int64, now time.Time) bool {
+	if d := now.Sub(time.Unix(ts, 0)); d > kTunnelMaxSkew || d < -kTunnelMaxSkew {
+		return false
+	}
+	if now.Sub(t.lastPrune) > kTunnelMaxSkew {
+		for k, v := range t.seen {
+			if now.Sub(v) > 2*kTunnelMaxSkew {
+				delete(t.seen, k)
+			}
+		}
+		t.lastPrune = now
+	}
+	if _, ok := t.seen[string(salt)]; ok {
+		return false
+	}
+	t.seen[string(salt)] = now
+	return true
+}
+
+//NewCodec 创建隧道一侧的流编解码器, client 端为后端连接, server 端为客户端连接,
+//server 端在 kTLSHandshakeTimeout 内未收到有效hello时通过 notify 报错
+func (t *Tunnel) NewCodec(ep *poller.EventLoop) StreamCodec {
+	c := &tunnelCodec{tunnel: t}
+	if t.server {
+		c.timer = time.AfterFunc(kTLSHandshakeTimeout, func() {
+			ep.Post(func() {
+				if !c.hello && !c.closed && c.notify != nil {
+					c.notify(errTunnelTimeout)
+				}
+			})
+		})
+	} else {
+		c.salt = make([]byte, kTunnelSaltSize)
+		rand.Read(c.salt)
+		c.seal, _ = t.aead(c.salt, "tcp up")
+		hello := make([]byte, kTunnelHelloSize)
+		binary.BigEndian.PutUint64(hello, uint64(time.Now().Unix()))
+		c.out = append(c.out, c.salt...)
+		c.sealFrame(hello)
+	}
+	return c
+}
+
+//TunnelUDP 一个udp会话的加密状态: 密钥由预共享密钥和会话的随机salt派生, nonce 为发送序号,
+//接收方以滑动窗口拒绝重放. 上行报文为 salt + 序号 + 密文(时间戳 + 数据), 下行报文为 序号 + 密文(数据);
+//salt 随每个上行报文发送, server 端无需握手即可从任一报文建立会话, 丢包不影响
+type TunnelUDP struct {
+	salt       []byte
+	seal       cipher.AEAD
+	open       cipher.AEAD
+	seq        uint64
+	window     replayWindow
+	lastActive time.Time
+}
+
+//newTunnelUDP 由salt派生会话两个方向的密钥, client 端加密上行, server 端加密下行
+func (t *Tunnel) newTunnelUDP(salt []byte) *TunnelUDP {
+	up, _ := t.aead(salt, "udp up")
+	down, _ := t.aead(salt, "udp down")
+	if t.server {
+		up, down = down, up
+	}
+	return &TunnelUDP{salt: salt, seal: up, open: down}
+}
+
+//NewUDPSession client 端为一个udp会话生成salt和密钥
+func (t *Tunnel) NewUDPSession() *TunnelUDP {
+	salt := make([]byte, kTunnelUDPSaltSize)
+	rand.Read(salt)
+	return t.newTunnelUDP(salt)
+}
+
+//sealSeq 以下一个序号为nonce加密, 追加到 dst 之后
+func (u *TunnelUDP) sealSeq(dst, plain []byte) []byte {
+	var nonce [kTunnelNonceSize]byte
+	binary.BigEndian.PutUint64(nonce[kTunnelNonceSize-kTunnelSeqSize:], u.seq)
+	dst = append(dst, nonce[kTunnelNonceSize-kTunnelSeqSize:]...)
+	u.seq++
+	return u.seal.Seal(dst, nonce[:], plain, nil)
+}
+
+//openSeq 解密 序号 + 密文, 重放或落后于窗口的序号返回 errTunnelReplay
+func (u *TunnelUDP) openSeq(pkt []byte) ([]byte, error) {
+	if len(pkt) < kTunnelSeqSize+u.open.Overhead() {
+		return nil, errTunnelAuth
+	}
+	seq := binary.BigEndian.Uint64(pkt)
+	if !u.window.check(seq) {
+		return nil, errTunnelReplay
+	}
+	var nonce [kTunnelNonceSize]byte
+	copy(nonce[kTunnelNonceSize-kTunnelSeqSize:], pkt[:kTunnelSeqSize])
+	plain, err := u.open.Open(nil, nonce[:], pkt[kTunnelSeqSize:], nil)
+	if err != nil {
+		return nil, errTunnelAuth
+	}
+	u.window.update(seq)
+	return plain, nil
+}
+
+//Seal client 端加密一个上行报文
+func (u *TunnelUDP) Seal(plain []byte) []byte {
+	buf := make([]byte, 8, 8+len(plain))
+	binary.BigEndian.PutUint64(buf, uint64(time.Now().Unix()))
+	pkt := make([]byte, 0, kTunnelUDPSaltSize+kTunnelSeqSize+len(buf)+len(plain)+u.seal.Overhead())
+	return u.sealSeq(append(pkt, u.salt...), append(buf, plain...))
+}
+
+//Open client 端解密一个下行报文
+func (u *TunnelUDP) Open(pkt []byte) ([]byte, error) {
+	return u.openSeq(pkt)
+}
+
+//OpenPacket server 端解密来自 from 的上行报文, 未知的salt建立新会话, 时间戳超出有效期时返回错误
+func (t *Tunnel) OpenPacket(from unix.Sockaddr, pkt []byte) ([]byte, error) {
+	if len(pkt) < kTunnelUDPSaltSize+kTunnelSeqSize+8 {
+		return nil, errTunnelAuth
+	}
+	now := time.Now()
+	t.pruneUDP(now)
+	salt := pkt[:kTunnelUDPSaltSize]
+	u, ok := t.udpSalts[string(salt)]
+	if !ok {
+		u = t.newTunnelUDP(append([]byte(nil), salt...))
+	}
+	plain, err := u.openSeq(pkt[kTunnelUDPSaltSize:])
+	if err != nil {
+		return nil, err
+	} else if len(plain) < 8 {
+		return nil, errTunnelAuth
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint64(plain)), 0)
+	if d := now.Sub(ts); d > kTunnelMaxSkew || d < -kTunnelMaxSkew {
+		return nil, errTunnelReplay
+	}
+	if !ok {
+		t.udpSalts[string(u.salt)] = u
+	}
+	t.udpPeers[Addr2Str(from)], u.lastActive = u, now
+	return plain[8:], nil
+}
+
+//SealPacket server 端加密发往 to 的下行报文, 使用该地址最近一次上行报文所属的会话
+func (t *Tunnel) SealPacket(to unix.Sockaddr, plain []byte) ([]byte, error) {
+	u, ok := t.udpPeers[Addr2Str(to)]
+	if !ok {
+		return nil, errTunnelSession
+	}
+	u.lastActive = time.Now()
+	return u.sealSeq(make([]byte, 0, kTunnelSeqSize+len(plain)+u.seal.Overhead()), plain), nil
+}
+
+//pruneUDP 清理超过 kTunnelUDPIdle 没有收发的会话
+func (t *Tunnel) pruneUDP(now time.Time) {
+	if now.Sub(t.udpPrune) < kTunnelMaxSkew {
+		return
+	}
+	t.udpPrune = now
+	for k, u := range t.udpSalts {
+		if now.Sub(u.lastActive) > kTunnelUDPIdle {
+			delete(t.udpSalts, k)
+		}
+	}
+	for k, u := range t.udpPeers {
+		if now.Sub(u.lastActive) > kTunnelUDPIdle {
+			delete(t.udpPeers, k)
+		}
+	}
+}
+
+//replayWindow 接收序号的滑动窗口(RFC6479), 接受新序号和窗口内未收到过的序号
+type replayWindow struct {
+	top  uint64 //已接收的最大序号+1
+	bits uint64 //第i位表示序号 top-1-i 已接收
+}
+
+func (w *replayWindow) check(seq uint64) bool {
+	if seq >= w.top {
+		return true
+	}
+	off := w.top - 1 - seq
+	return off < 64 && w.bits&(1<<off) == 0
+}
+
+func (w *replayWindow) update(seq uint64) {
+	if seq < w.top {
+		w.bits |= 1 << (w.top - 1 - seq)
+		return
+	}
+	if shift := seq - w.top + 1; shift >= 64 {
+		w.bits = 0
+	} else {
+		w.bits <<= shift
+	}
+	w.bits |= 1
+	w.top = seq + 1
+}
+
+//tunnelCodec 流格式: 双方各自先发送 salt, 之后每帧为 加密的2字节长度 + 加密的数据, nonce 为每个方向的计数器;
+//客户端第一帧为时间戳(hello), 服务端校验通过后才发送自己的 salt 和数据, 下行密钥同时由双方的 salt 派生
+type tunnelCodec struct {
+	tunnel    *Tunnel
+	salt      []byte
+	peerSalt  []byte
+	seal      cipher.AEAD
+	open      cipher.AEAD
+	sealNonce [kTunnelNonceSize]byte
+	openNonce [kTunnelNonceSize]byte
+	hello     bool
+	closed    bool
+	timer     *time.Timer
+	notify    func(err error)
+	in        []byte
+	out       []byte
+	queued    []byte
+}
+
+func incNonce(nonce *[kTunnelNonceSize]byte) {
+	for i := range nonce {
+		if nonce[i]++; nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *tunnelCodec) sealFrame(data []byte) {
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(data)))
+	c.out = c.seal.Seal(c.out, c.sealNonce[:], size[:], nil)
+	incNonce(&c.sealNonce)
+	c.out = c.seal.Seal(c.out, c.sealNonce[:], data, nil)
+	incNonce(&c.sealNonce)
+}
+
+//openFrame 解出一帧, 数据不足时返回 nil
+func (c *tunnelCodec) openFrame() ([]byte, error) {
+	overhead := c.open.Overhead()
+	if len(c.in) < 2+overhead {
+		return nil, nil
+	}
+	var size [2]byte
+	if _, err := c.open.Open(size[:0], c.openNonce[:], c.in[:2+overhead], nil); err != nil {
+		return nil, errTunnelAuth
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n > kTunnelMaxFrame {
+		return nil, errTunnelAuth
+	} else if len(c.in) < 2+overhead+n+overhead {
+		return nil, nil
+	}
+	nonce := c.openNonce
+	incNonce(&nonce)
+	data, err := c.open.Open(nil, nonce[:], c.in[2+overhead:2+overhead+n+overhead], nil)
+	if err != nil {
+		return nil, errTunnelAuth
+	}
+	incNonce(&nonce)
+	c.openNonce, c.in = nonce, c.in[2+overhead+n+overhead:]
+	if data == nil {
+		//空帧
+		data = []byte{}
+	}
+	return data, nil
+}
+
+func (c *tunnelCodec) Decode(in []byte) ([]byte, error) {
+	c.in = append(c.in, in...)
+	if c.open == nil {
+		if len(c.in) < kTunnelSaltSize {
+			return nil, nil
+		}
+		c.peerSalt, c.in = append([]byte(nil), c.in[:kTunnelSaltSize]...), c.in[kTunnelSaltSize:]
+		if c.tunnel.server {
+			c.open, _ = c.tunnel.aead(c.peerSalt, "tcp up")
+		} else {
+			c.open, _ = c.tunnel.aead(append(c.peerSalt, c.salt...), "tcp down")
+		}
+	}
+	var plain []byte
+	for {
+		data, err := c.openFrame()
+		if err != nil || data == nil {
+			return plain, err
+		}
+		if c.tunnel.server && !c.hello {
+			if err := c.onHello(data); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		plain = append(plain, data...)
+	}
+}
+
+//onHello 服务端校验客户端hello, 通过后发送自己的 salt 和暂存的数据
+func (c *tunnelCodec) onHello(data []byte) error {
+	if len(data) != kTunnelHelloSize {
+		return errTunnelHello
+	} else if !c.tunnel.accept(c.peerSalt, int64(binary.BigEndian.Uint64(data)), time.Now()) {
+		return errTunnelReplay
+	}
+	c.hello = true
+	c.timer.Stop()
+	c.salt = make([]byte, kTunnelSaltSize)
+	rand.Read(c.salt)
+	c.seal, _ = c.tunnel.aead(append(c.salt, c.peerSalt...), "tcp down")
+	c.out = append(c.out, c.salt...)
+	queued := c.queued
+	c.queued = nil
+	return c.Encode(queued)
+}
+
+//Encode 服务端在hello校验通过前暂存数据
+func (c *tunnelCodec) Encode(plain []byte) error {
+	if c.seal == nil {
+		c.queued = append(c.queued, plain...)
+		return nil
+	}
+	for len(plain) > 0 {
+		n := len(plain)
+		if n > kTunnelMaxFrame {
+			n = kTunnelMaxFrame
+		}
+		c.sealFrame(plain[:n])
+		plain = plain[n:]
+	}
+	return nil
+}
+
+func (c *tunnelCodec) Output() []byte {
+	out := c.out
+	c.out = nil
+	return out
+}
+
+func (c *tunnelCodec) SetNotify(fn func(err error)) {
+	c.notify = fn
+}
+
+func (c *tunnelCodec) Close() {
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
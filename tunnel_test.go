@@ -0,0 +1,263 @@
+package fdd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	accept := func(seq uint64) bool {
+		if !w.check(seq) {
+			return false
+		}
+		w.update(seq)
+		return true
+	}
+	steps := []struct {
+		seq uint64
+		ok  bool
+	}{
+		{0, true}, {0, false}, {2, true}, {1, true}, {1, false}, {2, false},
+		{100, true}, {37, true}, {36, false}, {37, false}, {99, true},
+		{200, true}, {137, true}, {136, false}, {100, false},
+	}
+	for i, s := range steps {
+		if accept(s.seq) != s.ok {
+			t.Fatalf("step %d: seq %d accepted %v", i, s.seq, !s.ok)
+		}
+	}
+}
+
+func TestTunnelUDP(t *testing.T) {
+	client, _ := NewTunnel(TunnelClient, "0123456789abcdef")
+	server, _ := NewTunnel(TunnelServer, "0123456789abcdef")
+	peer := SockAddrParse("10.0.0.1", 4000)
+	a, b := client.NewUDPSession(), client.NewUDPSession()
+
+	p1, p2 := a.Seal([]byte("one")), a.Seal([]byte("two"))
+	//乱序到达
+	if plain, err := server.OpenPacket(peer, p2); err != nil || string(plain) != "two" {
+		t.Fatalf("open p2: %q %v", plain, err)
+	}
+	if plain, err := server.OpenPacket(peer, p1); err != nil || string(plain) != "one" {
+		t.Fatalf("open p1: %q %v", plain, err)
+	}
+	//重放, 包括从其他地址重放
+	if _, err := server.OpenPacket(peer, p1); err != errTunnelReplay {
+		t.Fatalf("replayed p1: %v", err)
+	}
+	if _, err := server.OpenPacket(SockAddrParse("10.0.0.2", 4000), p2); err != errTunnelReplay {
+		t.Fatalf("replayed p2 from other peer: %v", err)
+	}
+	//篡改
+	bad := a.Seal([]byte("three"))
+	bad[len(bad)-1] ^= 1
+	if _, err := server.OpenPacket(peer, bad); err != errTunnelAuth {
+		t.Fatalf("tampered packet: %v", err)
+	}
+
+	//下行使用该地址最近的会话, 客户端同样拒绝重放
+	down, err := server.SealPacket(peer, []byte("reply"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := a.Open(down); err != nil || string(plain) != "reply" {
+		t.Fatalf("open reply: %q %v", plain, err)
+	}
+	if _, err := a.Open(down); err != errTunnelReplay {
+		t.Fatalf("replayed reply: %v", err)
+	}
+	if _, err := b.Open(down); err != errTunnelAuth {
+		t.Fatalf("reply opened by other session: %v", err)
+	}
+	if _, err := server.SealPacket(SockAddrParse("10.0.0.3", 4000), []byte("x")); err != errTunnelSession {
+		t.Fatalf("seal to unknown peer: %v", err)
+	}
+
+	//每个会话的密钥不同
+	pb := b.Seal([]byte("one"))
+	if string(pb[kTunnelUDPSaltSize:]) == string(p1[kTunnelUDPSaltSize:]) {
+		t.Fatal("sessions share key")
+	}
+	if plain, err := server.OpenPacket(peer, pb); err != nil || string(plain) != "one" {
+		t.Fatalf("open second session: %q %v", plain, err)
+	}
+}
+
+func TestTunnelUDPExpired(t *testing.T) {
+	client, _ := NewTunnel(TunnelClient, "0123456789abcdef")
+	server, _ := NewTunnel(TunnelServer, "0123456789abcdef")
+	u := client.NewUDPSession()
+	//构造时间戳过期的报文
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(time.Now().Add(-2*kTunnelMaxSkew).Unix()))
+	pkt := u.sealSeq(append([]byte(nil), u.salt...), append(buf, "old"...))
+	if _, err := server.OpenPacket(SockAddrParse("10.0.0.1", 4000), pkt); err != errTunnelReplay {
+		t.Fatalf("expired packet: %v", err)
+	}
+	if len(server.udpSalts) != 0 {
+		t.Fatal("session created by expired packet")
+	}
+	other, _ := NewTunnel(TunnelServer, "another key 0123")
+	if _, err := other.OpenPacket(SockAddrParse("10.0.0.1", 4000), u.Seal([]byte("x"))); err != errTunnelAuth {
+		t.Fatalf("wrong key: %v", err)
+	}
+}
+
+//newTunnelPair 创建使用相同密钥的隧道客户端和服务端
+func newTunnelPair(t *testing.T) (*Tunnel, *Tunnel) {
+	client, err := NewTunnel(TunnelClient, "0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewTunnel(TunnelServer, "0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+//helloAt 构造时间戳为 ts 的客户端首部(salt + hello帧)
+func helloAt(tun *Tunnel, ts time.Time, size int) []byte {
+	c := &tunnelCodec{tunnel: tun, salt: make([]byte, kTunnelSaltSize)}
+	rand.Read(c.salt)
+	c.seal, _ = tun.aead(c.salt, "tcp up")
+	c.out = append(c.out, c.salt...)
+	hello := make([]byte, size)
+	binary.BigEndian.PutUint64(hello, uint64(ts.Unix()))
+	c.sealFrame(hello)
+	return c.Output()
+}
+
+func TestTunnelCodecRoundTrip(t *testing.T) {
+	cli, srv := newTunnelPair(t)
+	ep := newTestLoop(t)
+	client, server := cli.NewCodec(ep), srv.NewCodec(ep)
+	defer client.Close()
+	defer server.Close()
+	//服务端在hello校验通过前暂存数据
+	server.Encode([]byte("world"))
+	if out := server.Output(); len(out) != 0 {
+		t.Fatalf("server sent %d bytes before hello", len(out))
+	}
+	big := bytes.Repeat([]byte("0123456789"), kTunnelMaxFrame/5)
+	client.Encode([]byte("hello"))
+	client.Encode(big)
+	up, err := server.Decode(client.Output())
+	if err != nil || !bytes.Equal(up, append([]byte("hello"), big...)) {
+		t.Fatalf("up: %d bytes, err %v", len(up), err)
+	}
+	down, err := client.Decode(server.Output())
+	if err != nil || string(down) != "world" {
+		t.Fatalf("down: %q %v", down, err)
+	}
+	server.Encode([]byte("again"))
+	if down, err = client.Decode(server.Output()); err != nil || string(down) != "again" {
+		t.Fatalf("down after hello: %q %v", down, err)
+	}
+}
+
+//TestTunnelCodecSplit 帧可能在任意位置被拆分到多次 Decode
+func TestTunnelCodecSplit(t *testing.T) {
+	cli, srv := newTunnelPair(t)
+	ep := newTestLoop(t)
+	client, server := cli.NewCodec(ep), srv.NewCodec(ep)
+	defer client.Close()
+	defer server.Close()
+	client.Encode([]byte("split across reads"))
+	var got []byte
+	for _, b := range client.Output() {
+		plain, err := server.Decode([]byte{b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, plain...)
+	}
+	if string(got) != "split across reads" {
+		t.Fatalf("got %q", got)
+	}
+	server.Encode([]byte("down"))
+	out := server.Output()
+	half := kTunnelSaltSize + 5
+	if plain, err := client.Decode(out[:half]); err != nil || len(plain) != 0 {
+		t.Fatalf("partial down: %q %v", plain, err)
+	}
+	if plain, err := client.Decode(out[half:]); err != nil || string(plain) != "down" {
+		t.Fatalf("rest of down: %q %v", plain, err)
+	}
+}
+
+func TestTunnelCodecTampered(t *testing.T) {
+	cli, srv := newTunnelPair(t)
+	ep := newTestLoop(t)
+	for _, at := range []int{kTunnelSaltSize, kTunnelSaltSize + 2 + 16 + 1, -1} {
+		client, server := cli.NewCodec(ep), srv.NewCodec(ep)
+		client.Encode([]byte("data"))
+		out := client.Output()
+		if at < 0 {
+			at = len(out) - 1
+		}
+		out[at] ^= 1
+		if _, err := server.Decode(out); err != errTunnelAuth {
+			t.Errorf("tampered at %d: %v", at, err)
+		}
+		client.Close()
+		server.Close()
+	}
+	other, _ := NewTunnel(TunnelServer, "another key 0123")
+	server := other.NewCodec(ep)
+	defer server.Close()
+	if _, err := server.Decode(helloAt(cli, time.Now(), kTunnelHelloSize)); err != errTunnelAuth {
+		t.Fatalf("wrong key: %v", err)
+	}
+}
+
+func TestTunnelCodecHello(t *testing.T) {
+	cli, srv := newTunnelPair(t)
+	ep := newTestLoop(t)
+	now := time.Now()
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"valid", helloAt(cli, now, kTunnelHelloSize), nil},
+		{"expired", helloAt(cli, now.Add(-2*kTunnelMaxSkew), kTunnelHelloSize), errTunnelReplay},
+		{"future", helloAt(cli, now.Add(2*kTunnelMaxSkew), kTunnelHelloSize), errTunnelReplay},
+		{"bad size", helloAt(cli, now, kTunnelHelloSize+1), errTunnelHello},
+	}
+	for _, tt := range tests {
+		server := srv.NewCodec(ep)
+		if _, err := server.Decode(tt.data); err != tt.err {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+		server.Close()
+	}
+}
+
+//TestTunnelCodecReplay 同一salt的hello重放到新连接时被 Tunnel.accept 拒绝
+func TestTunnelCodecReplay(t *testing.T) {
+	cli, srv := newTunnelPair(t)
+	ep := newTestLoop(t)
+	client := cli.NewCodec(ep)
+	defer client.Close()
+	client.Encode([]byte("once"))
+	captured := client.Output()
+	first := srv.NewCodec(ep)
+	defer first.Close()
+	if plain, err := first.Decode(captured); err != nil || string(plain) != "once" {
+		t.Fatalf("first: %q %v", plain, err)
+	}
+	replay := srv.NewCodec(ep)
+	defer replay.Close()
+	if plain, err := replay.Decode(captured); err != errTunnelReplay || len(plain) != 0 {
+		t.Fatalf("replayed: %q %v", plain, err)
+	}
+	if out := replay.Output(); len(out) != 0 {
+		t.Fatalf("server answered replayed hello with %d bytes", len(out))
+	}
+}
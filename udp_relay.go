@@ -1,109 +1,646 @@
 package fdd
 
 import (
+	"errors"
+	"net"
+	"time"
+
 	"github.com/rocinan/fdd/poller"
 	"golang.org/x/sys/unix"
 )
 
+const kUdpAssocQueue = 16
+
+type udpSession struct {
+	sock        int
+	local       int
+	reply       int
+	key         string
+	src         unix.Sockaddr
+	dst         unix.Sockaddr
+	proxyHeader []byte
+	lastActive  time.Time
+	assoc       *udpAssociate
+	tunnel      *TunnelUDP
+}
+
+//udpAssociate 经SOCKS5代理转发的会话: 控制连接完成 UDP ASSOCIATE 前报文暂存在 queued 中
+type udpAssociate struct {
+	ctrl      int
+	dialer    *Dialer
+	handshake *ProxyHandshake
+	header    []byte
+	queued    [][]byte
+	deadline  time.Time
+}
+
+//udpPending 待发送的报文, 本地应答的dns报文不属于会话, session 为空
+type udpPending struct {
+	fd      int
+	dir     int
+	pkt     []byte
+	to      unix.Sockaddr
+	session *udpSession
+}
+
+//client 返回限速所按的客户端地址
+func (p *udpPending) client() net.IP {
+	if p.session != nil {
+		return SockAddrIP(p.session.src)
+	}
+	return SockAddrIP(p.to)
+}
+
 type UDPRelay struct {
-	localSocket int
+	localSockets map[string]int
+	localAddrs   map[int]string
 
 	cfg           *Config
+	acl           *ACL
+	stats         *Stats
+	limiter       *Limiter
+	shaper        *Shaper
+	quota         *Quota
+	pending       []udpPending
+	dnsCache      *DNSCache
+	hostAddrs     *HostAddrs
 	eventLoop     *poller.EventLoop
-	remoteSocket  map[int]unix.SockaddrInet4
+	remoteSocket  map[int]*udpSession
 	remoteSrcAddr map[string]int
+	ctrlSocket    map[int]*udpSession
+	dialing       map[*udpSession]struct{}
+	upstream      *Upstream
+	tunnel        *Tunnel
+	mux           *Mux
+	lastSweep     time.Time
 }
 
-func NewUDPRelay(cfg *Config) (*UDPRelay, error) {
-	if fd, err := CreateUdpListenSocket(cfg.ListenAddr, cfg.ListenPort); err != nil {
+func NewUDPRelay(cfg *Config, stats *Stats, limiter *Limiter) (*UDPRelay, error) {
+	ur := &UDPRelay{
+		cfg:           cfg,
+		stats:         stats,
+		limiter:       limiter,
+		localSockets:  make(map[string]int),
+		localAddrs:    make(map[int]string),
+		remoteSocket:  make(map[int]*udpSession, cfg.HandlerCap),
+		remoteSrcAddr: make(map[string]int, cfg.HandlerCap),
+		ctrlSocket:    make(map[int]*udpSession),
+		dialing:       make(map[*udpSession]struct{}),
+	}
+	if err := ur.SyncListeners(); err != nil {
+		ur.closeListeners()
 		return nil, err
-	} else {
-		return &UDPRelay{
-			cfg:           cfg,
-			localSocket:   fd,
-			remoteSocket:  make(map[int]unix.SockaddrInet4, cfg.HandlerCap),
-			remoteSrcAddr: make(map[string]int, cfg.HandlerCap),
-		}, nil
+	}
+	return ur, nil
+}
+
+//listen 在addr上创建udp监听socket并按透明代理模式设置选项
+func (ur *UDPRelay) listen(addr string) (int, error) {
+	if path, _, ok := UnixPath(addr); ok {
+		return CreateUnixListenSocket(path, unix.SOCK_DGRAM, ur.cfg.UnixMode, ur.cfg.UnixOwner, ur.cfg.Tuning)
+	}
+	fd, err := CreateUdpListenSocket(addr, ur.cfg.ListenPort, ur.cfg.Tuning)
+	if err != nil {
+		return 0, err
+	}
+	sa, _ := unix.Getsockname(fd)
+	if ur.cfg.Transparent != "" {
+		if err := setUdpTransparent(fd, SockAddrFamily(sa), ur.cfg.Transparent); err != nil {
+			CloseSocket(fd)
+			return 0, err
+		}
+	} else if ur.cfg.ProxyProtocol == 2 {
+		//监听通配地址时 Getsockname 得不到客户端访问的地址, PROXY头中的目的地址取自报文的 pktinfo
+		if err := SetRecvPktInfo(fd, SockAddrFamily(sa)); err != nil {
+			CloseSocket(fd)
+			return 0, err
+		}
+	}
+	return fd, nil
+}
+
+//setUdpTransparent 透明代理模式下通过 IP_RECVORIGDSTADDR 获取原始目的地址, tproxy模式还需 IP_TRANSPARENT
+func setUdpTransparent(fd int, family int, mode string) error {
+	if mode == TransparentTProxy {
+		if err := SetTransparent(fd, family); err != nil {
+			return err
+		}
+	}
+	return SetRecvOrigDst(fd, family)
+}
+
+//SyncListeners 按 ListenAddr 当前解析出的地址新增或关闭监听socket, 关闭的地址上的会话一并关闭
+func (ur *UDPRelay) SyncListeners() error {
+	addrs, err := ResolveListenAddrs(ur.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	add, remove := diffListenAddrs(ur.localSockets, addrs)
+	for _, addr := range remove {
+		log.Info("[UDPRelay] stop listen on: ", addr)
+		ur.closeListener(addr)
+	}
+	err = nil
+	for _, addr := range add {
+		fd, lerr := ur.listen(addr)
+		if lerr != nil {
+			err = errors.New("listen on " + addr + " err: " + lerr.Error())
+			continue
+		}
+		ur.localSockets[addr], ur.localAddrs[fd] = fd, addr
+		if ur.eventLoop != nil {
+			ur.eventLoop.Register(fd, kPollIn|kPollErr, ur)
+		}
+		log.Info("[UDPRelay] listen on: ", addr)
+	}
+	return err
+}
+
+func (ur *UDPRelay) closeListener(addr string) {
+	fd := ur.localSockets[addr]
+	for s, session := range ur.remoteSocket {
+		if session.local == fd {
+			ur.closeSession(s)
+		}
+	}
+	if ur.eventLoop != nil {
+		ur.eventLoop.UnRegister(fd)
+	}
+	CloseSocket(fd)
+	RemoveUnixSocket(addr)
+	delete(ur.localSockets, addr)
+	delete(ur.localAddrs, fd)
+}
+
+func (ur *UDPRelay) closeListeners() {
+	for addr := range ur.localSockets {
+		ur.closeListener(addr)
 	}
 }
 
 func (ur *UDPRelay) AddToLoop(ep *poller.EventLoop) error {
 	ur.eventLoop = ep
-	return ur.eventLoop.Register(ur.localSocket, kPollIn|kPollErr, ur)
+	ur.eventLoop.AddTicker(ur)
+	for _, fd := range ur.localSockets {
+		if err := ur.eventLoop.Register(fd, kPollIn|kPollErr, ur); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//HandleTick 每秒检查一次, 关闭超过 UdpTimeOut 秒无数据的会话
+func (ur *UDPRelay) HandleTick(now time.Time) {
+	ur.flushPending()
+	for session := range ur.dialing {
+		session.assoc.dialer.Tick(now)
+	}
+	if ur.cfg.UdpTimeOut <= 0 || now.Sub(ur.lastSweep) < time.Second {
+		return
+	}
+	ur.lastSweep = now
+	timeout := time.Duration(ur.cfg.UdpTimeOut) * time.Second
+	for s, session := range ur.remoteSocket {
+		if session.assoc != nil && session.dst == nil && now.After(session.assoc.deadline) {
+			log.Warn("[UDPRelay] upstream udp associate timeout: ", Addr2Str(session.src))
+			ur.closeSession(s)
+		} else if now.Sub(session.lastActive) > timeout {
+			log.Debug("[UDPRelay] session timeout: ", Addr2Str(session.src))
+			ur.closeSession(s)
+		}
+	}
+}
+
+func (ur *UDPRelay) closeSession(s int) {
+	session := ur.remoteSocket[s]
+	ur.eventLoop.UnRegister(s)
+	CloseSocket(s)
+	if session.reply != INVALID_SOCKET {
+		CloseSocket(session.reply)
+	}
+	if assoc := session.assoc; assoc != nil && assoc.dialer != nil {
+		assoc.dialer.Close()
+		delete(ur.dialing, session)
+	} else if assoc != nil && assoc.ctrl != INVALID_SOCKET {
+		ur.eventLoop.UnRegister(assoc.ctrl)
+		CloseSocket(assoc.ctrl)
+		delete(ur.ctrlSocket, assoc.ctrl)
+	}
+	delete(ur.remoteSocket, s)
+	delete(ur.remoteSrcAddr, session.key)
+	ur.limiter.ReleaseUdp(SockAddrIP(session.src))
+	ur.stats.gauge(&ur.stats.UdpActive, -1)
 }
 
 func (ur *UDPRelay) HandleEvent(s, ev int) {
-	if s == ur.localSocket {
+	if _, ok := ur.localAddrs[s]; ok {
 		if Judge(ev & kPollErr) {
 			log.Warn("[UDPRelay] client socket event err: ", s, ev)
 			return
 		}
-		ur.handleClient()
+		ur.handleClient(s)
 	} else if s != INVALID_SOCKET {
 		if _, ok := ur.remoteSocket[s]; ok {
 			if Judge(ev & kPollErr) {
 				log.Warn("[UDPRealy] socket event err: ", s, ev)
-				ur.eventLoop.UnRegister(s)
+				ur.closeSession(s)
 				return
 			}
 			ur.handleRemote(s)
+		} else if session, ok := ur.ctrlSocket[s]; ok {
+			ur.handleCtrl(session, ev)
 		}
 	}
 }
 
-func (ur *UDPRelay) handleClient() {
+func (ur *UDPRelay) handleClient(local int) {
+	var (
+		n          int
+		sa, od, pd unix.Sockaddr
+		err        error
+	)
 	buf := make([]byte, kBuffSize)
-	n, sa, err := PacketRecv(ur.localSocket, &buf)
+	if ur.cfg.Transparent != "" {
+		n, sa, od, err = PacketRecvOrigDst(local, &buf)
+	} else if ur.cfg.ProxyProtocol == 2 {
+		n, sa, pd, err = PacketRecvOrigDst(local, &buf)
+	} else {
+		n, sa, err = PacketRecv(local, &buf)
+	}
 	if ok := CheckError("[UDPRelay] on local read err: ", err); !ok {
 		return
 	}
 	buf = buf[:n]
-	remoteSocket := 0
-	if s, ok := ur.remoteSrcAddr[MD5Addr(sa.Addr[:], sa.Port)]; !ok {
+	if ur.acl != nil && SockAddrIP(sa) != nil && !ur.acl.Allowed(SockAddrIP(sa)) {
+		log.Debug("[UDPRelay] drop pkg from: ", Addr2Str(sa))
+		ur.stats.add(&ur.stats.UdpDropped)
+		return
+	}
+	if ur.tunnel != nil && ur.tunnel.server {
+		if buf, err = ur.tunnel.OpenPacket(sa, buf); err != nil {
+			log.Debug("[UDPRelay] drop tunnel pkg from ", Addr2Str(sa), ": ", err)
+			ur.stats.add(&ur.stats.UdpDropped)
+			return
+		}
+	}
+	if ur.dnsCache != nil {
+		if answer, handled := ur.dnsCache.OnQuery(local, sa, buf); handled {
+			if answer != nil {
+				ur.sendLocal(udpPending{fd: local, dir: kStreamDown, pkt: answer, to: sa})
+			}
+			return
+		}
+	}
+	//监听多个地址时同一客户端端口可能发往不同的监听地址, 按监听地址区分会话
+	remoteSocket, key := 0, Addr2Str(sa)+"|"+ur.localAddrs[local]
+	if ur.cfg.Transparent != "" {
+		if od == nil {
+			log.Debug("[UDPRelay] no original dst, drop pkg from: ", Addr2Str(sa))
+			ur.stats.add(&ur.stats.UdpDropped)
+			return
+		}
+		//同一客户端端口可能发往多个原始目的地址, 按来源和目的区分会话
+		key += Addr2Str(od)
+	}
+	if s, ok := ur.remoteSrcAddr[key]; !ok {
+		if ur.quota != nil && !ur.quota.Allow(SockAddrIP(sa)) {
+			log.Debug("[UDPRelay] quota exceeded, drop session from: ", Addr2Str(sa))
+			ur.stats.add(&ur.stats.UdpDropped)
+			return
+		}
+		if !ur.limiter.AcquireUdp(SockAddrIP(sa)) {
+			log.Debug("[UDPRelay] limit session from: ", Addr2Str(sa))
+			ur.stats.add(&ur.stats.UdpDropped)
+			return
+		}
 		log.Info("[UDPRelay] new client : ", Addr2Str(sa))
-		if ns, err := CreateUdpRemoteSocket(); err != nil {
+		var backend Backend
+		reply := INVALID_SOCKET
+		if ur.cfg.Transparent != "" {
+			target, mapped := ur.cfg.TransparentTarget(od)
+			if !mapped && target.Port == ur.cfg.ListenPort && ur.hostAddrs.IsLocal(SockAddrIP(od)) {
+				log.Info("[UDPRelay] not redirected, drop session from: ", Addr2Str(sa))
+				ur.limiter.ReleaseUdp(SockAddrIP(sa))
+				return
+			}
+			if ur.cfg.Transparent == TransparentTProxy {
+				if reply, err = CreateUdpReplySocket(od); err != nil {
+					log.Error("[UDPRelay] create reply socket on ", Addr2Str(od), " err: ", err)
+					ur.limiter.ReleaseUdp(SockAddrIP(sa))
+					return
+				}
+			}
+			backend = target
+		} else {
+			//udp无连接, 取地址族偏好排序后的第一个后端
+			backend = OrderBackends(ur.cfg.RemoteBackends())[0]
+		}
+		var assoc *udpAssociate
+		dst := TargetSockAddr(backend.Addr, backend.Port)
+		if ur.upstream != nil {
+			//中继地址在 UDP ASSOCIATE 完成后才知道, 按代理地址的地址族创建socket
+			assoc, err = ur.associate(backend)
+			first := ur.upstream.First()
+			dst = SockAddrParse(first.Addr, first.Port)
+		}
+		if ur.mux != nil {
+			//多路复用流的socket已连接, 发送时不指定地址
+			dst = nil
+		}
+		ns := INVALID_SOCKET
+		if err == nil {
+			ns, err = ur.createRemote(sa, dst)
+		}
+		if err == nil && ur.dnsCache != nil && assoc == nil && SockAddrIP(dst) != nil {
+			//只接收来自上游的应答, 其他地址伪造的应答由内核丢弃
+			if err = unix.Connect(ns, dst); err != nil {
+				CloseSocket(ns)
+			}
+		}
+		if err != nil {
 			log.Error("[UDPRelay] create remote socket err: ", err)
+			ur.limiter.ReleaseUdp(SockAddrIP(sa))
+			if reply != INVALID_SOCKET {
+				CloseSocket(reply)
+			}
 			return
 		} else {
 			remoteSocket = ns
-			ur.remoteSocket[ns] = *sa
-			ur.remoteSrcAddr[MD5Addr(sa.Addr[:], sa.Port)] = ns
+			session := &udpSession{sock: ns, local: local, reply: reply, key: key, src: sa, dst: dst, assoc: assoc}
+			if assoc != nil {
+				session.dst = nil
+			}
+			if ur.tunnel != nil && !ur.tunnel.server {
+				session.tunnel = ur.tunnel.NewUDPSession()
+			}
+			if ur.cfg.ProxyProtocol == 2 {
+				dst, _ := unix.Getsockname(local)
+				if od != nil {
+					dst = od
+				} else if pd != nil {
+					dst = SockAddrParse(SockAddrIP(pd).String(), SockAddrPort(dst))
+				}
+				session.proxyHeader = BuildProxyHeaderV2(sa, dst, true)
+			}
+			ur.remoteSocket[ns] = session
+			ur.remoteSrcAddr[key] = ns
 			ur.eventLoop.Register(ns, kPollIn, ur)
+			ur.stats.add(&ur.stats.UdpSessions)
+			ur.stats.gauge(&ur.stats.UdpActive, 1)
+			if assoc != nil {
+				ur.dialCtrl(session)
+			}
 		}
+	} else if ur.quota != nil && !ur.quota.Allow(SockAddrIP(sa)) {
+		log.Debug("[UDPRelay] quota exceeded, close session from: ", Addr2Str(sa))
+		ur.stats.add(&ur.stats.UdpDropped)
+		ur.closeSession(s)
+		return
 	} else {
 		remoteSocket = s
 	}
-	if err := PacketSend(remoteSocket, &buf, SockAddrParse(ur.cfg.RemoteAddr, ur.cfg.RemotePort)); err != nil {
-		if err == unix.EAGAIN {
-			log.Warn("[UDPRelay] send pkg to remote err: EAGAIN")
-		} else {
-			log.Error("[udp_relay] send pkg to remote err: ", err)
+	session := ur.remoteSocket[remoteSocket]
+	session.lastActive = time.Now()
+	if ur.quota != nil {
+		ur.quota.Add(SockAddrIP(sa), kStreamUp, n)
+	}
+	if session.proxyHeader != nil {
+		buf = append(session.proxyHeader[:len(session.proxyHeader):len(session.proxyHeader)], buf...)
+	}
+	if session.tunnel != nil {
+		buf = session.tunnel.Seal(buf)
+	}
+	if session.assoc != nil {
+		buf = append(session.assoc.header[:len(session.assoc.header):len(session.assoc.header)], buf...)
+		if session.dst == nil {
+			if len(session.assoc.queued) < kUdpAssocQueue {
+				session.assoc.queued = append(session.assoc.queued, buf)
+			} else {
+				ur.stats.add(&ur.stats.UdpDropped)
+			}
+			return
 		}
 	}
-
+	ur.shapeSend(udpPending{fd: remoteSocket, dir: kStreamUp, pkt: buf, to: session.dst, session: session})
 }
 
 func (ur *UDPRelay) handleRemote(s int) {
-	buf, src := make([]byte, kBuffSize), ur.remoteSocket[s]
+	buf, session := make([]byte, kBuffSize), ur.remoteSocket[s]
 	n, _, err := PacketRecv(s, &buf)
 	if ok := CheckError("[UDPRelay] on remote read err: ", err); !ok {
 		return
 	}
+	if n == 0 && ur.mux != nil {
+		//多路复用流已被对端关闭
+		ur.closeSession(s)
+		return
+	}
 	buf = buf[:n]
-	CheckError("[UDPRelay] on send pkg to local err: ", PacketSend(ur.localSocket, &buf, &src))
+	if session.assoc != nil {
+		//去掉SOCKS5 UDP报文头, 不支持分片
+		if n < 3 || buf[2] != 0 {
+			ur.stats.add(&ur.stats.UdpDropped)
+			return
+		}
+		_, _, hn, err := ParseSocksAddr(buf[3:])
+		if err != nil {
+			ur.stats.add(&ur.stats.UdpDropped)
+			return
+		}
+		buf = buf[3+hn:]
+	}
+	if ur.quota != nil && !ur.quota.Allow(SockAddrIP(session.src)) {
+		log.Debug("[UDPRelay] quota exceeded, close session from: ", Addr2Str(session.src))
+		ur.stats.add(&ur.stats.UdpDropped)
+		ur.closeSession(s)
+		return
+	}
+	session.lastActive = time.Now()
+	if ur.quota != nil {
+		ur.quota.Add(SockAddrIP(session.src), kStreamDown, n)
+	}
+	if session.tunnel != nil {
+		if buf, err = session.tunnel.Open(buf); err != nil {
+			log.Debug("[UDPRelay] drop tunnel pkg from remote: ", err)
+			ur.stats.add(&ur.stats.UdpDropped)
+			return
+		}
+	}
+	if ur.dnsCache != nil {
+		if replies, ok := ur.dnsCache.OnAnswer(buf); ok {
+			if len(replies) == 0 {
+				ur.stats.add(&ur.stats.UdpDropped)
+			}
+			//等待同一查询的客户端可能属于其他会话, 各自经收到查询的socket应答
+			for _, r := range replies {
+				ur.sendLocal(udpPending{fd: r.fd, dir: kStreamDown, pkt: r.pkt, to: r.src})
+			}
+			return
+		}
+	}
+	fd := session.local
+	if session.reply != INVALID_SOCKET {
+		fd = session.reply
+	}
+	ur.sendLocal(udpPending{fd: fd, dir: kStreamDown, pkt: buf, to: session.src, session: session})
 }
 
-func (ur *UDPRelay) Close() {
-	for s := range ur.remoteSocket {
-		ur.eventLoop.UnRegister(s)
-		if s != INVALID_SOCKET {
-			CloseSocket(s)
+//sendLocal 向客户端发送报文, 隧道服务端先加密, 再经限速发送
+func (ur *UDPRelay) sendLocal(p udpPending) {
+	if v, ok := p.to.(*unix.SockaddrUnix); ok && v.Name == "" {
+		//未绑定地址的unix数据报客户端无法接收应答
+		return
+	}
+	if ur.tunnel != nil && ur.tunnel.server {
+		var err error
+		if p.pkt, err = ur.tunnel.SealPacket(p.to, p.pkt); err != nil {
+			log.Debug("[UDPRelay] drop tunnel pkg to ", Addr2Str(p.to), ": ", err)
+			ur.stats.add(&ur.stats.UdpDropped)
+			return
+		}
+	}
+	ur.shapeSend(p)
+}
+
+//createRemote 创建会话的后端socket, 多路复用客户端在已有连接上打开一个udp流
+func (ur *UDPRelay) createRemote(sa, dst unix.Sockaddr) (int, error) {
+	if ur.mux != nil {
+		return ur.mux.Open(kMuxStreamUDP, sa, nil)
+	}
+	return CreateUdpRemoteSocket(SockAddrFamily(dst), ur.cfg.RemoteSocketOpts(sa))
+}
+
+//associate 创建经SOCKS5代理转发的会话状态, 会话建立后由 dialCtrl 连接代理并开始 UDP ASSOCIATE 握手
+func (ur *UDPRelay) associate(target Backend) (*udpAssociate, error) {
+	header, err := AppendSocksAddr([]byte{0, 0, 0}, target.Addr, target.Port)
+	if err != nil {
+		return nil, err
+	}
+	return &udpAssociate{
+		ctrl:      INVALID_SOCKET,
+		handshake: ur.upstream.NewHandshake(target, true),
+		header:    header,
+		deadline:  time.Now().Add(kConnTimeout),
+	}, nil
+}
+
+//dialCtrl 在eventLoop中连接代理, 连接建立后发送握手请求, 控制连接关闭时会话随之关闭
+func (ur *UDPRelay) dialCtrl(session *udpSession) {
+	assoc := session.assoc
+	assoc.dialer = NewDialer(ur.eventLoop, []Backend{ur.upstream.First()}, ur.cfg.RemoteSocketOpts(session.src), func(fd int, _ Backend, err error) {
+		assoc.dialer = nil
+		delete(ur.dialing, session)
+		if err == nil {
+			assoc.ctrl = fd
+			ur.ctrlSocket[fd] = session
+			if err = ur.eventLoop.Register(fd, kPollIn|kPollErr, ur); err == nil {
+				out := assoc.handshake.Start()
+				_, err = BufferSend(fd, &out)
+			}
+		}
+		if err != nil {
+			log.Warn("[UDPRelay] udp associate with upstream err: ", err)
+			ur.closeSession(session.sock)
+		}
+	})
+	ur.dialing[session] = struct{}{}
+	assoc.dialer.Start()
+}
+
+//handleCtrl 处理控制连接的握手应答, 完成后发送暂存的报文
+func (ur *UDPRelay) handleCtrl(session *udpSession, ev int) {
+	assoc := session.assoc
+	buf := make([]byte, kBuffSize)
+	n, err := BufferRecv(assoc.ctrl, &buf)
+	if err == unix.EAGAIN {
+		return
+	} else if err != nil || n <= 0 || Judge(ev&kPollErr) {
+		log.Debug("[UDPRelay] upstream control conn closed: ", Addr2Str(session.src))
+		ur.closeSession(session.sock)
+		return
+	}
+	if session.dst != nil {
+		return
+	}
+	out, done, _, err := assoc.handshake.Feed(buf[:n])
+	if err == nil && len(out) != 0 {
+		_, err = BufferSend(assoc.ctrl, &out)
+	}
+	if err != nil {
+		log.Warn("[UDPRelay] upstream udp associate err: ", err)
+		ur.closeSession(session.sock)
+		return
+	} else if !done {
+		return
+	}
+	session.dst = assoc.handshake.Bound
+	if ip := SockAddrIP(session.dst); ip == nil || ip.IsUnspecified() {
+		//代理返回未指定地址时使用代理本身的地址
+		first := ur.upstream.First()
+		session.dst = SockAddrParse(first.Addr, SockAddrPort(session.dst))
+	}
+	log.Debug("[UDPRelay] upstream udp relay for ", Addr2Str(session.src), ": ", Addr2Str(session.dst))
+	for _, pkt := range assoc.queued {
+		ur.shapeSend(udpPending{fd: session.sock, dir: kStreamUp, pkt: pkt, to: session.dst, session: session})
+	}
+	assoc.queued, assoc.handshake = nil, nil
+}
+
+//shapeSend 限速检查后发送, 令牌不足时按配置延迟或丢弃
+func (ur *UDPRelay) shapeSend(p udpPending) {
+	if ur.shaper != nil {
+		if ur.shaper.Available(rateLimit{}, p.client(), p.dir, 1) <= 0 {
+			if ur.cfg.UdpShapeDelay && len(ur.pending) < kUdpShapeQueue {
+				ur.pending = append(ur.pending, p)
+			} else {
+				ur.stats.add(&ur.stats.UdpDropped)
+			}
+			return
 		}
-		delete(ur.remoteSocket, s)
+		ur.shaper.Consume(rateLimit{}, p.client(), p.dir, len(p.pkt))
 	}
-	ur.eventLoop.UnRegister(ur.localSocket)
-	if ur.localSocket != INVALID_SOCKET {
-		CloseSocket(ur.localSocket)
+	ur.sendPacket(p)
+}
+
+func (ur *UDPRelay) sendPacket(p udpPending) {
+	if err := PacketSend(p.fd, &p.pkt, p.to); err != nil {
+		if p.dir == kStreamDown {
+			log.Warn("[UDPRelay] on send pkg to local err: ", err)
+		} else if err == unix.EAGAIN {
+			log.Warn("[UDPRelay] send pkg to remote err: EAGAIN")
+		} else {
+			log.Error("[udp_relay] send pkg to remote err: ", err)
+		}
+	}
+}
+
+//flushPending 发送令牌已补充的延迟报文, 每个来源各自保持先后顺序
+func (ur *UDPRelay) flushPending() {
+	if len(ur.pending) == 0 {
+		return
+	}
+	blocked, rest := make(map[string]bool), ur.pending[:0]
+	for _, p := range ur.pending {
+		if p.session != nil && ur.remoteSocket[p.session.sock] != p.session {
+			continue
+		}
+		ip := p.client()
+		key := string(ip.To16()) + string(rune(p.dir))
+		if blocked[key] || ur.shaper.Available(rateLimit{}, ip, p.dir, 1) <= 0 {
+			blocked[key] = true
+			rest = append(rest, p)
+			continue
+		}
+		ur.shaper.Consume(rateLimit{}, ip, p.dir, len(p.pkt))
+		ur.sendPacket(p)
+	}
+	ur.pending = rest
+}
+
+func (ur *UDPRelay) Close() {
+	for s := range ur.remoteSocket {
+		ur.closeSession(s)
 	}
+	ur.closeListeners()
 	log.Info("[UDPRelay] udp relay service exit.")
 }
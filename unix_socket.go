@@ -0,0 +1,127 @@
+package fdd
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	UnixScheme     = "unix:"
+	UnixgramScheme = "unixgram:"
+)
+
+//UnixPath 解析 unix:/path(流式) 或 unixgram:/path(数据报) 地址, 以@开头的路径为抽象地址
+func UnixPath(addr string) (path string, dgram bool, ok bool) {
+	if strings.HasPrefix(addr, UnixgramScheme) {
+		return strings.TrimPrefix(addr, UnixgramScheme), true, true
+	}
+	if strings.HasPrefix(addr, UnixScheme) {
+		return strings.TrimPrefix(addr, UnixScheme), false, true
+	}
+	return "", false, false
+}
+
+//CreateUnixListenSocket 创建unix socket监听, sotype为 SOCK_STREAM 或 SOCK_DGRAM,
+//路径上残留的socket文件会被删除, mode/owner 非空时设置文件权限和属主, 流式socket的backlog取自st
+func CreateUnixListenSocket(path string, sotype int, mode os.FileMode, owner string, st *SocketTuning) (int, error) {
+	if path == "" {
+		return 0, errors.New("invalid unix socket path")
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return 0, err
+	}
+	fd, err := unix.Socket(unix.AF_UNIX, sotype, 0)
+	if err != nil {
+		return 0, err
+	}
+	//设置权限或属主前socket文件只允许本用户访问, 避免chmod/chown之前被其他用户连接
+	restrict := path[0] != '@' && (mode != 0 || owner != "")
+	var old int
+	if restrict {
+		old = unix.Umask(0177)
+	}
+	err = unix.Bind(fd, &unix.SockaddrUnix{Name: path})
+	if restrict {
+		unix.Umask(old)
+	}
+	if err != nil {
+		CloseSocket(fd)
+		return 0, err
+	}
+	if path[0] != '@' {
+		if err := setSocketFilePerm(path, mode, owner); err != nil {
+			CloseSocket(fd)
+			os.Remove(path)
+			return 0, err
+		}
+	}
+	if sotype == unix.SOCK_STREAM {
+		if err := unix.Listen(fd, st.backlog()); err != nil {
+			CloseSocket(fd)
+			return 0, err
+		}
+	}
+	SetNoBlock(fd)
+	return fd, nil
+}
+
+//RemoveUnixSocket 关闭监听后删除socket文件
+func RemoveUnixSocket(addr string) {
+	if path, _, ok := UnixPath(addr); ok && path != "" && path[0] != '@' {
+		os.Remove(path)
+	}
+}
+
+func removeStaleSocket(path string) error {
+	if path[0] == '@' {
+		return nil
+	}
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.New(path + " exists and is not a socket")
+	}
+	return os.Remove(path)
+}
+
+//setSocketFilePerm owner 格式为 user, user:group 或 :group, 支持名称和数字id
+func setSocketFilePerm(path string, mode os.FileMode, owner string) error {
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if owner == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	parts := strings.SplitN(owner, ":", 2)
+	if parts[0] != "" {
+		if id, err := strconv.Atoi(parts[0]); err == nil {
+			uid = id
+		} else if u, err := user.Lookup(parts[0]); err != nil {
+			return err
+		} else {
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		if id, err := strconv.Atoi(parts[1]); err == nil {
+			gid = id
+		} else if g, err := user.LookupGroup(parts[1]); err != nil {
+			return err
+		} else {
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return os.Chown(path, uid, gid)
+}
@@ -0,0 +1,334 @@
+package fdd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	UpstreamSocks5 = "socks5"
+	UpstreamHTTP   = "http"
+)
+
+const (
+	kSocksVersion     = 0x05
+	kSocksAuthNone    = 0x00
+	kSocksAuthPass    = 0x02
+	kSocksAuthNoMatch = 0xff
+	kSocksCmdConnect  = 0x01
+	kSocksCmdUDP      = 0x03
+	kSocksAtypIPv4    = 0x01
+	kSocksAtypDomain  = 0x03
+	kSocksAtypIPv6    = 0x04
+)
+
+const (
+	kHsSocksMethod = iota
+	kHsSocksAuth
+	kHsSocksReply
+	kHsHTTPReply
+	kHsSocksRequest
+)
+
+var (
+	errHandshakeNeedMore = errors.New("handshake: need more data")
+	errSocksHostTooLong  = errors.New("socks5: host name too long")
+)
+
+//UpstreamHop 上游代理链中的一跳
+type UpstreamHop struct {
+	Scheme string
+	Host   string
+	Port   int
+	User   string
+	Pass   string
+}
+
+//Upstream 经过一个或多个 SOCKS5/HTTP CONNECT 代理连接目标, 第一跳直接连接, 之后每一跳由上一跳代理连接
+type Upstream struct {
+	hops  []UpstreamHop
+	first Backend
+}
+
+//NewUpstream 解析代理链, 每项格式为 socks5://[user:pass@]host:port 或 http://[user:pass@]host:port,
+//第一跳的域名在此时按 family 解析, 之后各跳和目标的域名由代理解析
+func NewUpstream(list []string, family string) (*Upstream, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	u := &Upstream{}
+	for _, v := range list {
+		pu, err := url.Parse(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		if pu.Scheme != UpstreamSocks5 && pu.Scheme != UpstreamHTTP {
+			return nil, errors.New("unsupported upstream proxy: " + v)
+		}
+		port, err := strconv.Atoi(pu.Port())
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, errors.New("invalid upstream proxy port: " + v)
+		}
+		hop := UpstreamHop{Scheme: pu.Scheme, Host: pu.Hostname(), Port: port}
+		if pu.User != nil {
+			hop.User = pu.User.Username()
+			hop.Pass, _ = pu.User.Password()
+		}
+		if hop.Scheme == UpstreamSocks5 && (len(hop.User) > 255 || len(hop.Pass) > 255) {
+			return nil, errors.New("socks5 username or password too long")
+		} else if len(hop.Host) > 255 {
+			return nil, errors.New("upstream proxy host too long: " + v)
+		}
+		u.hops = append(u.hops, hop)
+	}
+	addr := u.hops[0].Host
+	if net.ParseIP(addr) == nil {
+		ips, err := GetDomainIps(addr, family)
+		if err != nil {
+			return nil, err
+		} else if len(ips) == 0 {
+			return nil, errors.New("no address for upstream proxy: " + addr)
+		}
+		addr = ips[0]
+	}
+	u.first = Backend{Addr: addr, Port: u.hops[0].Port, Host: u.hops[0].Host}
+	return u, nil
+}
+
+//First 返回需要直接连接的第一跳代理
+func (u *Upstream) First() Backend {
+	return u.first
+}
+
+//SupportsUDP 只有单跳SOCKS5代理支持 UDP ASSOCIATE
+func (u *Upstream) SupportsUDP() bool {
+	return len(u.hops) == 1 && u.hops[0].Scheme == UpstreamSocks5
+}
+
+//NewHandshake 创建经代理链连接 target 的握手状态机, udp 为true时向单跳SOCKS5代理请求 UDP ASSOCIATE
+func (u *Upstream) NewHandshake(target Backend, udp bool) *ProxyHandshake {
+	return &ProxyHandshake{hops: u.hops, target: target, udp: udp}
+}
+
+//ProxyHandshake 非阻塞的代理握手状态机, 只处理字节, 由调用方负责socket读写
+type ProxyHandshake struct {
+	hops   []UpstreamHop
+	target Backend
+	udp    bool
+	hop    int
+	state  int
+	in     []byte
+	//Bound UDP ASSOCIATE 返回的中继地址
+	Bound unix.Sockaddr
+}
+
+//Start 返回握手的第一段数据
+func (h *ProxyHandshake) Start() []byte {
+	return h.greet()
+}
+
+//Feed 输入从代理读到的数据, 返回需要发送的数据; done 为true时握手完成, rest 为握手之后已读到的数据
+func (h *ProxyHandshake) Feed(data []byte) (out []byte, done bool, rest []byte, err error) {
+	h.in = append(h.in, data...)
+	for {
+		var reply []byte
+		var hopDone bool
+		switch h.state {
+		case kHsSocksMethod:
+			reply, err = h.onSocksMethod()
+		case kHsSocksAuth:
+			reply, err = h.onSocksAuth()
+		case kHsSocksReply:
+			hopDone, err = h.onSocksReply()
+		case kHsHTTPReply:
+			hopDone, err = h.onHTTPReply()
+		}
+		if err == errHandshakeNeedMore {
+			return out, false, nil, nil
+		} else if err != nil {
+			return nil, false, nil, err
+		}
+		out = append(out, reply...)
+		if !hopDone {
+			continue
+		}
+		if h.hop++; h.hop == len(h.hops) {
+			return out, true, h.in, nil
+		}
+		out = append(out, h.greet()...)
+	}
+}
+
+//nextAddr 当前一跳需要连接的地址: 下一跳代理或最终目标
+func (h *ProxyHandshake) nextAddr() (string, int) {
+	if h.udp {
+		return "0.0.0.0", 0
+	} else if h.hop+1 < len(h.hops) {
+		return h.hops[h.hop+1].Host, h.hops[h.hop+1].Port
+	}
+	return h.target.Addr, h.target.Port
+}
+
+func (h *ProxyHandshake) greet() []byte {
+	hop := h.hops[h.hop]
+	if hop.Scheme == UpstreamHTTP {
+		h.state = kHsHTTPReply
+		host, port := h.nextAddr()
+		hostport := net.JoinHostPort(host, strconv.Itoa(port))
+		req := "CONNECT " + hostport + " HTTP/1.1\r\nHost: " + hostport + "\r\n"
+		if hop.User != "" {
+			req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(hop.User+":"+hop.Pass)) + "\r\n"
+		}
+		return []byte(req + "\r\n")
+	}
+	h.state = kHsSocksMethod
+	if hop.User != "" {
+		return []byte{kSocksVersion, 2, kSocksAuthNone, kSocksAuthPass}
+	}
+	return []byte{kSocksVersion, 1, kSocksAuthNone}
+}
+
+func (h *ProxyHandshake) onSocksMethod() ([]byte, error) {
+	if len(h.in) < 2 {
+		return nil, errHandshakeNeedMore
+	}
+	ver, method := h.in[0], h.in[1]
+	h.in = h.in[2:]
+	if ver != kSocksVersion {
+		return nil, errors.New("socks5: invalid version")
+	}
+	switch method {
+	case kSocksAuthNone:
+		return h.socksRequest()
+	case kSocksAuthPass:
+		hop := h.hops[h.hop]
+		if hop.User == "" {
+			return nil, errors.New("socks5: proxy requires username/password")
+		}
+		h.state = kHsSocksAuth
+		req := append([]byte{0x01, byte(len(hop.User))}, hop.User...)
+		req = append(append(req, byte(len(hop.Pass))), hop.Pass...)
+		return req, nil
+	}
+	return nil, errors.New("socks5: no acceptable auth method")
+}
+
+func (h *ProxyHandshake) onSocksAuth() ([]byte, error) {
+	if len(h.in) < 2 {
+		return nil, errHandshakeNeedMore
+	}
+	status := h.in[1]
+	h.in = h.in[2:]
+	if status != 0 {
+		return nil, errors.New("socks5: authentication failed")
+	}
+	return h.socksRequest()
+}
+
+func (h *ProxyHandshake) socksRequest() ([]byte, error) {
+	h.state = kHsSocksReply
+	cmd := byte(kSocksCmdConnect)
+	if h.udp {
+		cmd = kSocksCmdUDP
+	}
+	host, port := h.nextAddr()
+	return AppendSocksAddr([]byte{kSocksVersion, cmd, 0}, host, port)
+}
+
+func (h *ProxyHandshake) onSocksReply() (bool, error) {
+	if len(h.in) < 4 {
+		return false, errHandshakeNeedMore
+	}
+	if h.in[0] != kSocksVersion {
+		return false, errors.New("socks5: invalid version")
+	} else if h.in[1] != 0 {
+		return false, errors.New("socks5: request failed, reply code " + strconv.Itoa(int(h.in[1])))
+	}
+	host, port, n, err := ParseSocksAddr(h.in[3:])
+	if err != nil {
+		return false, err
+	}
+	if h.udp {
+		h.Bound = SockAddrParse(host, port)
+	}
+	h.in = h.in[3+n:]
+	return true, nil
+}
+
+func (h *ProxyHandshake) onHTTPReply() (bool, error) {
+	end := bytes.Index(h.in, kHeaderEnd)
+	if end < 0 {
+		if len(h.in) > kMaxPeekSize {
+			return false, errors.New("http connect: response too long")
+		}
+		return false, errHandshakeNeedMore
+	}
+	status := strings.SplitN(string(h.in[:bytes.IndexByte(h.in, '\r')]), " ", 3)
+	if len(status) < 2 || !strings.HasPrefix(status[0], "HTTP/1.") {
+		return false, errors.New("http connect: invalid response")
+	} else if len(status[1]) != 3 || status[1][0] != '2' {
+		return false, errors.New("http connect: " + strings.Join(status[1:], " "))
+	}
+	h.in = h.in[end+len(kHeaderEnd):]
+	return true, nil
+}
+
+//AppendSocksAddr 追加SOCKS5地址: ip按地址族编码, 其余按域名编码, 域名超过255字节时返回错误
+func AppendSocksAddr(b []byte, host string, port int) ([]byte, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return appendSocksIP(b, ip, port), nil
+	} else if len(host) > 255 {
+		return nil, errSocksHostTooLong
+	}
+	b = append(append(b, kSocksAtypDomain, byte(len(host))), host...)
+	return appendUint16(b, uint16(port)), nil
+}
+
+//appendSocksIP 追加ip形式的SOCKS5地址, ip为空时填 0.0.0.0
+func appendSocksIP(b []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, kSocksAtypIPv4), ip4...)
+	} else if ip != nil {
+		b = append(append(b, kSocksAtypIPv6), ip.To16()...)
+	} else {
+		b = append(append(b, kSocksAtypIPv4), net.IPv4zero.To4()...)
+	}
+	return appendUint16(b, uint16(port))
+}
+
+//ParseSocksAddr 解析SOCKS5地址, 返回主机、端口和占用的字节数
+func ParseSocksAddr(b []byte) (host string, port int, n int, err error) {
+	if len(b) < 1 {
+		return "", 0, 0, errHandshakeNeedMore
+	}
+	switch b[0] {
+	case kSocksAtypIPv4:
+		n = 1 + net.IPv4len
+	case kSocksAtypIPv6:
+		n = 1 + net.IPv6len
+	case kSocksAtypDomain:
+		if len(b) < 2 {
+			return "", 0, 0, errHandshakeNeedMore
+		}
+		n = 2 + int(b[1])
+	default:
+		return "", 0, 0, errors.New("socks5: invalid address type")
+	}
+	if len(b) < n+2 {
+		return "", 0, 0, errHandshakeNeedMore
+	}
+	if b[0] == kSocksAtypDomain {
+		host = string(b[2:n])
+	} else {
+		host = net.IP(b[1:n]).String()
+	}
+	return host, int(binary.BigEndian.Uint16(b[n:])), n + 2, nil
+}
@@ -0,0 +1,205 @@
+package fdd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewUpstreamInvalid(t *testing.T) {
+	tests := []string{
+		"ftp://127.0.0.1:21",
+		"socks5://127.0.0.1",
+		"socks5://127.0.0.1:0",
+		"http://127.0.0.1:70000",
+		"socks5://" + strings.Repeat("u", 256) + ":p@127.0.0.1:1080",
+		"http://" + strings.Repeat("a", 256) + ":8080",
+	}
+	for _, v := range tests {
+		if _, err := NewUpstream([]string{v}, FamilyPreferV4); err == nil {
+			t.Errorf("%q: want error", v)
+		}
+	}
+}
+
+func TestParseSocksAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		host string
+		port int
+		n    int
+		err  error
+	}{
+		{"ipv4", "\x01\x0a\x00\x00\x01\x00\x50", "10.0.0.1", 80, 7, nil},
+		{"ipv4 trailing", "\x01\x0a\x00\x00\x01\x00\x50rest", "10.0.0.1", 80, 7, nil},
+		{"ipv6", "\x04" + strings.Repeat("\x00", 15) + "\x01\x01\xbb", "::1", 443, 19, nil},
+		{"domain", "\x03\x0bexample.com\x01\xbb", "example.com", 443, 15, nil},
+		{"empty domain", "\x03\x00\x00\x35", "", 53, 4, nil},
+		{"empty", "", "", 0, 0, errHandshakeNeedMore},
+		{"domain no length", "\x03", "", 0, 0, errHandshakeNeedMore},
+		{"domain truncated", "\x03\x0bexample", "", 0, 0, errHandshakeNeedMore},
+		{"ipv6 truncated", "\x04\x00\x00", "", 0, 0, errHandshakeNeedMore},
+		{"no port", "\x01\x0a\x00\x00\x01\x00", "", 0, 0, errHandshakeNeedMore},
+	}
+	for _, tt := range tests {
+		host, port, n, err := ParseSocksAddr([]byte(tt.in))
+		if host != tt.host || port != tt.port || n != tt.n || err != tt.err {
+			t.Errorf("%s: got %q %d %d %v", tt.name, host, port, n, err)
+		}
+	}
+	if _, _, _, err := ParseSocksAddr([]byte{0x02, 0, 0}); err == nil || err == errHandshakeNeedMore {
+		t.Errorf("bad atyp: err = %v", err)
+	}
+}
+
+func TestAppendSocksAddr(t *testing.T) {
+	for _, host := range []string{"10.0.0.1", "::ffff:10.0.0.1", "2001:db8::1", "example.com", strings.Repeat("a", 255)} {
+		b, err := AppendSocksAddr(nil, host, 8080)
+		if err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		got, port, n, err := ParseSocksAddr(b)
+		want := host
+		if host == "::ffff:10.0.0.1" {
+			want = "10.0.0.1"
+		}
+		if err != nil || got != want || port != 8080 || n != len(b) {
+			t.Errorf("%s: round trip got %q %d %d %v", host, got, port, n, err)
+		}
+	}
+	if b, err := AppendSocksAddr([]byte{1}, strings.Repeat("a", 256), 80); err != errSocksHostTooLong || b != nil {
+		t.Errorf("long host: got %v %v", b, err)
+	}
+	if b := appendSocksIP(nil, nil, 0); string(b) != "\x01\x00\x00\x00\x00\x00\x00" {
+		t.Errorf("nil ip: got %q", b)
+	}
+}
+
+//hsStep 握手中的一次输入和期望的输出
+type hsStep struct {
+	in   string
+	out  string
+	done bool
+	err  bool
+}
+
+func TestProxyHandshake(t *testing.T) {
+	const (
+		connect = "\x05\x01\x00\x03\x0bexample.com\x01\xbb"
+		okReply = "\x05\x00\x00\x01\x00\x00\x00\x00\x00\x00"
+		httpReq = "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"
+	)
+	target := Backend{Addr: "example.com", Port: 443}
+	tests := []struct {
+		name   string
+		chain  []string
+		target Backend
+		start  string
+		steps  []hsStep
+		rest   string
+	}{
+		{"socks5", []string{"socks5://127.0.0.1:1080"}, target, "\x05\x01\x00", []hsStep{
+			{in: "\x05\x00", out: connect},
+			{in: okReply + "data", done: true},
+		}, "data"},
+		{"socks5 partial reply", []string{"socks5://127.0.0.1:1080"}, target, "\x05\x01\x00", []hsStep{
+			{in: "\x05"},
+			{in: "\x00", out: connect},
+			{in: okReply[:5]},
+			{in: okReply[5:], done: true},
+		}, ""},
+		{"socks5 auth", []string{"socks5://u:p@127.0.0.1:1080"}, target, "\x05\x02\x00\x02", []hsStep{
+			{in: "\x05\x02", out: "\x01\x01u\x01p"},
+			{in: "\x01\x00", out: connect},
+			{in: okReply, done: true},
+		}, ""},
+		{"socks5 auth failed", []string{"socks5://u:p@127.0.0.1:1080"}, target, "\x05\x02\x00\x02", []hsStep{
+			{in: "\x05\x02", out: "\x01\x01u\x01p"},
+			{in: "\x01\x01", err: true},
+		}, ""},
+		{"socks5 auth required", []string{"socks5://127.0.0.1:1080"}, target, "\x05\x01\x00", []hsStep{
+			{in: "\x05\x02", err: true},
+		}, ""},
+		{"socks5 no method", []string{"socks5://127.0.0.1:1080"}, target, "\x05\x01\x00", []hsStep{
+			{in: "\x05\xff", err: true},
+		}, ""},
+		{"socks5 bad version", []string{"socks5://127.0.0.1:1080"}, target, "\x05\x01\x00", []hsStep{
+			{in: "\x04\x00", err: true},
+		}, ""},
+		{"socks5 refused", []string{"socks5://127.0.0.1:1080"}, target, "\x05\x01\x00", []hsStep{
+			{in: "\x05\x00", out: connect},
+			{in: "\x05\x05\x00\x01\x00\x00\x00\x00\x00\x00", err: true},
+		}, ""},
+		{"socks5 bad reply addr", []string{"socks5://127.0.0.1:1080"}, target, "\x05\x01\x00", []hsStep{
+			{in: "\x05\x00", out: connect},
+			{in: "\x05\x00\x00\x09\x00\x00", err: true},
+		}, ""},
+		{"socks5 host too long", []string{"socks5://127.0.0.1:1080"}, Backend{Addr: strings.Repeat("a", 256), Port: 80}, "\x05\x01\x00", []hsStep{
+			{in: "\x05\x00", err: true},
+		}, ""},
+		{"http", []string{"http://127.0.0.1:8080"}, target, httpReq, []hsStep{
+			{in: "HTTP/1.1 200 Connection established\r\n"},
+			{in: "\r\ndata", done: true},
+		}, "data"},
+		{"http auth", []string{"http://u:p@127.0.0.1:8080"}, target, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic dTpw\r\n\r\n", []hsStep{
+			{in: "HTTP/1.0 200 OK\r\n\r\n", done: true},
+		}, ""},
+		{"http denied", []string{"http://127.0.0.1:8080"}, target, httpReq, []hsStep{
+			{in: "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n", err: true},
+		}, ""},
+		{"http invalid", []string{"http://127.0.0.1:8080"}, target, httpReq, []hsStep{
+			{in: "SSH-2.0\r\n\r\n", err: true},
+		}, ""},
+		{"http status without reason", []string{"http://127.0.0.1:8080"}, target, httpReq, []hsStep{
+			{in: "HTTP/1.1 20\r\n\r\n", err: true},
+		}, ""},
+		{"http too long", []string{"http://127.0.0.1:8080"}, target, httpReq, []hsStep{
+			{in: "HTTP/1.1 200 OK\r\n" + strings.Repeat("X: y\r\n", kMaxPeekSize/6+1), err: true},
+		}, ""},
+		{"chain", []string{"socks5://127.0.0.1:1080", "http://10.0.0.2:8080"}, target, "\x05\x01\x00", []hsStep{
+			{in: "\x05\x00", out: "\x05\x01\x00\x01\x0a\x00\x00\x02\x1f\x90"},
+			{in: okReply, out: httpReq},
+			{in: "HTTP/1.1 200 OK\r\n\r\n", done: true},
+		}, ""},
+	}
+	for _, tt := range tests {
+		u, err := NewUpstream(tt.chain, FamilyPreferV4)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		h := u.NewHandshake(tt.target, false)
+		if out := string(h.Start()); out != tt.start {
+			t.Errorf("%s: start %q, want %q", tt.name, out, tt.start)
+			continue
+		}
+		for i, step := range tt.steps {
+			out, done, rest, err := h.Feed([]byte(step.in))
+			if (err != nil) != step.err || done != step.done || string(out) != step.out {
+				t.Errorf("%s step %d: got %q %v %v, want %q %v err %v", tt.name, i, out, done, err, step.out, step.done, step.err)
+				break
+			}
+			if done && string(rest) != tt.rest {
+				t.Errorf("%s: rest %q, want %q", tt.name, rest, tt.rest)
+			}
+		}
+	}
+}
+
+func TestProxyHandshakeUDP(t *testing.T) {
+	u, err := NewUpstream([]string{"socks5://127.0.0.1:1080"}, FamilyPreferV4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := u.NewHandshake(Backend{Addr: "10.0.0.1", Port: 53}, true)
+	h.Start()
+	out, _, _, err := h.Feed([]byte("\x05\x00"))
+	if err != nil || string(out) != "\x05\x03\x00\x01\x00\x00\x00\x00\x00\x00" {
+		t.Fatalf("udp associate request %q %v", out, err)
+	}
+	if _, done, _, err := h.Feed([]byte("\x05\x00\x00\x01\x7f\x00\x00\x01\x12\x34")); !done || err != nil {
+		t.Fatalf("udp associate reply: %v %v", done, err)
+	}
+	if Addr2Str(h.Bound) != "127.0.0.1:4660" {
+		t.Fatalf("bound %s", Addr2Str(h.Bound))
+	}
+}